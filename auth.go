@@ -0,0 +1,720 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pairedDevicesFile = "memory/paired-devices.json"
+
+// Name of the cookie that carries the device token for browser clients
+const tokenCookieName = "orion_token"
+
+// Secret that opens the settings page, created on first start. The tray menu
+// and the startup log link to the page with it, the page keeps it as a cookie.
+const (
+	adminSecretFile = "memory/admin-secret"
+	adminCookieName = "orion_admin"
+)
+
+const (
+	pairingPINLength   = 6
+	pairingPINLifetime = 10 * time.Minute
+	// Failed PIN attempts allowed per pairingLockout window
+	pairingMaxFailures = 5
+	pairingLockout     = 1 * time.Minute
+)
+
+// Device types clients pair or register as
+const (
+	deviceTypePC     = "pc"
+	deviceTypeMobile = "mobile"
+)
+
+// Longest device name accepted when pairing or registering
+const maxDeviceNameLength = 64
+
+// Paired device structure, the token itself is only stored as a hash
+type PairedDevice struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Groups    []string  `json:"groups,omitempty"`
+	TokenHash string    `json:"tokenHash,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed"`
+	// PublicKey: key other devices encrypt end-to-end messages to, see handleKeys
+	PublicKey *DeviceKey `json:"publicKey,omitempty"`
+}
+
+// AuthManager issues pairing PINs and validates per-device tokens
+type AuthManager struct {
+	devices       map[string]*PairedDevice // keyed by token hash
+	pin           string
+	pinExpires    time.Time
+	failures      int
+	failuresReset time.Time
+	adminSecret   string
+	mutex         sync.Mutex
+}
+
+var authManager = NewAuthManager()
+
+func NewAuthManager() *AuthManager {
+	return &AuthManager{
+		devices: make(map[string]*PairedDevice),
+	}
+}
+
+// Load paired devices and the admin secret from file
+func (am *AuthManager) Load() error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if err := am.loadAdminSecret(); err != nil {
+		return err
+	}
+
+	fileData, err := os.ReadFile(pairedDevicesFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("[DEBUG] Auth: No paired devices yet\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var devices []*PairedDevice
+	if err := json.Unmarshal(fileData, &devices); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		am.devices[device.TokenHash] = device
+	}
+
+	fmt.Printf("[DEBUG] Auth: Loaded %d paired devices\n", len(am.devices))
+	return nil
+}
+
+// Read the admin secret, generating it on first start. Caller must hold the mutex.
+func (am *AuthManager) loadAdminSecret() error {
+	fileData, err := os.ReadFile(adminSecretFile)
+	if err == nil && len(strings.TrimSpace(string(fileData))) > 0 {
+		am.adminSecret = strings.TrimSpace(string(fileData))
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(adminSecretFile), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(adminSecretFile, []byte(secret), 0600); err != nil {
+		return err
+	}
+	am.adminSecret = secret
+	fmt.Printf("[INFO] Auth: Created admin secret in %s\n", adminSecretFile)
+	return nil
+}
+
+// Check a secret against the admin secret
+func (am *AuthManager) IsAdmin(secret string) bool {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	return secret != "" && am.adminSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(am.adminSecret)) == 1
+}
+
+// Link to the settings page that signs the browser in as admin
+func settingsURL() string {
+	authManager.mutex.Lock()
+	secret := authManager.adminSecret
+	authManager.mutex.Unlock()
+	host := getCurrentServerHost()
+	if host == "" {
+		// Listening on all interfaces
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s:%s/settings/?admin=%s", serverScheme(), host, serverPort, secret)
+}
+
+// Save paired devices to file, caller must hold the mutex
+func (am *AuthManager) save() error {
+	devices := make([]*PairedDevice, 0, len(am.devices))
+	for _, device := range am.devices {
+		devices = append(devices, device)
+	}
+
+	jsonData, err := json.MarshalIndent(devices, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pairedDevicesFile, jsonData, 0600)
+}
+
+// Get the current pairing PIN, generating a fresh one if it expired
+func (am *AuthManager) CurrentPIN() (string, time.Time) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	if am.pin == "" || time.Now().After(am.pinExpires) {
+		am.rotatePIN()
+	}
+	return am.pin, am.pinExpires
+}
+
+// Replace the pairing PIN, invalidating the old one
+func (am *AuthManager) RegeneratePIN() (string, time.Time) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	am.rotatePIN()
+	return am.pin, am.pinExpires
+}
+
+func (am *AuthManager) rotatePIN() {
+	max := big.NewInt(1)
+	for i := 0; i < pairingPINLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	am.pin = fmt.Sprintf("%0*d", pairingPINLength, n)
+	am.pinExpires = time.Now().Add(pairingPINLifetime)
+	fmt.Printf("[INFO] Pairing PIN: %s (valid until %s)\n", am.pin, am.pinExpires.Format("15:04:05"))
+}
+
+// Exchange a pairing PIN for a new device token
+func (am *AuthManager) Pair(pin, name, deviceType string) (string, *PairedDevice, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	now := time.Now()
+	if now.After(am.failuresReset) {
+		am.failures = 0
+		am.failuresReset = now.Add(pairingLockout)
+	}
+	if am.failures >= pairingMaxFailures {
+		return "", nil, errPairingLocked
+	}
+
+	if am.pin == "" || now.After(am.pinExpires) ||
+		subtle.ConstantTimeCompare([]byte(pin), []byte(am.pin)) != 1 {
+		am.failures++
+		return "", nil, errPairingInvalid
+	}
+
+	token, device, err := am.addDevice(name, deviceType)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// A PIN pairs exactly one device
+	am.rotatePIN()
+
+	fmt.Printf("[INFO] Auth: Paired device %s (%s, %s)\n", device.ID, device.Name, device.Type)
+	return token, device, nil
+}
+
+// Issue a token for a device without a PIN, for clients that are already trusted
+func (am *AuthManager) Register(name, deviceType string) (string, *PairedDevice, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	token, device, err := am.addDevice(name, deviceType)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fmt.Printf("[INFO] Auth: Registered device %s (%s, %s)\n", device.ID, device.Name, device.Type)
+	return token, device, nil
+}
+
+// Create and save a new device with a fresh token, caller must hold the mutex
+func (am *AuthManager) addDevice(name, deviceType string) (string, *PairedDevice, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	device := &PairedDevice{
+		ID:        "dev_" + id,
+		Name:      name,
+		Type:      deviceType,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		LastUsed:  now,
+	}
+	am.devices[device.TokenHash] = device
+	if err := am.save(); err != nil {
+		delete(am.devices, device.TokenHash)
+		return "", nil, err
+	}
+
+	deviceCopy := *device
+	return token, &deviceCopy, nil
+}
+
+// Change the name and type a device registered with
+func (am *AuthManager) UpdateDevice(id, name, deviceType string) (*PairedDevice, error) {
+	return am.changeDevice(id, func(device *PairedDevice) {
+		device.Name = name
+		device.Type = deviceType
+	})
+}
+
+// Replace the groups of a device, only ever done by the admin
+func (am *AuthManager) SetGroups(id string, groups []string) (*PairedDevice, error) {
+	return am.changeDevice(id, func(device *PairedDevice) {
+		device.Groups = groups
+	})
+}
+
+// Apply a change to a device and save it
+func (am *AuthManager) changeDevice(id string, change func(device *PairedDevice)) (*PairedDevice, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	for _, device := range am.devices {
+		if device.ID == id {
+			change(device)
+			if err := am.save(); err != nil {
+				return nil, err
+			}
+			deviceCopy := *device
+			return &deviceCopy, nil
+		}
+	}
+	return nil, errDeviceNotFound
+}
+
+// Replace the public key of a device, nil removes it. Returns the key it had before.
+func (am *AuthManager) SetPublicKey(id string, key *DeviceKey) (*DeviceKey, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	for _, device := range am.devices {
+		if device.ID == id {
+			previous := device.PublicKey
+			device.PublicKey = key
+			if err := am.save(); err != nil {
+				device.PublicKey = previous
+				return nil, err
+			}
+			return previous, nil
+		}
+	}
+	return nil, errDeviceNotFound
+}
+
+// Look up a device by ID
+func (am *AuthManager) Device(id string) (*PairedDevice, bool) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	for _, device := range am.devices {
+		if device.ID == id {
+			deviceCopy := *device
+			return &deviceCopy, true
+		}
+	}
+	return nil, false
+}
+
+// Look up the device a token belongs to
+func (am *AuthManager) Validate(token string) (*PairedDevice, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	device, ok := am.devices[hashToken(token)]
+	if !ok {
+		return nil, false
+	}
+	device.LastUsed = time.Now()
+	deviceCopy := *device
+	return &deviceCopy, true
+}
+
+// List paired devices, oldest first
+func (am *AuthManager) Devices() []PairedDevice {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	devices := make([]PairedDevice, 0, len(am.devices))
+	for _, device := range am.devices {
+		devices = append(devices, *device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].CreatedAt.Before(devices[j].CreatedAt)
+	})
+	return devices
+}
+
+// Revoke a paired device by ID
+func (am *AuthManager) Revoke(id string) error {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+
+	for hash, device := range am.devices {
+		if device.ID == id {
+			delete(am.devices, hash)
+			fmt.Printf("[INFO] Auth: Revoked device %s (%s)\n", device.ID, device.Name)
+			return am.save()
+		}
+	}
+	return errDeviceNotFound
+}
+
+var (
+	errPairingInvalid = fmt.Errorf("invalid or expired pairing PIN")
+	errPairingLocked  = fmt.Errorf("too many failed pairing attempts")
+	errDeviceNotFound = fmt.Errorf("device not found")
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Write a file via a temp file and rename so readers never see a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Get the device token from the request (header, query or cookie)
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(tokenCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Get the admin secret from the settings page cookie or an Authorization header
+func requestAdminSecret(r *http.Request) string {
+	if cookie, err := r.Cookie(adminCookieName); err == nil {
+		return cookie.Value
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// Check if a request carries the admin secret
+func isAdminRequest(r *http.Request) bool {
+	return authManager.IsAdmin(requestAdminSecret(r))
+}
+
+// Check if a request is allowed to access items, files and sockets
+func isAuthorized(r *http.Request) bool {
+	if !currentSettings().RequirePairing || isAdminRequest(r) {
+		return true
+	}
+	_, ok := authManager.Validate(requestToken(r))
+	return ok
+}
+
+// Require a paired device token or the admin secret
+func requireDevice(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthorized(r) {
+			fmt.Printf("[ERROR] Auth: Unauthorized request to %s from %s\n", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Unauthorized, pair this device first", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Require the admin secret, used for settings and device management
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(r) {
+			fmt.Printf("[ERROR] Auth: Rejected admin request to %s from %s\n", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Forbidden, open the settings from the tray menu or the link in the server log", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Exchange the admin secret of a settings link for a cookie. Returns true if
+// the request was answered, the redirect drops the secret from the address bar.
+func handleAdminLink(w http.ResponseWriter, r *http.Request) bool {
+	secret := r.URL.Query().Get("admin")
+	if secret == "" {
+		return false
+	}
+	if !authManager.IsAdmin(secret) {
+		fmt.Printf("[ERROR] Auth: Invalid admin link from %s\n", r.RemoteAddr)
+		http.Error(w, "Invalid admin link", http.StatusForbidden)
+		return true
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    secret,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	return true
+}
+
+// Check the Origin of a request: the server's own pages, browser extensions
+// and non-browser clients, which send none. Pages on other sites are refused.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if strings.HasPrefix(origin, "chrome-extension://") || strings.HasPrefix(origin, "moz-extension://") {
+		return true
+	}
+	originHost := origin
+	if i := strings.Index(originHost, "://"); i >= 0 {
+		originHost = originHost[i+3:]
+	}
+	return strings.EqualFold(originHost, r.Host)
+}
+
+// Handle pairing endpoint: GET reports whether the caller is paired, POST exchanges a PIN for a token
+func handlePair(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Pair endpoint called - Method: %s\n", r.Method)
+
+	switch r.Method {
+	case "GET":
+		status := map[string]interface{}{
+			"paired":   isAuthorized(r),
+			"required": currentSettings().RequirePairing,
+		}
+		if device := requestDevice(r); device != nil {
+			status["deviceId"] = device.ID
+			status["deviceName"] = device.Name
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case "POST":
+		var pairData struct {
+			PIN  string `json:"pin"`
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&pairData); err != nil {
+			fmt.Printf("[ERROR] Pair: Invalid JSON: %v\n", err)
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(pairData.Name) == "" {
+			pairData.Name = "Unnamed device"
+		}
+		name, deviceType, err := validateDeviceInfo(pairData.Name, pairData.Type)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, device, err := authManager.Pair(strings.TrimSpace(pairData.PIN), name, deviceType)
+		switch err {
+		case nil:
+		case errPairingLocked:
+			http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+			return
+		case errPairingInvalid:
+			fmt.Printf("[ERROR] Pair: Invalid PIN from %s\n", r.RemoteAddr)
+			http.Error(w, "Invalid or expired PIN", http.StatusUnauthorized)
+			return
+		default:
+			fmt.Printf("[ERROR] Pair: Error pairing device: %v\n", err)
+			http.Error(w, "Error pairing device", http.StatusInternalServerError)
+			return
+		}
+
+		setTokenCookie(w, r, token)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "success",
+			"token":    token,
+			"deviceId": device.ID,
+		})
+		fmt.Printf("[DEBUG] Pair: Response sent successfully\n")
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Check and normalize a device name and type
+func validateDeviceInfo(name, deviceType string) (string, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", "", fmt.Errorf("Device name is required")
+	}
+	if len(name) > maxDeviceNameLength {
+		return "", "", fmt.Errorf("Device name is too long (max %d characters)", maxDeviceNameLength)
+	}
+
+	switch deviceType {
+	case deviceTypePC, deviceTypeMobile:
+	case "":
+		deviceType = deviceTypeMobile
+	default:
+		return "", "", fmt.Errorf("Device type must be %q or %q", deviceTypePC, deviceTypeMobile)
+	}
+	return name, deviceType, nil
+}
+
+// Browsers get the token as a cookie so downloads and sockets just work
+func setTokenCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Handle pairing PIN endpoint: GET shows the current PIN, POST issues a new one
+func handlePairingPIN(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Pairing PIN endpoint called - Method: %s\n", r.Method)
+
+	var pin string
+	var expires time.Time
+	switch r.Method {
+	case "GET":
+		pin, expires = authManager.CurrentPIN()
+	case "POST":
+		pin, expires = authManager.RegeneratePIN()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pin":       pin,
+		"expiresAt": expires,
+		"url":       fmt.Sprintf("%s://%s:%s/mobile/?pin=%s", serverScheme(), getCurrentServerHost(), serverPort, pin),
+	})
+}
+
+// Handle paired devices endpoint: GET lists devices, PATCH /tokens/{id} with
+// {"groups"} sets the groups of one and DELETE /tokens/{id} revokes it
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Tokens endpoint called - Method: %s\n", r.Method)
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/tokens"), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		devices := authManager.Devices()
+		for i := range devices {
+			devices[i].TokenHash = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+
+	case r.Method == "PATCH" && id != "":
+		var groupsData struct {
+			Groups []string `json:"groups"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&groupsData); err != nil {
+			fmt.Printf("[ERROR] Tokens: Invalid JSON: %v\n", err)
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		groups, err := validateDeviceGroups(groupsData.Groups)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		device, err := authManager.SetGroups(id, groups)
+		if err == errDeviceNotFound {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Printf("[ERROR] Tokens: Error setting groups of device %s: %v\n", id, err)
+			http.Error(w, "Error updating device", http.StatusInternalServerError)
+			return
+		}
+		connectionManager.UpdateDevice(*device)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "id": id, "groups": device.Groups})
+
+	case r.Method == "DELETE" && id != "":
+		device, _ := authManager.Device(id)
+		if err := authManager.Revoke(id); err == errDeviceNotFound {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Printf("[ERROR] Tokens: Error revoking device %s: %v\n", id, err)
+			http.Error(w, "Error revoking device", http.StatusInternalServerError)
+			return
+		}
+		deliveryQueue.RemoveDevice(id)
+		// Nobody can encrypt to a revoked device anymore
+		if device != nil && device.PublicKey != nil {
+			connectionManager.BroadcastEvent("key_removed", map[string]string{"deviceId": id})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success", "id": id})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
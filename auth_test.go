@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Use a fresh auth manager with its admin secret for the rest of the test
+func useTestAuthManager(t *testing.T) *AuthManager {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	am := NewAuthManager()
+	if err := am.Load(); err != nil {
+		t.Fatal(err)
+	}
+	savedManager, savedSettings := authManager, serverSettings
+	authManager = am
+	serverSettings.RequirePairing = true
+	t.Cleanup(func() {
+		authManager, serverSettings = savedManager, savedSettings
+	})
+	return am
+}
+
+func TestIsAuthorized(t *testing.T) {
+	am := useTestAuthManager(t)
+	token, device, err := am.Register("Laptop", deviceTypePC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(remoteAddr string, setup func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest("GET", "/pc/items", nil)
+		r.RemoteAddr = remoteAddr
+		if setup != nil {
+			setup(r)
+		}
+		return r
+	}
+	tests := []struct {
+		name  string
+		r     *http.Request
+		want  bool
+		admin bool
+	}{
+		{"no token", request("192.168.1.20:5000", nil), false, false},
+		// The server machine is no exception, pages in its browser call from there
+		{"loopback without token", request("127.0.0.1:5000", nil), false, false},
+		{"bearer token", request("192.168.1.20:5000", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }), true, false},
+		{"query token", request("192.168.1.20:5000", func(r *http.Request) { r.URL.RawQuery = "token=" + token }), true, false},
+		{"cookie token", request("192.168.1.20:5000", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: tokenCookieName, Value: token}) }), true, false},
+		{"wrong token", request("192.168.1.20:5000", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token+"0") }), false, false},
+		{"admin cookie", request("127.0.0.1:5000", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: adminCookieName, Value: am.adminSecret}) }), true, true},
+		{"admin bearer", request("127.0.0.1:5000", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+am.adminSecret) }), true, true},
+		{"device token is no admin secret", request("127.0.0.1:5000", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: adminCookieName, Value: token}) }), false, false},
+	}
+	for _, tt := range tests {
+		if got := isAuthorized(tt.r); got != tt.want {
+			t.Errorf("%s: isAuthorized = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := isAdminRequest(tt.r); got != tt.admin {
+			t.Errorf("%s: isAdminRequest = %v, want %v", tt.name, got, tt.admin)
+		}
+	}
+
+	// Revoked tokens stop working at once
+	if err := am.Revoke(device.ID); err != nil {
+		t.Fatal(err)
+	}
+	if isAuthorized(tests[2].r) {
+		t.Errorf("revoked token still authorized")
+	}
+	if err := am.Revoke(device.ID); err != errDeviceNotFound {
+		t.Errorf("second revoke: err = %v", err)
+	}
+
+	// Without pairing every device is let in, settings still need the secret
+	serverSettings.RequirePairing = false
+	if !isAuthorized(tests[0].r) || isAdminRequest(tests[0].r) {
+		t.Errorf("pairing off: authorized %v, admin %v", isAuthorized(tests[0].r), isAdminRequest(tests[0].r))
+	}
+}
+
+func TestAuthManagerPersistence(t *testing.T) {
+	am := useTestAuthManager(t)
+	token, device, _ := am.Register("Phone", deviceTypeMobile)
+	am.SetGroups(device.ID, []string{"family"})
+	revokedToken, revoked, _ := am.Register("Old phone", deviceTypeMobile)
+	am.Revoke(revoked.ID)
+
+	// Tokens, revocations and the admin secret survive a restart
+	reloaded := NewAuthManager()
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reloaded.Validate(token); !ok || got.ID != device.ID || len(got.Groups) != 1 {
+		t.Errorf("reloaded device = %+v, %v", got, ok)
+	}
+	if _, ok := reloaded.Validate(revokedToken); ok {
+		t.Errorf("revoked device came back after a restart")
+	}
+	if !reloaded.IsAdmin(am.adminSecret) || reloaded.IsAdmin("") {
+		t.Errorf("admin secret changed on restart")
+	}
+}
+
+func TestPairingLockout(t *testing.T) {
+	am := useTestAuthManager(t)
+	pin, _ := am.CurrentPIN()
+	wrong := "000000"
+	if pin == wrong {
+		wrong = "111111"
+	}
+
+	for i := 0; i < pairingMaxFailures; i++ {
+		if _, _, err := am.Pair(wrong, "Guess", deviceTypeMobile); err != errPairingInvalid {
+			t.Fatalf("attempt %d: err = %v", i+1, err)
+		}
+	}
+	// Locked out, even the right PIN is refused until the window ends
+	if _, _, err := am.Pair(pin, "Phone", deviceTypeMobile); err != errPairingLocked {
+		t.Fatalf("after %d failures: err = %v", pairingMaxFailures, err)
+	}
+
+	am.mutex.Lock()
+	am.failuresReset = time.Now().Add(-time.Second)
+	am.mutex.Unlock()
+	token, device, err := am.Pair(pin, "Phone", deviceTypeMobile)
+	if err != nil || token == "" {
+		t.Fatalf("after the lockout: err = %v", err)
+	}
+	if got, ok := am.Validate(token); !ok || got.ID != device.ID {
+		t.Errorf("paired token not valid")
+	}
+
+	// A PIN pairs one device only
+	if _, _, err := am.Pair(pin, "Second phone", deviceTypeMobile); err != errPairingInvalid {
+		t.Errorf("reused PIN: err = %v", err)
+	}
+	am.mutex.Lock()
+	am.pinExpires = time.Now().Add(-time.Second)
+	expired := am.pin
+	am.mutex.Unlock()
+	if _, _, err := am.Pair(expired, "Late phone", deviceTypeMobile); err != errPairingInvalid {
+		t.Errorf("expired PIN: err = %v", err)
+	}
+}
+
+func TestHandlePair(t *testing.T) {
+	am := useTestAuthManager(t)
+	pin, _ := am.CurrentPIN()
+
+	pair := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handlePair(w, httptest.NewRequest("POST", "/pair", strings.NewReader(body)))
+		return w
+	}
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"invalid JSON", `{"pin":`, http.StatusBadRequest},
+		{"name too long", `{"pin":"` + pin + `","name":"` + strings.Repeat("x", maxDeviceNameLength+1) + `"}`, http.StatusBadRequest},
+		{"unknown type", `{"pin":"` + pin + `","name":"Phone","type":"family"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := pair(tt.body); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// Refused requests don't use up the PIN, names are trimmed and defaulted
+	w := pair(`{"pin":" ` + pin + ` ","name":"  "}`)
+	var response struct {
+		Token    string `json:"token"`
+		DeviceID string `json:"deviceId"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("pair: status %d, err %v", w.Code, err)
+	}
+	if device, ok := am.Validate(response.Token); !ok || device.Name != "Unnamed device" || device.Type != deviceTypeMobile {
+		t.Errorf("paired device = %+v, %v", device, ok)
+	}
+}
+
+func TestHandleTokensGroups(t *testing.T) {
+	am := useTestAuthManager(t)
+	_, phone, _ := am.Register("Phone", deviceTypeMobile)
+
+	patch := func(id, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleTokens(w, httptest.NewRequest("PATCH", "/tokens/"+id, strings.NewReader(body)))
+		return w
+	}
+	if w := patch(phone.ID, `{"groups":[" Family ","family","kids"]}`); w.Code != http.StatusOK {
+		t.Fatalf("set groups: status %d", w.Code)
+	}
+	if device, _ := am.Device(phone.ID); strings.Join(device.Groups, ",") != "family,kids" {
+		t.Errorf("groups = %q", device.Groups)
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+	}{
+		{"invalid group", phone.ID, `{"groups":["a b"]}`, http.StatusBadRequest},
+		{"invalid JSON", phone.ID, `{"groups":`, http.StatusBadRequest},
+		{"unknown device", "dev_missing", `{"groups":["family"]}`, http.StatusNotFound},
+		{"no device", "", `{"groups":["family"]}`, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := patch(tt.id, tt.body); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// An empty list takes the device out of every group
+	patch(phone.ID, `{"groups":[]}`)
+	if device, _ := am.Device(phone.ID); len(device.Groups) != 0 {
+		t.Errorf("groups after clearing = %q", device.Groups)
+	}
+}
+
+func TestHandleAdminLink(t *testing.T) {
+	am := useTestAuthManager(t)
+
+	w := httptest.NewRecorder()
+	if !handleAdminLink(w, httptest.NewRequest("GET", "/settings/?admin="+am.adminSecret, nil)) {
+		t.Fatal("admin link not handled")
+	}
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/settings/" || len(cookies) != 1 ||
+		cookies[0].Name != adminCookieName || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Errorf("admin link: status %d, location %q, cookies %+v", w.Code, w.Header().Get("Location"), cookies)
+	}
+
+	w = httptest.NewRecorder()
+	if !handleAdminLink(w, httptest.NewRequest("GET", "/settings/?admin=guess", nil)) || w.Code != http.StatusForbidden || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong secret: status %d", w.Code)
+	}
+	if handleAdminLink(httptest.NewRecorder(), httptest.NewRequest("GET", "/settings/", nil)) {
+		t.Errorf("plain settings page handled as an admin link")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	handler := corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		method      string
+		origin      string
+		status      int
+		allowOrigin string
+	}{
+		{"GET", "", http.StatusOK, ""},
+		{"POST", "", http.StatusOK, ""},
+		{"GET", "http://192.168.1.5:8000", http.StatusOK, "http://192.168.1.5:8000"},
+		{"POST", "http://192.168.1.5:8000", http.StatusOK, "http://192.168.1.5:8000"},
+		{"POST", "chrome-extension://abcdef", http.StatusOK, "chrome-extension://abcdef"},
+		{"OPTIONS", "moz-extension://1234-5678", http.StatusNoContent, "moz-extension://1234-5678"},
+		// Other sites may load resources but never read or change them
+		{"GET", "https://evil.example", http.StatusOK, ""},
+		{"POST", "https://evil.example", http.StatusForbidden, ""},
+		{"DELETE", "http://localhost:8000", http.StatusForbidden, ""},
+		{"OPTIONS", "https://evil.example", http.StatusForbidden, ""},
+		{"POST", "null", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://192.168.1.5:8000/pc/message", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.status || w.Header().Get("Access-Control-Allow-Origin") != tt.allowOrigin {
+			t.Errorf("%s from %q: status %d, allowed origin %q; want %d, %q", tt.method, tt.origin, w.Code, w.Header().Get("Access-Control-Allow-Origin"), tt.status, tt.allowOrigin)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Uploads are stored once under a name derived from the SHA-256 of their
+// content (see blobNameFor), so sending the same file again adds an item but
+// no new file. Every file item holds a
+// reference to its blob and the blob is deleted with the last one.
+type BlobStore struct {
+	refs  map[string]int   // blob name -> items referencing it
+	sizes map[string]int64 // blob name -> size in bytes
+	mutex sync.Mutex
+}
+
+func NewBlobStore() *BlobStore {
+	return &BlobStore{
+		refs:  make(map[string]int),
+		sizes: make(map[string]int64),
+	}
+}
+
+var blobStore = NewBlobStore()
+
+// Storage use of the uploads, reported by /status
+type StorageStats struct {
+	Blobs      int   `json:"blobs"`      // files on disk
+	References int   `json:"references"` // file items pointing at them
+	Bytes      int64 `json:"bytes"`      // size of the files on disk
+	SavedBytes int64 `json:"savedBytes"` // what the duplicates would have taken
+	Encrypted  bool  `json:"encrypted"`  // stored with AES-GCM, see setupEncryption
+}
+
+// Name of the blob for content with this hex SHA-256: the hash itself, or with
+// encryption on an HMAC of it so file names don't tell which known files are
+// stored
+func blobNameFor(sha string) string {
+	if blobNameKey == nil {
+		return sha
+	}
+	mac := hmac.New(sha256.New, blobNameKey)
+	mac.Write([]byte(sha))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check if a stored name is a blob name rather than an old item_<nanos>_name upload
+func isBlobName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// Count the references of the stored items, replacing what was counted before
+func (b *BlobStore) Rebuild(items []Item) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refs = make(map[string]int)
+	b.sizes = make(map[string]int64)
+	for _, item := range items {
+		if item.File == nil || item.File.StoredName == "" {
+			continue
+		}
+		b.refs[item.File.StoredName]++
+		b.sizes[item.File.StoredName] = item.File.Size
+	}
+	fmt.Printf("[DEBUG] Blob store: %d files referenced by file items\n", len(b.refs))
+}
+
+// Move a finished upload into the store and take a reference to it. The file
+// at path is consumed: renamed to its content hash, or deleted if that blob
+// already exists. Returns the blob name.
+func (b *BlobStore) Ingest(path string) (string, error) {
+	// Hash before locking, large files take a while
+	sha, size, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	name := blobNameFor(sha)
+	blobPath, err := safeJoin(uploadsDir, name)
+	if err != nil {
+		return "", err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, err := os.Stat(blobPath); err == nil {
+		fmt.Printf("[DEBUG] Blob store: Already have %s, dropping the new copy (%d bytes)\n", name, size)
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	} else if err := storeFile(path, blobPath); err != nil {
+		return "", err
+	}
+
+	b.refs[name]++
+	b.sizes[name] = size
+	return name, nil
+}
+
+// Drop a reference and delete the file once nothing references it. Returns the
+// number of bytes freed, or -1 if the file is still in use or was already gone.
+func (b *BlobStore) Release(name string) (int64, error) {
+	filePath, err := safeJoin(uploadsDir, name)
+	if err != nil {
+		return -1, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.refs[name] > 1 {
+		b.refs[name]--
+		fmt.Printf("[DEBUG] Blob store: %s still referenced by %d items\n", name, b.refs[name])
+		return -1, nil
+	}
+	delete(b.refs, name)
+	delete(b.sizes, name)
+
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	if err := os.Remove(filePath); err != nil {
+		return -1, err
+	}
+	return info.Size(), nil
+}
+
+// Drop a reference without touching the file. Returns true if it was the last one.
+func (b *BlobStore) Unref(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.refs[name] > 1 {
+		b.refs[name]--
+		return false
+	}
+	delete(b.refs, name)
+	delete(b.sizes, name)
+	return true
+}
+
+// Run remove for a file no item references, holding the lock so no upload can
+// take a reference to it in the meantime. Returns false if the file is in use.
+func (b *BlobStore) Discard(name string, remove func() error) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.refs[name] > 0 {
+		return false, nil
+	}
+	return true, remove()
+}
+
+// Get the current storage use and how much deduplication saved
+func (b *BlobStore) Stats() StorageStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := StorageStats{Encrypted: storageCipher != nil}
+	for name, refs := range b.refs {
+		size := b.sizes[name]
+		stats.Blobs++
+		stats.References += refs
+		stats.Bytes += size
+		stats.SavedBytes += int64(refs-1) * size
+	}
+	return stats
+}
+
+// Get the hex SHA-256 and size of a file's content
+func hashFile(path string) (string, int64, error) {
+	file, err := openStoredFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// Move an upload stored under its old item_<nanos>_name into the blob store.
+// An upload that is already gone still resolves if its blob exists, which
+// happens when a migration was interrupted before the items were saved.
+func adoptUpload(file *FilePayload) (string, error) {
+	filePath, err := safeJoin(uploadsDir, file.StoredName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filePath); os.IsNotExist(err) && file.SHA256 != "" {
+		name := blobNameFor(file.SHA256)
+		if blobPath, err := safeJoin(uploadsDir, name); err == nil {
+			if _, err := os.Stat(blobPath); err == nil {
+				return name, nil
+			}
+		}
+	}
+	return blobStore.Ingest(filePath)
+}
+
+// Move the blobs still named by their plain SHA-256 to their keyed names once
+// encryption is on, updating the items that point at them. The file is moved
+// before its items are saved; an interrupted run is finished at the next start.
+func rekeyBlobNames(store ItemStore) error {
+	if blobNameKey == nil {
+		return nil
+	}
+	renamed := 0
+	for _, item := range store.List() {
+		if item.File == nil || item.File.SHA256 == "" || item.File.StoredName != item.File.SHA256 {
+			continue
+		}
+		name := blobNameFor(item.File.SHA256)
+		oldPath, err := safeJoin(uploadsDir, item.File.StoredName)
+		if err != nil {
+			return err
+		}
+		newPath, err := safeJoin(uploadsDir, name)
+		if err != nil {
+			return err
+		}
+		// Duplicates share the blob, the first of them already moved it
+		if _, err := os.Stat(newPath); os.IsNotExist(err) {
+			if err := os.Rename(oldPath, newPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		file := *item.File
+		file.StoredName = name
+		item.File = &file
+		if err := store.Update(item); err != nil {
+			return err
+		}
+		renamed++
+	}
+	if renamed > 0 {
+		fmt.Printf("[INFO] Blob store: Renamed the uploads of %d items to keyed names\n", renamed)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobStore(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	blobs := NewBlobStore()
+
+	ingest := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(uploadsDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := blobs.Ingest(path)
+		if err != nil {
+			t.Fatalf("Ingest(%s): %v", name, err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Ingest(%s) left the received file behind", name)
+		}
+		return stored
+	}
+
+	first := ingest("item_1_a.txt", "hello")
+	second := ingest("item_2_b.txt", "hello")
+	other := ingest("item_3_c.txt", "world")
+	if first != second || !isBlobName(first) {
+		t.Fatalf("same content stored as %q and %q", first, second)
+	}
+	if first == other {
+		t.Fatalf("different content stored under the same name %q", first)
+	}
+
+	want := StorageStats{Blobs: 2, References: 3, Bytes: 10, SavedBytes: 5}
+	if stats := blobs.Stats(); stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+
+	// The shared file survives until its last reference is released
+	if freed, err := blobs.Release(first); err != nil || freed != -1 {
+		t.Errorf("Release of a shared blob = %d, %v, want -1", freed, err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, first)); err != nil {
+		t.Errorf("shared blob deleted early: %v", err)
+	}
+	if freed, err := blobs.Release(first); err != nil || freed != 5 {
+		t.Errorf("Release of the last reference = %d, %v, want 5", freed, err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, first)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced blob still on disk: %v", err)
+	}
+
+	// References are recounted from the items on startup
+	blobs.Rebuild([]Item{
+		{ID: "a", Type: "file", File: &FilePayload{StoredName: other, Size: 5}},
+		{ID: "b", Type: "file", File: &FilePayload{StoredName: other, Size: 5}},
+		{ID: "c", Type: "text", Content: "hi"},
+	})
+	want = StorageStats{Blobs: 1, References: 2, Bytes: 5, SavedBytes: 5}
+	if stats := blobs.Stats(); stats != want {
+		t.Errorf("Stats() after Rebuild = %+v, want %+v", stats, want)
+	}
+}
+
+func TestBlobNamesWithKey(t *testing.T) {
+	useTestItemStore(t)
+	useTestBlobStore(t)
+	const sha = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // "hello"
+
+	// A blob stored before encryption was turned on
+	writeUpload(t, sha, "hello")
+	itemStore.Add(Item{ID: "item_1", Type: "file", File: &FilePayload{Name: "a.txt", StoredName: sha, Size: 5, SHA256: sha}})
+	itemStore.Add(Item{ID: "item_2", Type: "file", File: &FilePayload{Name: "b.txt", StoredName: sha, Size: 5, SHA256: sha}})
+
+	useTestStorageKey(t)
+	name := blobNameFor(sha)
+	if name == sha || !isBlobName(name) {
+		t.Fatalf("keyed blob name = %q", name)
+	}
+	if err := rekeyBlobNames(itemStore); err != nil {
+		t.Fatal(err)
+	}
+	if files := folderFiles(uploadsDir); files != name {
+		t.Errorf("uploads after renaming = %s", files)
+	}
+	for _, item := range itemStore.List() {
+		if item.File.StoredName != name || item.File.SHA256 != sha {
+			t.Errorf("item %s file = %+v", item.ID, item.File)
+		}
+	}
+
+	// New uploads of the same content land on the renamed blob
+	writeUpload(t, "item_3_c.txt", "hello")
+	if stored, err := blobStore.Ingest(filepath.Join(uploadsDir, "item_3_c.txt")); err != nil || stored != name {
+		t.Errorf("Ingest = %q, %v, want %q", stored, err, name)
+	}
+}
@@ -1,8 +1,16 @@
+// Encryption helpers shared with the Firefox extension
+importScripts('e2e.js');
+
 // Default server configuration
 const DEFAULT_SETTINGS = {
     serverHost: '192.168.2.101',
     serverPort: 8000,
-    resizableSidebar: true
+    useHttps: false,
+    deviceName: 'My PC',
+    pairingPin: '',
+    resizableSidebar: true,
+    e2eEncryption: false,
+    clipboardSync: false
 };
 
 // Handle extension installation
@@ -18,12 +26,245 @@ function getServerUrl() {
     return new Promise((resolve) => {
         chrome.storage.local.get('orionSettings', (result) => {
             const settings = result.orionSettings || DEFAULT_SETTINGS;
-            const serverUrl = `http://${settings.serverHost}:${settings.serverPort}`;
+            const scheme = settings.useHttps ? 'https' : 'http';
+            const serverUrl = `${scheme}://${settings.serverHost}:${settings.serverPort}`;
             resolve(serverUrl);
         });
     });
 }
 
+// Registered device of this browser, resolved once per server and name
+let devicePromise = null;
+
+function getDevice() {
+    if (!devicePromise) {
+        devicePromise = registerDevice().catch(error => {
+            console.error('Background script: Device registration failed:', error);
+            devicePromise = null;
+            return null;
+        });
+    }
+    return devicePromise;
+}
+
+// Pair with the PIN from the settings. Without a PIN registering only works
+// while the server doesn't require pairing. Existing registrations are only renamed.
+function registerDevice() {
+    return new Promise(resolve => {
+        chrome.storage.local.get(['orionSettings', 'orionDevice'], resolve);
+    }).then(result => {
+        const settings = result.orionSettings || DEFAULT_SETTINGS;
+        const name = settings.deviceName || DEFAULT_SETTINGS.deviceName;
+        return getServerUrl().then(serverUrl => {
+            const stored = result.orionDevice;
+            if (stored && stored.serverUrl === serverUrl && stored.name === name) {
+                return stored;
+            }
+
+            const known = stored && stored.serverUrl === serverUrl;
+            const usePin = !known && settings.pairingPin;
+            const headers = { 'Content-Type': 'application/json' };
+            if (known) {
+                headers['Authorization'] = `Bearer ${stored.token}`;
+            }
+
+            return fetch(serverUrl + (usePin ? '/pair' : '/devices/register'), {
+                method: 'POST',
+                headers,
+                body: JSON.stringify({ name, type: 'pc', pin: usePin ? settings.pairingPin : undefined }),
+                mode: 'cors',
+                credentials: 'omit'
+            })
+                .then(response => {
+                    if (response.status === 401 && !usePin) {
+                        throw new Error('Pairing required, enter the PIN from the server settings');
+                    }
+                    if (!response.ok) {
+                        throw new Error(`HTTP ${response.status}: ${response.statusText}`);
+                    }
+                    return response.json();
+                })
+                .then(data => {
+                    const device = {
+                        serverUrl,
+                        name,
+                        deviceId: data.deviceId,
+                        token: data.token || stored.token
+                    };
+                    chrome.storage.local.set({ orionDevice: device });
+                    console.log('Background script: Registered as device', device.deviceId);
+                    return device;
+                });
+        });
+    });
+}
+
+// Drop a token the server no longer accepts so the next request registers again
+function forgetDevice() {
+    devicePromise = null;
+    chrome.storage.local.remove('orionDevice');
+}
+
+// Re-register after the server address or device name changed
+chrome.storage.onChanged.addListener((changes) => {
+    if (changes.orionSettings) {
+        devicePromise = null;
+        keyDirectoryPromise = null;
+
+        const { oldValue, newValue } = changes.orionSettings;
+        const wasEnabled = Boolean(oldValue && oldValue.e2eEncryption);
+        if (newValue && newValue.e2eEncryption) {
+            publishE2EKey();
+        } else if (wasEnabled) {
+            withdrawE2EKey();
+        }
+
+        const syncedBefore = Boolean(oldValue && oldValue.clipboardSync);
+        const syncNow = Boolean(newValue && newValue.clipboardSync);
+        if (syncNow !== syncedBefore) {
+            subscribeClipboard(syncNow);
+        }
+    }
+});
+
+// Fetch from the server with this device's token
+function apiFetch(path, options = {}) {
+    return Promise.all([getServerUrl(), getDevice()]).then(([serverUrl, device]) => {
+        const headers = Object.assign({}, options.headers);
+        if (device) {
+            headers['Authorization'] = `Bearer ${device.token}`;
+        }
+        return fetch(serverUrl + path, Object.assign({}, options, { headers })).then(response => {
+            if (response.status === 401 && device) {
+                forgetDevice();
+            }
+            return response;
+        });
+    });
+}
+
+// Tab whose media was reported last, see the now-playing request
+let nowPlayingTab = null;
+
+// End-to-end encryption, see e2e.js. The key pair is created once per browser
+// and published for the registered device while the setting is on.
+let e2eKeyPromise = null;
+let keyDirectoryPromise = null;
+const decryptedItems = new Map(); // item ID -> plaintext, null if we can't read it
+
+function getSettings() {
+    return new Promise(resolve => {
+        chrome.storage.local.get('orionSettings', (result) => {
+            resolve(result.orionSettings || DEFAULT_SETTINGS);
+        });
+    });
+}
+
+function isE2EEnabled() {
+    return getSettings().then(settings => Boolean(settings.e2eEncryption));
+}
+
+function getE2EKeyPair() {
+    if (!e2eKeyPromise) {
+        e2eKeyPromise = new Promise(resolve => {
+            chrome.storage.local.get('orionE2EKey', resolve);
+        }).then(result => {
+            if (result.orionE2EKey) {
+                return result.orionE2EKey;
+            }
+            return e2eGenerateKeyPair().then(keyPair => {
+                chrome.storage.local.set({ orionE2EKey: keyPair });
+                return keyPair;
+            });
+        });
+    }
+    return e2eKeyPromise;
+}
+
+// Publish our public key, repeating it is harmless as the server ignores an unchanged key
+function publishE2EKey() {
+    return isE2EEnabled().then(enabled => {
+        if (!enabled) {
+            return;
+        }
+        return getE2EKeyPair().then(keyPair => apiFetch('/keys', {
+            method: 'PUT',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify({ algorithm: E2E_KEY_ALGORITHM, key: keyPair.publicKey })
+        })).then(response => {
+            if (!response.ok) {
+                throw new Error(`HTTP ${response.status}: ${response.statusText}`);
+            }
+            keyDirectoryPromise = null;
+        });
+    }).catch(error => {
+        console.error('Background script: Error publishing E2E key:', error);
+    });
+}
+
+// Stop others from encrypting to us, the key pair is kept to read older messages
+function withdrawE2EKey() {
+    return apiFetch('/keys', { method: 'DELETE' }).catch(error => {
+        console.error('Background script: Error withdrawing E2E key:', error);
+    });
+}
+
+// Public keys of all devices, fetched again after key_rotated or key_removed
+function getKeyDirectory() {
+    if (!keyDirectoryPromise) {
+        keyDirectoryPromise = apiFetch('/keys', { method: 'GET' })
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(`HTTP ${response.status}: ${response.statusText}`);
+                }
+                return response.json();
+            })
+            .then(data => data.keys)
+            .catch(error => {
+                keyDirectoryPromise = null;
+                throw error;
+            });
+    }
+    return keyDirectoryPromise;
+}
+
+// Encrypt for every device with a key, ourselves included so our own history stays readable
+async function encryptMessage(text) {
+    const [device, keys] = await Promise.all([getDevice(), getKeyDirectory()]);
+    if (!device || !keys.some(entry => entry.deviceId === device.deviceId)) {
+        throw new Error('This device has not published an encryption key yet');
+    }
+    return e2eEncrypt(text, keys);
+}
+
+// Items the way tabs show them: encrypted items we can read become text
+async function presentItems(items) {
+    const [device, keyPair] = await Promise.all([getDevice(), getE2EKeyPair()]);
+    return Promise.all(items.map(async item => {
+        if (item.type !== 'encrypted') {
+            return item;
+        }
+        if (!decryptedItems.has(item.id)) {
+            decryptedItems.set(item.id, await e2eDecrypt(item, device && device.deviceId, keyPair));
+        }
+        const text = decryptedItems.get(item.id);
+        return text === null ? item : Object.assign({}, item, { type: 'text', content: text, encrypted: true });
+    }));
+}
+
+// Snapshot of the local history for tabs. Decrypting is async, so snapshots
+// are taken in order and a slow one can't overwrite a newer one.
+let presentQueue = Promise.resolve();
+
+function presentSyncState() {
+    presentQueue = presentQueue.catch(() => null)
+        .then(() => presentItems(syncState.items))
+        .then(items => ({ items, hasMore: syncState.hasMore }));
+    return presentQueue;
+}
+
 // Listen for fetch-conversation requests from content script
 chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
     console.log('Background script: Received message:', request.type);
@@ -56,7 +297,7 @@ chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
                 return;
             }
 
-            fetch(serverUrl + '/pc/items', {
+            apiFetch('/pc/items', {
                 method: 'GET',
                 headers: {
                     'Content-Type': 'application/json',
@@ -74,8 +315,9 @@ chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
                         throw new Error(`HTTP ${response.status}: ${response.statusText}`);
                     }
 
-                    return response.text();
+                    return response.json();
                 })
+                .then(data => presentItems(data.items || []).then(items => JSON.stringify(Object.assign({}, data, { items }))))
                 .then(data => {
                     console.log('Background script: Fetch successful, data length:', data.length);
                     console.log('Background script: Data preview:', data.substring(0, 200));
@@ -92,35 +334,36 @@ chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
         return true;
     }
 
+    if (request.type === 'load-older-items') {
+        loadOlderItems()
+            .then(loaded => presentSyncState().then(data => {
+                sendResponse({ success: true, loaded, data });
+            }))
+            .catch(error => {
+                console.error('Background script: Error loading older items:', error);
+                sendResponse({ success: false, error: error.toString() });
+            });
+        return true;
+    }
+
     if (request.type === 'send-message') {
         console.log('Background script: Sending message');
-        getServerUrl().then(serverUrl => {
-            fetch(serverUrl + '/pc/message', {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({ text: request.text }),
-                mode: 'cors',
-                credentials: 'omit'
+        sendMessageCommand(request.text)
+            .then(data => {
+                console.log('Background script: Message sent successfully:', data);
+                sendResponse({ success: true, data });
             })
-                .then(response => response.json())
-                .then(data => {
-                    console.log('Background script: Message sent successfully:', data);
-                    sendResponse({ success: true, data });
-                })
-                .catch(error => {
-                    console.error('Background script: Message send error:', error);
-                    sendResponse({ success: false, error: error.toString() });
-                });
-        });
+            .catch(error => {
+                console.error('Background script: Message send error:', error);
+                sendResponse({ success: false, error: error.toString() });
+            });
         return true;
     }
 
     if (request.type === 'send-file') {
         console.log('Background script: Sending file');
         getServerUrl().then(serverUrl => {
-            fetch(serverUrl + '/pc/file', {
+            apiFetch('/pc/file', {
                 method: 'POST',
                 body: request.formData,
                 mode: 'cors',
@@ -138,10 +381,49 @@ chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
         return true;
     }
 
+    if (request.type === 'clipboard-changed') {
+        pushClipboard(request.text)
+            .then(data => sendResponse({ success: true, data }))
+            .catch(error => {
+                console.error('Background script: Clipboard push error:', error);
+                sendResponse({ success: false, error: error.toString() });
+            });
+        return true;
+    }
+
+    if (request.type === 'get-thumbnail') {
+        apiFetch(`/thumbs/${encodeURIComponent(request.itemId)}`)
+            .then(response => {
+                if (!response.ok) {
+                    throw new Error(`HTTP ${response.status}`);
+                }
+                const contentType = response.headers.get('Content-Type') || 'image/png';
+                return response.arrayBuffer().then(buffer => {
+                    // Data URLs work on any page, http: URLs to the server are blocked on https: pages
+                    const bytes = new Uint8Array(buffer);
+                    let binary = '';
+                    for (let i = 0; i < bytes.length; i += 0x8000) {
+                        binary += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+                    }
+                    sendResponse({ success: true, dataUrl: `data:${contentType};base64,${btoa(binary)}` });
+                });
+            })
+            .catch(error => {
+                console.error('Background script: Thumbnail error:', error);
+                sendResponse({ success: false, error: error.toString() });
+            });
+        return true;
+    }
+
     if (request.type === 'download-file') {
         console.log('Background script: Downloading file:', request.displayName);
-        getServerUrl().then(serverUrl => {
-            const downloadUrl = `${serverUrl}/uploads/${request.uniqueFilename}`;
+        Promise.all([getServerUrl(), getDevice()]).then(([serverUrl, device]) => {
+            // Downloads can't carry headers, the token goes in the URL
+            // The item ID picks the name and lets the server check who may fetch it
+            let downloadUrl = `${serverUrl}/uploads/${encodeURIComponent(request.uniqueFilename)}?item=${encodeURIComponent(request.itemId)}`;
+            if (device) {
+                downloadUrl += `&token=${encodeURIComponent(device.token)}`;
+            }
 
             // Use chrome.downloads API to download the file
             chrome.downloads.download({
@@ -161,28 +443,29 @@ chrome.runtime.onMessage.addListener((request, sender, sendResponse) => {
         return true;
     }
 
-    if (request.type === 'youtube-video-info') {
-        console.log('Background script: Sending YouTube video info:', request.videoInfo);
-        getServerUrl().then(serverUrl => {
-            fetch(serverUrl + '/pc/youtube-info', {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify(request.videoInfo),
-                mode: 'cors',
-                credentials: 'omit'
-            })
-                .then(response => response.json())
-                .then(data => {
-                    console.log('Background script: YouTube info sent successfully:', data);
-                    sendResponse({ success: true, data });
-                })
-                .catch(error => {
-                    console.error('Background script: YouTube info send error:', error);
-                    sendResponse({ success: false, error: error.toString() });
-                });
-        });
+    if (request.type === 'now-playing') {
+        // Media playing in a tab, null once it stopped. The device plays one
+        // thing at a time, so only the tab that reported last can end it.
+        const tabId = sender.tab && sender.tab.id;
+        if (!request.nowPlaying && tabId !== nowPlayingTab) {
+            sendResponse({ success: true });
+            return;
+        }
+        nowPlayingTab = request.nowPlaying ? tabId : null;
+
+        apiFetch('/pc/now-playing', request.nowPlaying ? {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(request.nowPlaying)
+        } : { method: 'DELETE' })
+            .then(response => response.json())
+            .then(data => sendResponse({ success: true, data }))
+            .catch(error => {
+                console.error('Background script: Now playing send error:', error);
+                sendResponse({ success: false, error: error.toString() });
+            });
         return true;
     }
 
@@ -236,10 +519,232 @@ let websocket = null;
 let reconnectInterval = null;
 const connectedTabs = new Set();
 
+// Local copy of the history, kept current by sequence-numbered events.
+// It starts with the newest page, older pages are loaded when a tab asks.
+const HISTORY_PAGE_SIZE = 50;
+const syncState = { epoch: null, seq: 0, items: [], hasMore: false };
+
+// Apply a history snapshot or change event, returns true if the items changed
+function applySyncMessage(message) {
+    if (message.type === 'initial') {
+        syncState.epoch = message.epoch;
+        syncState.seq = message.seq;
+        syncState.items = (message.data && message.data.items) || [];
+        syncState.hasMore = Boolean(message.data && message.data.hasMore);
+        return true;
+    }
+
+    // Events from a previous server run or that we already applied
+    if (message.epoch !== syncState.epoch || message.seq <= syncState.seq) {
+        return false;
+    }
+    syncState.seq = message.seq;
+
+    switch (message.type) {
+        case 'item_added':
+            if (syncState.items.some(item => item.id === message.data.id)) {
+                return false;
+            }
+            syncState.items.push(message.data);
+            return true;
+        case 'item_updated':
+            syncState.items = syncState.items.map(item => item.id === message.data.id ? message.data : item);
+            return true;
+        case 'item_deleted':
+            syncState.items = syncState.items.filter(item => item.id !== message.data.id);
+            return true;
+        case 'cleared':
+            syncState.items = [];
+            syncState.hasMore = false;
+            return true;
+    }
+    return false;
+}
+
+// Add targeted items that were queued while this device was offline, returns true if any were new
+function mergeQueuedItems(items) {
+    const known = new Set(syncState.items.map(item => item.id));
+    const added = items.filter(item => !known.has(item.id));
+    if (added.length === 0) {
+        return false;
+    }
+    syncState.items = syncState.items.concat(added)
+        .sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp));
+    return true;
+}
+
+// Prepend the page before the oldest item we have, returns the number of items added
+async function loadOlderItems() {
+    if (!syncState.hasMore || syncState.items.length === 0) {
+        return 0;
+    }
+    const before = encodeURIComponent(syncState.items[0].id);
+    const response = await apiFetch(`/pc/items?before=${before}&limit=${HISTORY_PAGE_SIZE}`, { method: 'GET' });
+    if (!response.ok) {
+        throw new Error(`HTTP ${response.status}: ${response.statusText}`);
+    }
+    const page = await response.json();
+
+    const known = new Set(syncState.items.map(item => item.id));
+    const older = page.items.filter(item => !known.has(item.id));
+    syncState.items = older.concat(syncState.items);
+    syncState.hasMore = page.hasMore;
+    return older.length;
+}
+
+// Commands waiting for an ack, keyed by request ID
+const COMMAND_TIMEOUT = 10000;
+const pendingCommands = new Map();
+let nextCommandId = 1;
+
+// Send a command over the WebSocket and wait for its ack
+function sendCommand(type, data) {
+    return new Promise((resolve, reject) => {
+        if (!websocket || websocket.readyState !== WebSocket.OPEN) {
+            const error = new Error('WebSocket not connected');
+            error.notSent = true;
+            reject(error);
+            return;
+        }
+
+        const id = String(nextCommandId++);
+        const timer = setTimeout(() => {
+            pendingCommands.delete(id);
+            reject(new Error(`Command ${type} timed out`));
+        }, COMMAND_TIMEOUT);
+        pendingCommands.set(id, { resolve, reject, timer });
+
+        websocket.send(JSON.stringify({ type, id, data }));
+    });
+}
+
+function handleCommandAck(ack) {
+    const pending = pendingCommands.get(ack.id);
+    if (!pending) {
+        return;
+    }
+
+    pendingCommands.delete(ack.id);
+    clearTimeout(pending.timer);
+    if (ack.ok) {
+        pending.resolve(ack.data);
+    } else {
+        pending.reject(new Error(ack.error || 'Command failed'));
+    }
+}
+
+function rejectPendingCommands() {
+    for (const pending of pendingCommands.values()) {
+        clearTimeout(pending.timer);
+        pending.reject(new Error('WebSocket closed'));
+    }
+    pendingCommands.clear();
+}
+
+// Send a message, end-to-end encrypted when that is turned on
+function sendMessageCommand(text) {
+    return isE2EEnabled().then(enabled => enabled ? sendEncryptedMessage(text) : sendMessageData({ text }));
+}
+
+// When the server says a recipient key changed, fetch the directory and try once more
+function sendEncryptedMessage(text, retried = false) {
+    return encryptMessage(text).then(sendMessageData).catch(error => {
+        if (retried || !/key changed/i.test(error.message)) {
+            throw error;
+        }
+        keyDirectoryPromise = null;
+        return sendEncryptedMessage(text, true);
+    });
+}
+
+// Send over the open WebSocket, falling back to HTTP when it isn't connected.
+// A command that was already sent is never retried, it may have been saved.
+function sendMessageData(data) {
+    return sendCommand('send_message', data).catch(error => {
+        if (!error.notSent) {
+            throw error;
+        }
+        return apiFetch('/pc/message', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+            body: JSON.stringify(data),
+            mode: 'cors',
+            credentials: 'omit'
+        }).then(response => {
+            if (!response.ok) {
+                return response.text().then(message => {
+                    throw new Error(message.trim() || `HTTP ${response.status}`);
+                });
+            }
+            return response.json();
+        });
+    });
+}
+
+// Clipboard sync: copies in pages are pushed to the server, clipboard events
+// from other devices are written in the active tab. Those events only arrive
+// while the WebSocket is connected, which is while a sidebar is open.
+function subscribeClipboard(enabled) {
+    return sendCommand('clipboard_subscribe', { enabled }).catch(error => {
+        console.log('Background script: Clipboard subscription not changed:', error.message);
+    });
+}
+
+// Push text copied in a page, the server drops it if it is what we just received
+function pushClipboard(text) {
+    return getSettings().then(settings => {
+        if (!settings.clipboardSync || !text) {
+            return { changed: false };
+        }
+        return sendCommand('clipboard', { text }).catch(error => {
+            if (!error.notSent) {
+                throw error;
+            }
+            return apiFetch('/pc/clipboard', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json',
+                },
+                body: JSON.stringify({ text })
+            }).then(response => {
+                if (!response.ok) {
+                    return response.text().then(message => {
+                        throw new Error(message.trim() || `HTTP ${response.status}`);
+                    });
+                }
+                return response.json();
+            });
+        });
+    });
+}
+
+// Only a focused page may write the clipboard, so ask the active tab
+function writeClipboard(text) {
+    chrome.tabs.query({ active: true, lastFocusedWindow: true }).then(tabs => {
+        for (const tab of tabs) {
+            chrome.tabs.sendMessage(tab.id, { type: 'write-clipboard', text }).catch(err => {
+                console.log('Failed to write clipboard in tab:', tab.id, err);
+            });
+        }
+    });
+}
+
 // Function to connect to WebSocket from background script
 function connectWebSocketBackground() {
-    getServerUrl().then(serverUrl => {
-        const wsUrl = serverUrl.replace('http://', 'ws://') + '/pc/ws';
+    Promise.all([getServerUrl(), getDevice()]).then(([serverUrl, device]) => {
+        const params = new URLSearchParams();
+        if (device) {
+            params.set('token', device.token);
+        }
+        // After a reconnect only ask for the events we missed
+        if (syncState.epoch) {
+            params.set('epoch', syncState.epoch);
+            params.set('since', syncState.seq);
+        }
+        const query = params.toString();
+        const wsUrl = serverUrl.replace(/^http/, 'ws') + '/pc/ws' + (query ? '?' + query : '');
         console.log('Background: Connecting to WebSocket:', wsUrl);
 
         try {
@@ -251,6 +756,12 @@ function connectWebSocketBackground() {
                     clearInterval(reconnectInterval);
                     reconnectInterval = null;
                 }
+                publishE2EKey();
+                getSettings().then(settings => {
+                    if (settings.clipboardSync) {
+                        subscribeClipboard(true);
+                    }
+                });
 
                 // Notify all connected tabs that WebSocket is connected
                 for (const tabId of connectedTabs) {
@@ -268,21 +779,43 @@ function connectWebSocketBackground() {
                 const message = JSON.parse(event.data);
                 console.log('Background: WebSocket message received:', message);
 
-                // Broadcast to all connected tabs
-                for (const tabId of connectedTabs) {
-                    chrome.tabs.sendMessage(tabId, {
-                        type: 'websocket-data',
-                        data: message
-                    }).catch(err => {
-                        console.log('Failed to send to tab:', tabId, err);
-                        connectedTabs.delete(tabId);
-                    });
+                // Acks only concern this script, tabs just see the resulting updates
+                if (message.type === 'ack') {
+                    handleCommandAck(message);
+                    return;
+                }
+
+                // Another device copied something, put it on our clipboard too
+                if (message.type === 'clipboard') {
+                    writeClipboard(message.data.content);
+                    return;
+                }
+
+                // Someone's key changed, encrypt with a fresh directory from now on
+                if (message.type === 'key_rotated' || message.type === 'key_removed') {
+                    keyDirectoryPromise = null;
+                    return;
+                }
+
+                // Tabs render whole lists, so history changes are passed on as a full update
+                const syncTypes = ['initial', 'synced', 'item_added', 'item_updated', 'item_deleted', 'cleared'];
+                if (syncTypes.includes(message.type)) {
+                    if (applySyncMessage(message)) {
+                        presentSyncState().then(data => broadcastWebSocketData({ type: 'update', data }));
+                    }
+                } else if (message.type === 'queued_items') {
+                    if (mergeQueuedItems(message.data.items || [])) {
+                        presentSyncState().then(data => broadcastWebSocketData({ type: 'update', data }));
+                    }
+                } else {
+                    broadcastWebSocketData(message);
                 }
             };
 
             websocket.onclose = function (event) {
                 console.log('Background: WebSocket disconnected, code:', event.code, 'reason:', event.reason);
                 websocket = null;
+                rejectPendingCommands();
 
                 // Notify all connected tabs that WebSocket is disconnected
                 for (const tabId of connectedTabs) {
@@ -344,3 +877,16 @@ function connectWebSocketBackground() {
         }
     });
 }
+
+// Broadcast a WebSocket message to all connected tabs
+function broadcastWebSocketData(message) {
+    for (const tabId of connectedTabs) {
+        chrome.tabs.sendMessage(tabId, {
+            type: 'websocket-data',
+            data: message
+        }).catch(err => {
+            console.log('Failed to send to tab:', tabId, err);
+            connectedTabs.delete(tabId);
+        });
+    }
+}
@@ -5,215 +5,130 @@ if (window.orionContentScriptLoaded) {
     window.orionContentScriptLoaded = true;
     console.log('Orion content script loaded');
 
-    // Check if current page is a YouTube video and start monitoring
-    checkYouTubeVideo();
+    // Report media playing in this page for handoff to other devices
+    startMediaTracking();
+
+    // Copies feed clipboard sync when it is turned on
+    document.addEventListener('copy', reportCopiedText, true);
 }
 
-// YouTube video detection and time tracking
-function checkYouTubeVideo() {
-    const currentUrl = window.location.href;
-    console.log('Current URL:', currentUrl);
+// Set while we copy text from another device ourselves, so it isn't sent back
+let writingClipboard = false;
 
-    // Check if URL is a YouTube video
-    if (isYouTubeVideoUrl(currentUrl)) {
-        console.log('YouTube video detected!');
-        startYouTubeTimeTracking();
+// Tell the background about text copied in this page
+function reportCopiedText() {
+    if (writingClipboard) {
+        return;
+    }
+    const active = document.activeElement;
+    let text;
+    if (active && (active.tagName === 'TEXTAREA' || active.tagName === 'INPUT') && typeof active.selectionStart === 'number') {
+        text = active.value.substring(active.selectionStart, active.selectionEnd);
     } else {
-        console.log('Not a YouTube video URL');
+        text = String(window.getSelection() || '');
+    }
+    if (text) {
+        chrome.runtime.sendMessage({ type: 'clipboard-changed', text }).catch(() => { });
     }
 }
 
-function isYouTubeVideoUrl(url) {
-    // Match various YouTube video URL formats:
-    // https://www.youtube.com/watch?v=VIDEO_ID
-    // https://youtu.be/VIDEO_ID
-    // https://m.youtube.com/watch?v=VIDEO_ID
-    const youtubeVideoRegex = /(?:youtube\.com\/watch\?v=|youtu\.be\/|m\.youtube\.com\/watch\?v=)([a-zA-Z0-9_-]{11})/;
-    return youtubeVideoRegex.test(url);
-}
-
-function startYouTubeTimeTracking() {
-    console.log('Starting YouTube time tracking...');
-
-    // Wait for video element to load
-    const checkForVideo = setInterval(() => {
-        const videoElement = document.querySelector('video');
-
-        if (videoElement) {
-            console.log('YouTube video element found');
-            clearInterval(checkForVideo);
-
-            // Log initial time
-            logVideoTime(videoElement);
-
-            // Set up periodic time logging (every 1 second for real-time updates)
-            const timeLogger = setInterval(() => {
-                if (document.querySelector('video') === videoElement && !videoElement.paused) {
-                    logVideoTime(videoElement);
-                }
-            }, 1000);
-
-            // Log time when video is paused/played
-            videoElement.addEventListener('pause', () => {
-                console.log('Video paused');
-                logVideoTime(videoElement);
-            });
-
-            videoElement.addEventListener('play', () => {
-                console.log('Video resumed');
-                logVideoTime(videoElement);
-            });
-
-            // Clean up interval if user navigates away
-            const originalPushState = history.pushState;
-            const originalReplaceState = history.replaceState;
-
-            history.pushState = function () {
-                originalPushState.apply(history, arguments);
-                setTimeout(() => {
-                    if (!isYouTubeVideoUrl(window.location.href)) {
-                        clearInterval(timeLogger);
-                    }
-                }, 100);
-            };
-
-            history.replaceState = function () {
-                originalReplaceState.apply(history, arguments);
-                setTimeout(() => {
-                    if (!isYouTubeVideoUrl(window.location.href)) {
-                        clearInterval(timeLogger);
-                    }
-                }, 100);
-            };
-
-            window.addEventListener('popstate', () => {
-                setTimeout(() => {
-                    if (!isYouTubeVideoUrl(window.location.href)) {
-                        clearInterval(timeLogger);
-                    }
-                }, 100);
-            });
+// Put another device's clipboard text on ours, execCommand covers pages where writeText is refused
+function writeClipboardText(text) {
+    navigator.clipboard.writeText(text).catch(() => {
+        const textarea = document.createElement('textarea');
+        textarea.value = text;
+        textarea.style.cssText = 'position: fixed; top: 0; left: 0; opacity: 0;';
+        document.body.appendChild(textarea);
+        textarea.select();
+        writingClipboard = true;
+        try {
+            document.execCommand('copy');
+        } finally {
+            writingClipboard = false;
+            textarea.remove();
         }
-    }, 500); // Check every 500ms for video element
-
-    // Stop checking after 10 seconds if no video found
-    setTimeout(() => {
-        clearInterval(checkForVideo);
-    }, 10000);
-}
-
-function logVideoTime(videoElement) {
-    if (!videoElement) return;
-
-    const currentTime = videoElement.currentTime;
-    const duration = videoElement.duration;
-    const timeElapsed = formatTime(currentTime);
-    const totalDuration = formatTime(duration);
-    const percentComplete = duration > 0 ? ((currentTime / duration) * 100).toFixed(1) : 0;
-
-    // Create a properly formatted YouTube timestamp link
-    const timeInSeconds = Math.floor(currentTime);
-    const timestampLink = createYouTubeTimestampLink(window.location.href, timeInSeconds);
-
-    console.log(`YouTube Video Link: ${timestampLink}`);
-    console.log(`YouTube Video Time - Elapsed: ${timeElapsed} / ${totalDuration} (${percentComplete}%)`);
-
-    // Send YouTube video info to server for mobile notification
-    sendYouTubeVideoInfo(videoElement, timestampLink);
+    });
 }
 
-function sendYouTubeVideoInfo(videoElement, timestampLink) {
-    const videoId = extractYouTubeVideoId(window.location.href);
-    if (!videoId) return;
-
-    // Get video title from page
-    const videoTitle = document.querySelector('h1.ytd-video-primary-info-renderer') ||
-        document.querySelector('h1.title') ||
-        document.querySelector('title');
+// Media handoff: tell the server what video or audio plays in this page, so
+// other devices can continue it. The server recognizes the site from the URL.
+const NOW_PLAYING_INTERVAL = 5000; // ms between reports while playing
 
-    const title = videoTitle ? videoTitle.textContent.trim() : 'YouTube Video';
+let trackedMedia = null;
+let nowPlayingTimer = null;
 
-    const videoInfo = {
-        videoId: videoId,
-        title: title,
-        currentTime: Math.floor(videoElement.currentTime),
-        duration: Math.floor(videoElement.duration),
-        timestampLink: timestampLink,
-        isPlaying: !videoElement.paused,
-        url: window.location.href
-    };
-
-    console.log('Sending YouTube video info:', videoInfo);
-
-    // Send to background script to forward to server
-    chrome.runtime.sendMessage({
-        type: 'youtube-video-info',
-        videoInfo: videoInfo
-    }).then(response => {
-        console.log('YouTube video info sent successfully:', response);
-    }).catch(err => {
-        console.error('Error sending YouTube video info:', err);
+// Media events don't bubble, so they are captured on the document. That also
+// covers players single-page sites create after navigating.
+function startMediaTracking() {
+    for (const type of ['play', 'pause', 'seeked', 'ended']) {
+        document.addEventListener(type, onMediaEvent, true);
+    }
+    window.addEventListener('pagehide', () => {
+        if (trackedMedia) {
+            stopNowPlaying();
+        }
     });
 }
 
-function createYouTubeTimestampLink(currentUrl, timeInSeconds) {
-    try {
-        // Extract video ID from various YouTube URL formats
-        const videoId = extractYouTubeVideoId(currentUrl);
+// Muted loops are page decoration and short clips not worth continuing elsewhere
+function isHandoffMedia(media) {
+    return !(media.muted && media.loop) && !(media.duration < 5);
+}
 
-        if (videoId) {
-            return `https://youtu.be/${videoId}?t=${timeInSeconds}`;
-        } else {
-            console.error('Could not extract video ID from URL:', currentUrl);
-            return currentUrl;
+function onMediaEvent(event) {
+    const media = event.target;
+    if (!(media instanceof HTMLMediaElement)) {
+        return;
+    }
+    if (event.type === 'play' && media !== trackedMedia) {
+        if (!isHandoffMedia(media)) {
+            return;
         }
-    } catch (error) {
-        console.error('Error creating timestamp link:', error);
-        return currentUrl;
+        console.log('Now playing: Tracking', media.currentSrc);
+        trackedMedia = media;
+        clearInterval(nowPlayingTimer);
+        nowPlayingTimer = setInterval(() => {
+            if (trackedMedia && !trackedMedia.paused) {
+                reportNowPlaying(trackedMedia);
+            }
+        }, NOW_PLAYING_INTERVAL);
+    }
+    if (media === trackedMedia) {
+        reportNowPlaying(media);
     }
 }
 
-function extractYouTubeVideoId(url) {
-    // Match various YouTube URL formats and extract the video ID:
-    // https://www.youtube.com/watch?v=VIDEO_ID
-    // https://youtu.be/VIDEO_ID
-    // https://m.youtube.com/watch?v=VIDEO_ID
-    // https://youtube.com/watch?v=VIDEO_ID
-    const patterns = [
-        // Standard youtube.com watch URLs (most common)
-        /[?&]v=([a-zA-Z0-9_-]{11})(?:[&#]|$)/,
-        // youtu.be short URLs
-        /youtu\.be\/([a-zA-Z0-9_-]{11})(?:[?&#]|$)/,
-        // Embed URLs
-        /youtube\.com\/embed\/([a-zA-Z0-9_-]{11})(?:[?&#]|$)/,
-        // Direct video URLs
-        /youtube\.com\/v\/([a-zA-Z0-9_-]{11})(?:[?&#]|$)/
-    ];
-
-    for (const pattern of patterns) {
-        const match = url.match(pattern);
-        if (match && match[1]) {
-            console.log(`Extracted video ID: ${match[1]} from URL: ${url}`);
-            return match[1];
-        }
+// Title and artist the page gives its player, else the page title
+function mediaTitle() {
+    const metadata = navigator.mediaSession && navigator.mediaSession.metadata;
+    if (metadata && metadata.title) {
+        return { title: metadata.title, artist: metadata.artist || '' };
     }
-
-    console.error(`Could not extract video ID from URL: ${url}`);
-    return null;
+    return { title: document.title, artist: '' };
 }
 
-function formatTime(seconds) {
-    if (isNaN(seconds) || seconds < 0) return '0:00';
+function reportNowPlaying(media) {
+    const { title, artist } = mediaTitle();
+    const nowPlaying = {
+        url: window.location.href,
+        title: title,
+        artist: artist,
+        kind: media instanceof HTMLVideoElement ? 'video' : 'audio',
+        position: media.currentTime || 0,
+        duration: isFinite(media.duration) ? media.duration : 0,
+        playing: !media.paused && !media.ended
+    };
 
-    const hours = Math.floor(seconds / 3600);
-    const minutes = Math.floor((seconds % 3600) / 60);
-    const secs = Math.floor(seconds % 60);
+    chrome.runtime.sendMessage({ type: 'now-playing', nowPlaying }).catch(err => {
+        console.error('Error sending now playing:', err);
+    });
+}
 
-    if (hours > 0) {
-        return `${hours}:${minutes.toString().padStart(2, '0')}:${secs.toString().padStart(2, '0')}`;
-    } else {
-        return `${minutes}:${secs.toString().padStart(2, '0')}`;
-    }
+function stopNowPlaying() {
+    clearInterval(nowPlayingTimer);
+    nowPlayingTimer = null;
+    trackedMedia = null;
+    chrome.runtime.sendMessage({ type: 'now-playing', nowPlaying: null }).catch(() => { });
 }
 
 // Listen for messages from background script
@@ -228,6 +143,12 @@ chrome.runtime.onMessage.addListener((msg, sender, sendResponse) => {
         return;
     }
 
+    // Clipboard text from another device, we are the active tab
+    if (msg.type === 'write-clipboard') {
+        writeClipboardText(msg.text);
+        return;
+    }
+
     // Handle WebSocket status updates from background script
     if (msg.type === 'websocket-status') {
         console.log('WebSocket status update:', msg.connected, msg.error ? 'with error' : '', msg.errorMessage || '');
@@ -422,6 +343,9 @@ chrome.runtime.onMessage.addListener((msg, sender, sendResponse) => {
                     // Prevent scroll propagation when hovering over sidebar
                     setupScrollPrevention();
 
+                    // Load older messages when scrolled to the top
+                    setupHistoryPaging();
+
                     // Set initial closed position based on width
                     const sidebarWidth = sidebar.offsetWidth;
                     sidebar.style.setProperty('right', `-${sidebarWidth + 10}px`, 'important');
@@ -534,6 +458,40 @@ function setupScrollPrevention() {
     }, { passive: false });
 }
 
+// Older pages of the history are fetched by the background script on demand
+let hasOlderItems = false;
+let loadingOlderItems = false;
+let keepScrollPosition = false;
+
+function setupHistoryPaging() {
+    const conversation = document.getElementById('conversation');
+    if (!conversation) {
+        return;
+    }
+
+    conversation.addEventListener('scroll', function () {
+        if (conversation.scrollTop > 50 || !hasOlderItems || loadingOlderItems) {
+            return;
+        }
+        loadingOlderItems = true;
+        chrome.runtime.sendMessage({ type: 'load-older-items' })
+            .then(response => {
+                if (response.success && response.loaded > 0) {
+                    keepScrollPosition = true;
+                    displayConversationData(response.data);
+                } else if (!response.success) {
+                    console.error('Error loading older items:', response.error);
+                }
+            })
+            .catch(err => {
+                console.error('Error communicating with background script:', err);
+            })
+            .finally(() => {
+                loadingOlderItems = false;
+            });
+    });
+}
+
 // WebSocket functionality for real-time updates (via background script)
 let websocketConnected = false;
 
@@ -608,6 +566,10 @@ function displayConversationData(data) {
 
     console.log('Found conversation div, displaying', data?.items?.length || 0, 'items');
 
+    // After loading older items, keep the messages in view where they were
+    const distanceFromBottom = conversationDiv.scrollHeight - conversationDiv.scrollTop;
+    hasOlderItems = Boolean(data.hasMore);
+
     // Clear existing content
     conversationDiv.innerHTML = '';
 
@@ -632,32 +594,50 @@ function displayConversationData(data) {
 
             // Add content based on type
             if (item.type === 'text') {
-                // Check if content contains URLs and make them clickable
-                const urlRegex = /(https?:\/\/[^\s]+)/g;
-                if (urlRegex.test(item.content)) {
-                    // Content has URLs, replace with clickable links
-                    const htmlContent = item.content.replace(urlRegex, '<a href="$1" target="_blank" style="color: #4A9EFF; text-decoration: underline;">$1</a>');
-                    messageDiv.innerHTML = htmlContent;
-                } else {
-                    // No URLs, just set as text
-                    messageDiv.textContent = item.content;
-                }
+                // URLs in the text become clickable links
+                appendTextWithLinks(messageDiv, item.content);
+            } else if (item.type === 'clipboard') {
+                // Copied text is shown exactly as it was copied
+                messageDiv.textContent = item.content;
             } else if (item.type === 'file') {
-                // Parse filename and unique filename from content
-                const parts = item.content.split('|');
-                const displayName = parts[0];
-                const uniqueFilename = parts[1] || parts[0]; // fallback for old format
+                // Name the file was sent with and its name in the uploads folder
+                const displayName = item.file.name;
+                const uniqueFilename = item.file.storedName;
 
                 // Make file message clickable for download
                 const fileSpan = document.createElement('span');
                 fileSpan.style.cssText = 'color: #4A9EFF; text-decoration: underline; cursor: pointer;';
                 fileSpan.textContent = displayName;
                 fileSpan.addEventListener('click', function () {
-                    downloadFile(uniqueFilename, displayName);
+                    downloadFile(item.id, uniqueFilename, displayName);
                 });
 
+                // Images get a preview, sized up front so the list doesn't jump while it loads
+                if (item.file.thumbnail) {
+                    const thumb = document.createElement('img');
+                    thumb.style.cssText = 'display: block; max-width: 100%; height: auto; margin-bottom: 4px; border-radius: 6px; cursor: pointer;';
+                    thumb.alt = displayName;
+                    if (item.file.width && item.file.height) {
+                        const scale = Math.min(1, 320 / Math.max(item.file.width, item.file.height));
+                        thumb.width = Math.max(1, Math.round(item.file.width * scale));
+                        thumb.height = Math.max(1, Math.round(item.file.height * scale));
+                    }
+                    thumb.addEventListener('click', function () {
+                        downloadFile(item.id, uniqueFilename, displayName);
+                    });
+                    loadThumbnail(thumb, item.id);
+                    messageDiv.appendChild(thumb);
+                }
+
                 // messageDiv.innerHTML = '📎 ';
                 messageDiv.appendChild(fileSpan);
+            } else if (item.type === 'link') {
+                messageDiv.appendChild(createLinkPreview(item));
+            } else if (item.type === 'encrypted') {
+                // End-to-end encrypted, but not for this device's key
+                messageDiv.style.fontStyle = 'italic';
+                messageDiv.style.color = '#aaa';
+                messageDiv.textContent = '🔒 Encrypted message';
             }
 
             // Add timestamp
@@ -668,14 +648,19 @@ function displayConversationData(data) {
                 margin-top: 4px;
             `;
             const time = new Date(item.timestamp).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
-            timeDiv.textContent = `${item.from} • ${time}`;
+            timeDiv.textContent = `${item.encrypted ? '🔒 ' : ''}${item.type === 'clipboard' ? '📋 ' : ''}${item.deviceName || item.from} • ${time}`;
             messageDiv.appendChild(timeDiv);
 
             conversationDiv.appendChild(messageDiv);
         });
 
-        // Scroll to bottom
-        conversationDiv.scrollTop = conversationDiv.scrollHeight;
+        if (keepScrollPosition) {
+            conversationDiv.scrollTop = conversationDiv.scrollHeight - distanceFromBottom;
+        } else {
+            // Scroll to bottom
+            conversationDiv.scrollTop = conversationDiv.scrollHeight;
+        }
+        keepScrollPosition = false;
     } else {
         conversationDiv.innerHTML = '<div style="color: #aaa; padding: 20px; text-align: center;">No messages yet</div>';
     }
@@ -795,7 +780,8 @@ function setupQRCode() {
                 };
             }
 
-            const mobileUrl = `http://${settings.serverHost}:${settings.serverPort}/mobile`;
+            const scheme = settings.useHttps ? 'https' : 'http';
+            const mobileUrl = `${scheme}://${settings.serverHost}:${settings.serverPort}/mobile`;
 
             // Generate QR code
             generateQRCode(mobileUrl, 'qrCode');
@@ -928,12 +914,91 @@ function sendFile(file) {
         });
 }
 
-function downloadFile(uniqueFilename, displayName) {
+// Show text with its URLs as links. Built from nodes, never parsed as HTML.
+function appendTextWithLinks(container, text) {
+    const urlRegex = /https?:\/\/[^\s]+/g;
+    let lastIndex = 0;
+    for (const match of text.matchAll(urlRegex)) {
+        if (match.index > lastIndex) {
+            container.appendChild(document.createTextNode(text.substring(lastIndex, match.index)));
+        }
+        const link = document.createElement('a');
+        link.href = match[0];
+        link.target = '_blank';
+        link.rel = 'noopener noreferrer';
+        link.style.cssText = 'color: #4A9EFF; text-decoration: underline;';
+        link.textContent = match[0];
+        container.appendChild(link);
+        lastIndex = match.index + match[0].length;
+    }
+    if (lastIndex < text.length) {
+        container.appendChild(document.createTextNode(text.substring(lastIndex)));
+    }
+}
+
+// Preview card of a link item, with the title, description and icon the
+// server fetched. Until then, or if the page had none, it shows the URL.
+function createLinkPreview(item) {
+    const link = item.link || {};
+    const card = document.createElement('a');
+    card.href = link.url || item.content;
+    card.target = '_blank';
+    card.rel = 'noopener noreferrer';
+    card.style.cssText = 'display: block; color: #4A9EFF; text-decoration: none; text-align: left;';
+
+    const header = document.createElement('div');
+    header.style.cssText = 'display: flex; align-items: center; gap: 6px;';
+    if (link.favicon) {
+        const icon = document.createElement('img');
+        icon.src = link.favicon;
+        icon.alt = '';
+        icon.width = 16;
+        icon.height = 16;
+        icon.style.cssText = 'flex: none; border-radius: 3px;';
+        header.appendChild(icon);
+    }
+    const title = document.createElement('span');
+    title.style.cssText = 'text-decoration: underline; font-weight: bold;';
+    title.textContent = link.title || item.content;
+    header.appendChild(title);
+    card.appendChild(header);
+
+    if (link.description) {
+        const description = document.createElement('div');
+        description.style.cssText = 'margin-top: 4px; color: #ddd; font-size: 0.9em;';
+        description.textContent = link.description;
+        card.appendChild(description);
+    }
+    if (link.title) {
+        const host = document.createElement('div');
+        host.style.cssText = 'margin-top: 2px; color: #aaa; font-size: 0.8em;';
+        host.textContent = link.host;
+        card.appendChild(host);
+    }
+    return card;
+}
+
+// Thumbnails come through the background script, the page can't reach the server itself
+function loadThumbnail(img, itemId) {
+    chrome.runtime.sendMessage({
+        type: 'get-thumbnail',
+        itemId: itemId
+    }).then(response => {
+        if (response && response.success) {
+            img.src = response.dataUrl;
+        } else {
+            img.remove();
+        }
+    }).catch(() => img.remove());
+}
+
+function downloadFile(itemId, uniqueFilename, displayName) {
     console.log('Downloading file:', displayName, 'unique:', uniqueFilename);
 
     // Use background script's download handler to avoid HTTP warnings
     chrome.runtime.sendMessage({
         type: 'download-file',
+        itemId: itemId,
         uniqueFilename: uniqueFilename,
         displayName: displayName
     })
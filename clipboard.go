@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Clipboard sync: devices push their clipboard changes as "clipboard" items.
+// The server keeps the newest clipboard item of each device, older ones are
+// deleted, and sends every change as a clipboard event to the connections
+// that subscribed with the clipboard_subscribe command.
+//
+// A device that receives a clipboard event usually copies the text, which its
+// clipboard watcher then reports as a change of its own. Such echoes repeat the
+// current clipboard and are dropped here, so clients don't have to notice.
+
+// Largest clipboard text accepted, in bytes
+const maxClipboardSize = 256 << 10
+
+var (
+	errClipboardEmpty    = errors.New("Clipboard text is required")
+	errClipboardTooLarge = fmt.Errorf("Clipboard text is larger than %d KB", maxClipboardSize>>10)
+)
+
+// Payload of a clipboard item
+type ClipboardPayload struct {
+	SHA256 string `json:"sha256"` // of the text, compared to recognize echoes
+}
+
+type Clipboard struct {
+	latest  map[string]string // clipboard key -> ID of the device's clipboard item
+	current string            // ID of the newest clipboard item of any device
+	mutex   sync.Mutex
+}
+
+func NewClipboard() *Clipboard {
+	return &Clipboard{latest: make(map[string]string)}
+}
+
+var clipboard = NewClipboard()
+
+// Key of the device a clipboard item came from, see senderKey
+func itemClipboardKey(item Item) string {
+	if item.DeviceID != "" {
+		return item.DeviceID
+	}
+	return "anonymous:" + item.From
+}
+
+// Find the newest clipboard item of each device in the stored items
+func (c *Clipboard) Rebuild(items []Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.latest = make(map[string]string)
+	c.current = ""
+	for _, item := range items {
+		if item.Type != "clipboard" {
+			continue
+		}
+		c.latest[itemClipboardKey(item)] = item.ID
+		c.current = item.ID
+	}
+	fmt.Printf("[DEBUG] Clipboard: %d devices have a clipboard\n", len(c.latest))
+}
+
+// Store a device's new clipboard text and delete its previous clipboard item.
+// Text that already is the current clipboard is an echo: nothing changes and
+// the current item is returned with false.
+func (c *Clipboard) Push(from string, device *PairedDevice, text string) (Item, bool, error) {
+	if text == "" {
+		return Item{}, false, errClipboardEmpty
+	}
+	if len(text) > maxClipboardSize {
+		return Item{}, false, errClipboardTooLarge
+	}
+	sum := sha256.Sum256([]byte(text))
+	hash := hex.EncodeToString(sum[:])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if current, ok := itemStore.Get(c.current); ok && current.Clipboard != nil && current.Clipboard.SHA256 == hash {
+		fmt.Printf("[DEBUG] Clipboard: Ignoring echo of %s from %s\n", current.ID, from)
+		return current, false, nil
+	}
+
+	item := newItem(from, device, nil, "clipboard", text)
+	item.Clipboard = &ClipboardPayload{SHA256: hash}
+	if err := itemStore.Add(item); err != nil {
+		return Item{}, false, err
+	}
+
+	key := senderKey(from, device)
+	previous := c.latest[key]
+	c.latest[key] = item.ID
+	c.current = item.ID
+
+	// Gone already if it was deleted by hand or by retention
+	if previous != "" {
+		if old, err := deleteItem(previous); err == nil {
+			publishItemDeleted(old)
+		}
+	}
+	return item, true, nil
+}
+
+// Get the current clipboard and the newest clipboard item of every device
+func (c *Clipboard) Snapshot() (*Item, []Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var current *Item
+	if item, ok := itemStore.Get(c.current); ok {
+		current = &item
+	}
+	latest := []Item{}
+	for _, id := range c.latest {
+		if item, ok := itemStore.Get(id); ok {
+			latest = append(latest, item)
+		}
+	}
+	return current, latest
+}
+
+// Push a clipboard change and tell everyone about it. sender is the connection
+// it came in on, nil for HTTP.
+func pushClipboard(from string, device *PairedDevice, sender *Client, text string) (Item, bool, error) {
+	item, changed, err := clipboard.Push(from, device, text)
+	if err != nil || !changed {
+		return item, changed, err
+	}
+	publishItemAdded(item)
+	connectionManager.BroadcastClipboard(item, sender)
+	return item, true, nil
+}
+
+// HTTP status for an error from Clipboard.Push
+func clipboardErrorStatus(err error) int {
+	switch err {
+	case errClipboardEmpty:
+		return http.StatusBadRequest
+	case errClipboardTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// Handle the clipboard endpoints (/pc/clipboard and /mobile/clipboard):
+//
+//	GET   the current clipboard and the newest clipboard item of each device
+//	POST  push a clipboard change ({"text"}), for clients without a WebSocket
+func handleClipboard(w http.ResponseWriter, r *http.Request, from string) {
+	fmt.Printf("[DEBUG] Clipboard endpoint called - From: %s, Method: %s\n", from, r.Method)
+
+	switch r.Method {
+	case "GET":
+		current, devices := clipboard.Snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"current": current, "devices": devices})
+
+	case "POST":
+		var clipData struct {
+			Text string `json:"text"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCommandSize)
+		if err := json.NewDecoder(r.Body).Decode(&clipData); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, errClipboardTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		item, changed, err := pushClipboard(from, requestDevice(r), nil, clipData.Text)
+		if err != nil {
+			fmt.Printf("[ERROR] Clipboard: Error saving clipboard from %s: %v\n", from, err)
+			status := clipboardErrorStatus(err)
+			message := err.Error()
+			if status == http.StatusInternalServerError {
+				message = "Error saving data"
+			}
+			http.Error(w, message, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "id": item.ID, "changed": changed})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
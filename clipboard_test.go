@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClipboardPush(t *testing.T) {
+	useTestItemStore(t)
+	laptop := &PairedDevice{ID: "dev_laptop", Name: "Laptop"}
+	phone := &PairedDevice{ID: "dev_phone", Name: "Phone"}
+
+	first, changed, err := clipboard.Push("PC", laptop, "hello")
+	if err != nil || !changed {
+		t.Fatalf("first push: changed %v, err %v", changed, err)
+	}
+	if first.Type != "clipboard" || first.Content != "hello" || first.Clipboard == nil {
+		t.Errorf("clipboard item = %+v", first)
+	}
+
+	// The phone copies what it received and reports it back
+	echo, changed, err := clipboard.Push("phone", phone, "hello")
+	if err != nil || changed || echo.ID != first.ID {
+		t.Errorf("echo: changed %v, id %s, err %v", changed, echo.ID, err)
+	}
+
+	second, changed, _ := clipboard.Push("phone", phone, "world")
+	if !changed {
+		t.Fatalf("new text from the phone was not stored")
+	}
+
+	// The laptop's next copy replaces its previous clipboard item
+	third, _, _ := clipboard.Push("PC", laptop, "again")
+	if _, ok := itemStore.Get(first.ID); ok {
+		t.Errorf("previous clipboard item of the laptop was kept")
+	}
+
+	current, latest := clipboard.Snapshot()
+	if current == nil || current.ID != third.ID {
+		t.Errorf("current clipboard = %+v, want %s", current, third.ID)
+	}
+	ids := map[string]bool{}
+	for _, item := range latest {
+		ids[item.ID] = true
+	}
+	if len(latest) != 2 || !ids[second.ID] || !ids[third.ID] {
+		t.Errorf("latest clipboards = %+v", latest)
+	}
+
+	// Text from before the current clipboard is a change again
+	if _, changed, _ := clipboard.Push("phone", phone, "hello"); !changed {
+		t.Errorf("older text not accepted")
+	}
+
+	// The index survives a restart
+	clipboard = NewClipboard()
+	clipboard.Rebuild(itemStore.List())
+	if _, latest := clipboard.Snapshot(); len(latest) != 2 {
+		t.Errorf("rebuilt clipboards = %+v", latest)
+	}
+	if _, changed, _ := clipboard.Push("PC", laptop, "hello"); changed {
+		t.Errorf("echo accepted after rebuild")
+	}
+}
+
+func TestClipboardLimits(t *testing.T) {
+	useTestItemStore(t)
+
+	if _, _, err := clipboard.Push("PC", nil, ""); err != errClipboardEmpty {
+		t.Errorf("empty text: err = %v", err)
+	}
+	if _, _, err := clipboard.Push("PC", nil, strings.Repeat("x", maxClipboardSize+1)); err != errClipboardTooLarge {
+		t.Errorf("large text: err = %v", err)
+	}
+	if _, changed, err := clipboard.Push("PC", nil, strings.Repeat("x", maxClipboardSize)); err != nil || !changed {
+		t.Errorf("text at the limit: changed %v, err %v", changed, err)
+	}
+	if len(itemStore.List()) != 1 {
+		t.Errorf("store holds %d items, want 1", len(itemStore.List()))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Largest command frame a client may send; matches what a text message can reasonably hold
+const maxCommandSize = 1 << 20
+
+// Idle connections are closed when neither a command nor a pong arrives within this window
+const commandReadTimeout = 60 * time.Second
+
+// Command sent by a client over /pc/ws or /mobile/ws:
+//
+//	{"type": "send_message", "id": "1", "data": {"text": "hello", "to": ["dev_ab12"]}}
+//	{"type": "send_message", "id": "2", "data": {"text": "<ciphertext>", "e2e": {...}}}
+//	{"type": "delete_item",  "id": "2", "data": {"id": "item_123"}}
+//	{"type": "typing",       "data": {"typing": true}}
+//	{"type": "clipboard",    "id": "4", "data": {"text": "copied text"}}
+//	{"type": "clipboard_subscribe", "id": "5", "data": {"enabled": true}}
+//	{"type": "ping",         "id": "3"}
+//
+// Commands with an id are answered with an ack carrying the same id.
+type WSCommand struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Reply to a command, sent as {"type": "ack", "id": ..., "ok": ...}
+type WSAck struct {
+	Type  string      `json:"type"`
+	ID    string      `json:"id"`
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Read and execute commands until the connection fails or is closed
+func readWebSocketCommands(client *Client, from string) error {
+	conn := client.conn
+	conn.SetReadLimit(maxCommandSize)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(commandReadTimeout))
+		client.Touch()
+
+		var command WSCommand
+		if err := json.Unmarshal(message, &command); err != nil {
+			fmt.Printf("[ERROR] WebSocket command: Invalid JSON from %s: %v\n", from, err)
+			sendCommandAck(client, WSAck{Error: "invalid JSON"})
+			continue
+		}
+
+		result, err := handleWebSocketCommand(client, from, command)
+		if command.ID == "" {
+			continue
+		}
+		ack := WSAck{ID: command.ID, OK: err == nil, Data: result}
+		if err != nil {
+			ack.Error = err.Error()
+		}
+		sendCommandAck(client, ack)
+	}
+}
+
+// Execute a single command and return the data for its ack
+func handleWebSocketCommand(client *Client, from string, command WSCommand) (interface{}, error) {
+	fmt.Printf("[DEBUG] WebSocket command: %s from %s (id: %s)\n", command.Type, from, command.ID)
+
+	switch command.Type {
+	case "send_message":
+		var msgData struct {
+			Text string      `json:"text"`
+			To   []string    `json:"to"`
+			E2E  *E2EPayload `json:"e2e"`
+		}
+		if err := json.Unmarshal(command.Data, &msgData); err != nil {
+			return nil, fmt.Errorf("invalid data")
+		}
+		if err := validateMessageText(msgData.Text); err != nil {
+			return nil, err
+		}
+		to, err := parseTargets(msgData.To, client.Device())
+		if err != nil {
+			return nil, err
+		}
+		var item Item
+		if msgData.E2E != nil {
+			if to, err = prepareEncryptedMessage(client.Device(), to, msgData.Text, msgData.E2E); err != nil {
+				return nil, err
+			}
+			item, err = addEncryptedItem(from, client.Device(), to, msgData.Text, msgData.E2E)
+		} else {
+			item, err = addTextItem(from, client.Device(), to, msgData.Text)
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] WebSocket command: Error saving message: %v\n", err)
+			return nil, fmt.Errorf("error saving data")
+		}
+		publishItemAdded(item)
+		startUnfurl(item)
+		return map[string]string{"id": item.ID}, nil
+
+	case "delete_item":
+		var deleteData struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(command.Data, &deleteData); err != nil || deleteData.ID == "" {
+			return nil, fmt.Errorf("item id is required")
+		}
+		if item, ok := itemStore.Get(deleteData.ID); ok && !itemVisibleTo(item, client.Device()) {
+			return nil, errItemNotFound
+		}
+		item, err := deleteItem(deleteData.ID)
+		if err == errItemNotFound {
+			return nil, err
+		} else if err != nil {
+			fmt.Printf("[ERROR] WebSocket command: Error deleting item %s: %v\n", deleteData.ID, err)
+			return nil, fmt.Errorf("error deleting item")
+		}
+		publishItemDeleted(item)
+		return map[string]string{"id": deleteData.ID}, nil
+
+	case "typing":
+		var typingData struct {
+			Typing bool `json:"typing"`
+		}
+		if len(command.Data) > 0 {
+			if err := json.Unmarshal(command.Data, &typingData); err != nil {
+				return nil, fmt.Errorf("invalid data")
+			}
+		}
+		// Relay to everyone else; the sender already knows it is typing
+		connectionManager.BroadcastEventFrom(client, "typing", map[string]interface{}{
+			"from":   from,
+			"typing": typingData.Typing,
+		})
+		return nil, nil
+
+	case "clipboard":
+		var clipData struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(command.Data, &clipData); err != nil {
+			return nil, fmt.Errorf("invalid data")
+		}
+		item, changed, err := pushClipboard(from, client.Device(), client, clipData.Text)
+		if err == errClipboardEmpty || err == errClipboardTooLarge {
+			return nil, err
+		} else if err != nil {
+			fmt.Printf("[ERROR] WebSocket command: Error saving clipboard: %v\n", err)
+			return nil, fmt.Errorf("error saving data")
+		}
+		return map[string]interface{}{"id": item.ID, "changed": changed}, nil
+
+	case "clipboard_subscribe":
+		subscribeData := struct {
+			Enabled bool `json:"enabled"`
+		}{Enabled: true}
+		if len(command.Data) > 0 {
+			if err := json.Unmarshal(command.Data, &subscribeData); err != nil {
+				return nil, fmt.Errorf("invalid data")
+			}
+		}
+		client.clipboard.Store(subscribeData.Enabled)
+		// New subscribers start from the current clipboard
+		current, _ := clipboard.Snapshot()
+		return map[string]interface{}{"enabled": subscribeData.Enabled, "current": current}, nil
+
+	case "ping":
+		return map[string]interface{}{"time": time.Now()}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown command: %s", command.Type)
+	}
+}
+
+func sendCommandAck(client *Client, ack WSAck) {
+	ack.Type = "ack"
+	client.Send(ack)
+}
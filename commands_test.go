@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Open a PC WebSocket connection to a test server
+func dialTestWebSocket(t *testing.T) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(handlePCWebSocket))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Send a command and wait for its ack, skipping the events in between
+func sendTestCommand(t *testing.T, conn *websocket.Conn, command string) WSAck {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var ack WSAck
+		if err := conn.ReadJSON(&ack); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		if ack.Type == "ack" {
+			return ack
+		}
+	}
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	useTestItemStore(t)
+
+	conn := dialTestWebSocket(t)
+	tests := []struct {
+		name    string
+		command string
+		id      string
+		err     string
+	}{
+		{"ping", `{"type":"ping","id":"1"}`, "1", ""},
+		{"message", `{"type":"send_message","id":"2","data":{"text":"hello"}}`, "2", ""},
+		{"empty message", `{"type":"send_message","id":"3","data":{"text":"  "}}`, "3", errMessageEmpty.Error()},
+		{"message data", `{"type":"send_message","id":"4","data":"hello"}`, "4", "invalid data"},
+		{"delete without ID", `{"type":"delete_item","id":"5","data":{}}`, "5", "item id is required"},
+		{"delete unknown item", `{"type":"delete_item","id":"6","data":{"id":"item_missing"}}`, "6", errItemNotFound.Error()},
+		{"unknown command", `{"type":"shout","id":"7"}`, "7", "unknown command: shout"},
+		{"invalid JSON", `{"type":`, "", "invalid JSON"},
+	}
+	for _, tt := range tests {
+		ack := sendTestCommand(t, conn, tt.command)
+		if ack.ID != tt.id || ack.OK != (tt.err == "") || ack.Error != tt.err {
+			t.Errorf("%s: ack = %+v", tt.name, ack)
+		}
+	}
+
+	// The message was stored, and the same client can delete it
+	items := itemStore.List()
+	if len(items) != 1 || items[0].Content != "hello" || items[0].From != "PC" {
+		t.Fatalf("items after send_message = %+v", items)
+	}
+	ack := sendTestCommand(t, conn, `{"type":"delete_item","id":"8","data":{"id":"`+items[0].ID+`"}}`)
+	if data, _ := json.Marshal(ack.Data); !ack.OK || !strings.Contains(string(data), items[0].ID) {
+		t.Errorf("delete ack = %+v", ack)
+	}
+	if len(itemStore.List()) != 0 {
+		t.Errorf("item left after delete_item")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages waiting to be written to one connection. A client that falls this
+// far behind is disconnected and catches up through the event log on reconnect.
+const clientSendQueueSize = 512
+
+// Longest a single write may take before the connection is considered dead
+const clientWriteTimeout = 10 * time.Second
+
+// How often connections are pinged and their device token is checked
+const clientPingInterval = 30 * time.Second
+
+// Connection kinds
+const (
+	clientPC     = "PC"
+	clientMobile = "mobile"
+)
+
+// WebSocket upgrader
+var upgrader = websocket.Upgrader{
+	CheckOrigin:      allowedOrigin,
+	ReadBufferSize:   1024,
+	WriteBufferSize:  1024,
+	HandshakeTimeout: 45 * time.Second,
+}
+
+// A WebSocket connection with its own outbound queue. Only the writer
+// goroutine writes to conn, as gorilla/websocket allows one writer at a time.
+type Client struct {
+	conn      *websocket.Conn
+	kind      string
+	request   *http.Request
+	device    atomic.Pointer[PairedDevice] // nil for anonymous connections
+	lastSeen  atomic.Int64                 // unix nanoseconds
+	clipboard atomic.Bool                  // subscribed to clipboard events
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewClient(conn *websocket.Conn, kind string, r *http.Request) *Client {
+	client := &Client{
+		conn:    conn,
+		kind:    kind,
+		request: r,
+		send:    make(chan []byte, clientSendQueueSize),
+		done:    make(chan struct{}),
+	}
+	if device := requestDevice(r); device != nil {
+		device.TokenHash = ""
+		client.device.Store(device)
+	}
+	client.Touch()
+	return client
+}
+
+// Registered device behind the connection, nil if anonymous
+func (c *Client) Device() *PairedDevice {
+	return c.device.Load()
+}
+
+// Key grouping all connections of one device
+func (c *Client) deviceKey() string {
+	if device := c.Device(); device != nil {
+		return device.ID
+	}
+	return "anonymous:" + c.kind
+}
+
+// Record activity from the client
+func (c *Client) Touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (c *Client) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Queue a message for the client
+func (c *Client) Send(message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("[ERROR] WebSocket: Error encoding message: %v\n", err)
+		return
+	}
+	c.sendRaw(data)
+}
+
+// Queue an encoded message without blocking; a full queue drops the client
+func (c *Client) sendRaw(data []byte) {
+	select {
+	case <-c.done:
+	case c.send <- data:
+	default:
+		fmt.Printf("[DEBUG] WebSocket: Dropping slow %s connection, %d messages queued\n", c.kind, len(c.send))
+		c.Close()
+	}
+}
+
+// Stop the writer, which closes the connection and ends the read loop
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Write queued messages and pings until the client is closed or a write fails
+func (c *Client) writePump() {
+	ticker := time.NewTicker(clientPingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				fmt.Printf("[DEBUG] %s WebSocket write failed: %v\n", c.kind, err)
+				return
+			}
+		case <-ticker.C:
+			// Drop the connection once its device token is revoked
+			if !isAuthorized(c.request) {
+				fmt.Printf("[DEBUG] %s WebSocket closed: device no longer authorized\n", c.kind)
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				fmt.Printf("[DEBUG] %s WebSocket ping failed: %v\n", c.kind, err)
+				return
+			}
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		}
+	}
+}
+
+// Handle PC WebSocket connections
+func handlePCWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveWebSocket(w, r, clientPC)
+}
+
+// Handle mobile WebSocket connections
+func handleMobileWebSocket(w http.ResponseWriter, r *http.Request) {
+	serveWebSocket(w, r, clientMobile)
+}
+
+func serveWebSocket(w http.ResponseWriter, r *http.Request, kind string) {
+	fmt.Printf("[DEBUG] %s WebSocket connection requested\n", kind)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade %s WebSocket connection: %v", kind, err)
+		return
+	}
+	defer conn.Close()
+
+	// Set connection timeouts
+	conn.SetReadDeadline(time.Now().Add(commandReadTimeout))
+
+	// Set ping/pong handlers for connection health checking, pongs count as activity
+	client := NewClient(conn, kind, r)
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(commandReadTimeout))
+		client.Touch()
+		return nil
+	})
+
+	go client.writePump()
+	defer client.Close()
+
+	// Add connection to manager and queue the history or the events it missed
+	eventLog.SyncConnection(client, r, func() { connectionManager.Add(client) })
+	defer connectionManager.Remove(client)
+
+	// Hand over targeted items that arrived while the device was offline
+	deliverQueuedItems(client)
+
+	fmt.Printf("[DEBUG] %s WebSocket connection established\n", kind)
+
+	// Offer the media other devices are playing to the new connection
+	sendNowPlaying(client)
+
+	// Keep connection alive and handle incoming commands
+	from := "PC"
+	if kind == clientMobile {
+		from = "phone"
+	}
+	err = readWebSocketCommands(client, from)
+	log.Printf("%s WebSocket connection closed: %v", kind, err)
+}
+
+// WebSocket connection management
+type ConnectionManager struct {
+	clients map[*Client]bool
+	mutex   sync.RWMutex
+}
+
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		clients: make(map[*Client]bool),
+	}
+}
+
+var connectionManager = NewConnectionManager()
+
+func (cm *ConnectionManager) Add(client *Client) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	cm.clients[client] = true
+	fmt.Printf("[DEBUG] ConnectionManager: Added %s connection (%s), total: %d\n", client.kind, client.deviceKey(), len(cm.clients))
+}
+
+func (cm *ConnectionManager) Remove(client *Client) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	delete(cm.clients, client)
+	fmt.Printf("[DEBUG] ConnectionManager: Removed %s connection (%s), total: %d\n", client.kind, client.deviceKey(), len(cm.clients))
+}
+
+// Number of open connections
+func (cm *ConnectionManager) Count() int {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return len(cm.clients)
+}
+
+// Broadcast a message to all PC and mobile connections
+func (cm *ConnectionManager) BroadcastMessage(message interface{}) {
+	cm.broadcast(message, func(*Client) bool { return true })
+}
+
+// Broadcast a typed event to all PC and mobile connections
+func (cm *ConnectionManager) BroadcastEvent(eventType string, data interface{}) {
+	cm.BroadcastEventFrom(nil, eventType, data)
+}
+
+// Broadcast a typed event to every connection except the sender
+func (cm *ConnectionManager) BroadcastEventFrom(sender *Client, eventType string, data interface{}) {
+	message := map[string]interface{}{
+		"type": eventType,
+		"data": data,
+	}
+	cm.broadcast(message, func(client *Client) bool { return client != sender })
+}
+
+// Send a message to every connection of a registered device
+func (cm *ConnectionManager) SendToDevice(deviceID string, message interface{}) {
+	cm.broadcast(message, func(client *Client) bool {
+		device := client.Device()
+		return device != nil && device.ID == deviceID
+	})
+}
+
+// Check if a registered device has an open connection
+func (cm *ConnectionManager) DeviceConnected(deviceID string) bool {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	for client := range cm.clients {
+		if device := client.Device(); device != nil && device.ID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// Send a now-playing event to every connection except those of the device
+// that plays the media
+func (cm *ConnectionManager) BroadcastNowPlaying(eventType string, data interface{}, deviceID string) {
+	message := map[string]interface{}{
+		"type": eventType,
+		"data": data,
+	}
+	cm.broadcast(message, func(client *Client) bool {
+		device := client.Device()
+		return deviceID == "" || device == nil || device.ID != deviceID
+	})
+}
+
+// Send a clipboard change to the subscribed connections, except those of the
+// device it came from which already has it
+func (cm *ConnectionManager) BroadcastClipboard(item Item, sender *Client) {
+	message := map[string]interface{}{
+		"type": "clipboard",
+		"data": item,
+	}
+	cm.broadcast(message, func(client *Client) bool {
+		if client == sender || !client.clipboard.Load() {
+			return false
+		}
+		device := client.Device()
+		return item.DeviceID == "" || device == nil || device.ID != item.DeviceID
+	})
+}
+
+// Queue a message for every matching connection. Encoding happens once and
+// queuing never blocks, so a slow connection can't hold up the others.
+func (cm *ConnectionManager) broadcast(message interface{}, include func(*Client) bool) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("[ERROR] WebSocket: Error encoding broadcast: %v\n", err)
+		return
+	}
+
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	for client := range cm.clients {
+		if include(client) {
+			client.sendRaw(data)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A connection whose writer is stuck, nothing leaves its queue
+func newStuckClient(queueSize int) *Client {
+	return &Client{
+		kind: clientPC,
+		send: make(chan []byte, queueSize),
+		done: make(chan struct{}),
+	}
+}
+
+func TestBroadcastDropsSlowClient(t *testing.T) {
+	cm := NewConnectionManager()
+	slow, fast := newStuckClient(2), newStuckClient(10)
+	cm.Add(slow)
+	cm.Add(fast)
+
+	// Broadcasting never waits for the slow connection
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			cm.BroadcastMessage(map[string]int{"n": i})
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast blocked on a full queue")
+	}
+
+	select {
+	case <-slow.done:
+	default:
+		t.Errorf("slow client not closed with %d messages queued", len(slow.send))
+	}
+	select {
+	case <-fast.done:
+		t.Errorf("client with room in its queue was closed")
+	default:
+	}
+	if len(fast.send) != 5 {
+		t.Errorf("fast client has %d messages queued, want 5", len(fast.send))
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const deliveryQueueFile = "memory/delivery-queue.json"
+
+// Targets naming a group start with this prefix, e.g. "group:family". Groups
+// are assigned by the admin, never by the devices themselves.
+const groupTargetPrefix = "group:"
+
+// Limits on the groups a device joins and the targets of one item
+const (
+	maxDeviceGroups = 10
+	maxItemTargets  = 20
+)
+
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+var (
+	errTargetNeedsDevice = fmt.Errorf("Only registered devices can send to specific devices")
+	errTooManyTargets    = fmt.Errorf("Too many targets (max %d)", maxItemTargets)
+)
+
+// Check and normalize the groups assigned to a device
+func validateDeviceGroups(groups []string) ([]string, error) {
+	if len(groups) > maxDeviceGroups {
+		return nil, fmt.Errorf("Too many groups (max %d)", maxDeviceGroups)
+	}
+	normalized := make([]string, 0, len(groups))
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		group = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(group, groupTargetPrefix)))
+		if !groupNamePattern.MatchString(group) {
+			return nil, fmt.Errorf("Invalid group name %q", group)
+		}
+		if !seen[group] {
+			seen[group] = true
+			normalized = append(normalized, group)
+		}
+	}
+	return normalized, nil
+}
+
+// Split a comma-separated target list from a query string or form field
+func splitTargets(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Check the targets of a new item: registered device IDs or "group:<name>".
+// Only registered devices may target, so recipients can see who sent it.
+func parseTargets(targets []string, sender *PairedDevice) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		normalized = append(normalized, target)
+	}
+	if len(normalized) == 0 {
+		return nil, nil
+	}
+	if sender == nil {
+		return nil, errTargetNeedsDevice
+	}
+	if len(normalized) > maxItemTargets {
+		return nil, errTooManyTargets
+	}
+
+	devices := authManager.Devices()
+	for i, target := range normalized {
+		if strings.HasPrefix(target, groupTargetPrefix) {
+			group := strings.ToLower(strings.TrimPrefix(target, groupTargetPrefix))
+			if !groupExists(devices, group) {
+				return nil, fmt.Errorf("Unknown group %q", group)
+			}
+			normalized[i] = groupTargetPrefix + group
+			continue
+		}
+		if !deviceExists(devices, target) {
+			return nil, fmt.Errorf("Unknown device %q", target)
+		}
+	}
+	return normalized, nil
+}
+
+func groupExists(devices []PairedDevice, group string) bool {
+	for _, device := range devices {
+		if deviceInGroup(&device, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func deviceExists(devices []PairedDevice, id string) bool {
+	for _, device := range devices {
+		if device.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Check group membership. Only the assigned groups count, the type a device
+// reports for itself says nothing about who it belongs to.
+func deviceInGroup(device *PairedDevice, group string) bool {
+	for _, joined := range device.Groups {
+		if joined == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a device may see an item. Untargeted items are for everyone,
+// targeted ones only for their targets and the device that sent them.
+func itemVisibleTo(item Item, device *PairedDevice) bool {
+	if len(item.To) == 0 {
+		return true
+	}
+	if device == nil {
+		return false
+	}
+	if item.DeviceID == device.ID {
+		return true
+	}
+	for _, target := range item.To {
+		if target == device.ID {
+			return true
+		}
+		if group, ok := strings.CutPrefix(target, groupTargetPrefix); ok && deviceInGroup(device, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Visibility check for the events about an item, nil when everyone may see it
+func itemAudience(item Item) func(*PairedDevice) bool {
+	if len(item.To) == 0 {
+		return nil
+	}
+	return func(device *PairedDevice) bool {
+		return itemVisibleTo(item, device)
+	}
+}
+
+// Registered devices a targeted item is for, not counting the sender
+func itemRecipients(item Item) []string {
+	var recipients []string
+	for _, device := range authManager.Devices() {
+		if device.ID != item.DeviceID && itemVisibleTo(item, &device) {
+			recipients = append(recipients, device.ID)
+		}
+	}
+	return recipients
+}
+
+// Targeted items waiting for their devices to connect, persisted so they
+// survive a restart
+type DeliveryQueue struct {
+	pending map[string][]string // device ID -> item IDs, oldest first
+	mutex   sync.Mutex
+}
+
+func NewDeliveryQueue() *DeliveryQueue {
+	return &DeliveryQueue{
+		pending: make(map[string][]string),
+	}
+}
+
+var deliveryQueue = NewDeliveryQueue()
+
+// Load queued deliveries from file
+func (q *DeliveryQueue) Load() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	fileData, err := os.ReadFile(deliveryQueueFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fileData, &q.pending); err != nil {
+		return err
+	}
+
+	fmt.Printf("[DEBUG] Delivery queue: Loaded deliveries for %d devices\n", len(q.pending))
+	return nil
+}
+
+// Save queued deliveries to file, caller must hold the mutex
+func (q *DeliveryQueue) save() error {
+	jsonData, err := json.MarshalIndent(q.pending, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(deliveryQueueFile, jsonData, 0644)
+}
+
+// Queue an item for a device that is offline
+func (q *DeliveryQueue) Enqueue(deviceID, itemID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.pending[deviceID] = append(q.pending[deviceID], itemID)
+	if err := q.save(); err != nil {
+		fmt.Printf("[ERROR] Delivery queue: Error saving queue: %v\n", err)
+	}
+}
+
+// Remove and return the items queued for a device
+func (q *DeliveryQueue) Take(deviceID string) []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	itemIDs, ok := q.pending[deviceID]
+	if !ok {
+		return nil
+	}
+	delete(q.pending, deviceID)
+	if err := q.save(); err != nil {
+		fmt.Printf("[ERROR] Delivery queue: Error saving queue: %v\n", err)
+	}
+	return itemIDs
+}
+
+// Drop deleted items from every device's queue
+func (q *DeliveryQueue) RemoveItems(itemIDs ...string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	removed := make(map[string]bool, len(itemIDs))
+	for _, id := range itemIDs {
+		removed[id] = true
+	}
+
+	changed := false
+	for deviceID, queued := range q.pending {
+		kept := queued[:0]
+		for _, id := range queued {
+			if !removed[id] {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == len(queued) {
+			continue
+		}
+		changed = true
+		if len(kept) == 0 {
+			delete(q.pending, deviceID)
+		} else {
+			q.pending[deviceID] = kept
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := q.save(); err != nil {
+		fmt.Printf("[ERROR] Delivery queue: Error saving queue: %v\n", err)
+	}
+}
+
+// Drop the queue of a revoked device
+func (q *DeliveryQueue) RemoveDevice(deviceID string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.pending[deviceID]; !ok {
+		return
+	}
+	delete(q.pending, deviceID)
+	if err := q.save(); err != nil {
+		fmt.Printf("[ERROR] Delivery queue: Error saving queue: %v\n", err)
+	}
+}
+
+// Drop every queued delivery, used when the history is cleared
+func (q *DeliveryQueue) Clear() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.pending) == 0 {
+		return
+	}
+	q.pending = make(map[string][]string)
+	if err := q.save(); err != nil {
+		fmt.Printf("[ERROR] Delivery queue: Error saving queue: %v\n", err)
+	}
+}
+
+// Number of deliveries waiting for a device
+func (q *DeliveryQueue) Pending(deviceID string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending[deviceID])
+}
+
+// Hand a new targeted item to its recipients: online devices already got it
+// through the item_added event, offline ones get it when they reconnect
+func routeTargetedItem(item Item) {
+	for _, deviceID := range itemRecipients(item) {
+		if connectionManager.DeviceConnected(deviceID) {
+			notifyDelivered(item, deviceID)
+			continue
+		}
+		fmt.Printf("[DEBUG] Delivery: Queued item %s for offline device %s\n", item.ID, deviceID)
+		deliveryQueue.Enqueue(deviceID, item.ID)
+	}
+}
+
+// Send a reconnecting device the targeted items queued while it was offline
+func deliverQueuedItems(client *Client) {
+	device := client.Device()
+	if device == nil {
+		return
+	}
+	itemIDs := deliveryQueue.Take(device.ID)
+	if len(itemIDs) == 0 {
+		return
+	}
+
+	items := make([]Item, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		if item, ok := itemStore.Get(id); ok {
+			items = append(items, item)
+		}
+	}
+	fmt.Printf("[DEBUG] Delivery: Sending %d queued items to %s\n", len(items), device.ID)
+
+	client.Send(map[string]interface{}{
+		"type": "queued_items",
+		"data": map[string]interface{}{"items": items},
+	})
+	for _, item := range items {
+		notifyDelivered(item, device.ID)
+	}
+}
+
+// Tell the sending device that a targeted item reached one of its recipients
+func notifyDelivered(item Item, deviceID string) {
+	if item.DeviceID == "" {
+		return
+	}
+	connectionManager.SendToDevice(item.DeviceID, map[string]interface{}{
+		"type": "item_delivered",
+		"data": map[string]interface{}{
+			"id":          item.ID,
+			"deviceId":    deviceID,
+			"deliveredAt": time.Now(),
+		},
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// Use a fresh delivery queue for the rest of the test
+func useTestDeliveryQueue(t *testing.T) {
+	t.Helper()
+	saved := deliveryQueue
+	deliveryQueue = NewDeliveryQueue()
+	t.Cleanup(func() { deliveryQueue = saved })
+}
+
+func TestParseTargets(t *testing.T) {
+	am := useTestAuthManager(t)
+	_, laptop, _ := am.Register("Laptop", deviceTypePC)
+	_, phone, _ := am.Register("Phone", deviceTypeMobile)
+	am.SetGroups(phone.ID, []string{"family"})
+
+	many := make([]string, maxItemTargets+1)
+	for i := range many {
+		many[i] = "group:family"
+		if i > 0 {
+			many[i] = strings.Repeat("x", i)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		targets []string
+		sender  *PairedDevice
+		want    []string
+		err     string
+	}{
+		{"everyone", nil, nil, nil, ""},
+		{"blank targets", []string{"", "  "}, nil, nil, ""},
+		{"device", []string{phone.ID}, laptop, []string{phone.ID}, ""},
+		{"group", []string{" group:Family "}, laptop, []string{"group:family"}, ""},
+		{"duplicates", []string{phone.ID, phone.ID, "group:family"}, laptop, []string{phone.ID, "group:family"}, ""},
+		{"anonymous sender", []string{phone.ID}, nil, nil, errTargetNeedsDevice.Error()},
+		{"unknown device", []string{"dev_missing"}, laptop, nil, `Unknown device "dev_missing"`},
+		{"unknown group", []string{"group:work"}, laptop, nil, `Unknown group "work"`},
+		{"device type is no group", []string{"group:mobile"}, laptop, nil, `Unknown group "mobile"`},
+		{"too many", many, laptop, nil, errTooManyTargets.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTargets(tt.targets, tt.sender)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("parseTargets(%q) error = %v, want %q", tt.targets, err, tt.err)
+				}
+				return
+			}
+			if err != nil || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("parseTargets(%q) = %q, %v; want %q", tt.targets, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestItemVisibleTo(t *testing.T) {
+	laptop := &PairedDevice{ID: "dev_laptop", Type: deviceTypePC}
+	phone := &PairedDevice{ID: "dev_phone", Type: deviceTypeMobile, Groups: []string{"family"}}
+	tablet := &PairedDevice{ID: "dev_tablet", Type: deviceTypeMobile}
+	// Types are reported by the devices themselves, anything goes
+	impostor := &PairedDevice{ID: "dev_impostor", Type: "family"}
+
+	tests := []struct {
+		name   string
+		item   Item
+		device *PairedDevice
+		want   bool
+	}{
+		{"untargeted", Item{}, tablet, true},
+		{"untargeted anonymous", Item{}, nil, true},
+		{"targeted anonymous", Item{To: []string{"group:mobile"}}, nil, false},
+		{"target device", Item{DeviceID: laptop.ID, To: []string{phone.ID}}, phone, true},
+		{"other device", Item{DeviceID: laptop.ID, To: []string{phone.ID}}, tablet, false},
+		{"sender", Item{DeviceID: laptop.ID, To: []string{phone.ID}}, laptop, true},
+		{"group", Item{DeviceID: laptop.ID, To: []string{"group:family"}}, phone, true},
+		{"not in group", Item{DeviceID: laptop.ID, To: []string{"group:family"}}, tablet, false},
+		{"type is no group", Item{DeviceID: laptop.ID, To: []string{"group:mobile"}}, tablet, false},
+		{"type named like a group", Item{DeviceID: laptop.ID, To: []string{"group:family"}}, impostor, false},
+		{"group name is no device ID", Item{DeviceID: laptop.ID, To: []string{"family"}}, phone, false},
+		{"any target", Item{DeviceID: laptop.ID, To: []string{"dev_other", "group:family"}}, phone, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := itemVisibleTo(tt.item, tt.device); got != tt.want {
+				t.Errorf("itemVisibleTo = %v, want %v", got, tt.want)
+			}
+			if audience := itemAudience(tt.item); audience != nil && audience(tt.device) != tt.want {
+				t.Errorf("itemAudience disagrees with itemVisibleTo")
+			} else if audience == nil && len(tt.item.To) > 0 {
+				t.Errorf("targeted item has no audience check")
+			}
+		})
+	}
+}
+
+func TestDeliveryQueue(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("memory", 0755); err != nil {
+		t.Fatal(err)
+	}
+	queue := NewDeliveryQueue()
+	queue.Enqueue("dev_a", "item_1")
+	queue.Enqueue("dev_a", "item_2")
+	queue.Enqueue("dev_b", "item_2")
+	queue.Enqueue("dev_c", "item_3")
+
+	// Deleted items leave every queue, emptied queues go away
+	queue.RemoveItems("item_2", "item_missing")
+	if queue.Pending("dev_a") != 1 || queue.Pending("dev_b") != 0 {
+		t.Errorf("after RemoveItems: dev_a %d, dev_b %d", queue.Pending("dev_a"), queue.Pending("dev_b"))
+	}
+	queue.RemoveDevice("dev_c")
+
+	// Queues survive a restart
+	reloaded := NewDeliveryQueue()
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Take("dev_a"); len(got) != 1 || got[0] != "item_1" {
+		t.Errorf("Take(dev_a) = %q", got)
+	}
+	if got := reloaded.Take("dev_a"); got != nil {
+		t.Errorf("second Take(dev_a) = %q", got)
+	}
+	if reloaded.Pending("dev_c") != 0 {
+		t.Errorf("queue of a revoked device reloaded")
+	}
+
+	reloaded.Enqueue("dev_d", "item_4")
+	reloaded.Clear()
+	if reloaded.Pending("dev_d") != 0 {
+		t.Errorf("queue kept after Clear")
+	}
+}
+
+func TestRouteTargetedItem(t *testing.T) {
+	am := useTestAuthManager(t)
+	useTestDeliveryQueue(t)
+	_, laptop, _ := am.Register("Laptop", deviceTypePC)
+	_, phone, _ := am.Register("Phone", deviceTypeMobile)
+	_, tablet, _ := am.Register("Tablet", deviceTypeMobile)
+	_, desktop, _ := am.Register("Desktop", deviceTypePC)
+	am.SetGroups(phone.ID, []string{"family"})
+	am.SetGroups(desktop.ID, []string{"family"})
+
+	// Every recipient is offline, the sender is never queued its own item
+	routeTargetedItem(Item{ID: "item_1", DeviceID: laptop.ID, To: []string{"group:family"}})
+	routeTargetedItem(Item{ID: "item_2", DeviceID: laptop.ID, To: []string{tablet.ID, desktop.ID}})
+
+	want := map[string]int{laptop.ID: 0, phone.ID: 1, tablet.ID: 1, desktop.ID: 2}
+	for id, n := range want {
+		if got := deliveryQueue.Pending(id); got != n {
+			t.Errorf("%s has %d queued items, want %d", id, got, n)
+		}
+	}
+}
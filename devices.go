@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Device entry reported on /status and /devices
+type DeviceStatus struct {
+	ID          string    `json:"id,omitempty"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Groups      []string  `json:"groups,omitempty"`
+	Connected   bool      `json:"connected"`
+	Connections int       `json:"connections"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// Get the registered device whose token came with the request, nil for
+// anonymous requests (the admin, or any client while pairing is disabled)
+func requestDevice(r *http.Request) *PairedDevice {
+	device, ok := authManager.Validate(requestToken(r))
+	if !ok {
+		return nil
+	}
+	return device
+}
+
+// Key of the device a request came from, anonymous senders share one per
+// endpoint ("PC" or "phone")
+func senderKey(from string, device *PairedDevice) string {
+	if device != nil {
+		return device.ID
+	}
+	return "anonymous:" + from
+}
+
+// Handle device registration: POST /devices/register with {"name", "type"}.
+// Clients that are already trusted get a token of their own so their items
+// can be told apart; a registered device calling it again is renamed. Groups
+// are not up to the device, the admin assigns them on /tokens/{id}.
+func handleDeviceRegister(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Device register endpoint called - Method: %s\n", r.Method)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var registerData struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&registerData); err != nil {
+		fmt.Printf("[ERROR] Device register: Invalid JSON: %v\n", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	name, deviceType, err := validateDeviceInfo(registerData.Name, registerData.Type)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Already registered: just update name and type
+	if device := requestDevice(r); device != nil {
+		device, err := authManager.UpdateDevice(device.ID, name, deviceType)
+		if err != nil {
+			fmt.Printf("[ERROR] Device register: Error updating device: %v\n", err)
+			http.Error(w, "Error updating device", http.StatusInternalServerError)
+			return
+		}
+		connectionManager.UpdateDevice(*device)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "success",
+			"deviceId": device.ID,
+			"name":     device.Name,
+			"type":     device.Type,
+			"groups":   device.Groups,
+		})
+		return
+	}
+
+	token, device, err := authManager.Register(name, deviceType)
+	if err != nil {
+		fmt.Printf("[ERROR] Device register: Error registering device: %v\n", err)
+		http.Error(w, "Error registering device", http.StatusInternalServerError)
+		return
+	}
+
+	setTokenCookie(w, r, token)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"token":    token,
+		"deviceId": device.ID,
+		"name":     device.Name,
+		"type":     device.Type,
+		"groups":   device.Groups,
+	})
+	fmt.Printf("[DEBUG] Device register: Response sent successfully\n")
+}
+
+// Handle devices endpoint: GET lists registered devices and who is online
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Devices endpoint called - Method: %s\n", r.Method)
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	online := make(map[string]DeviceStatus)
+	for _, status := range connectionManager.ConnectedDevices() {
+		online[status.ID] = status
+	}
+
+	var devices []DeviceStatus
+	for _, device := range authManager.Devices() {
+		status, ok := online[device.ID]
+		if !ok {
+			status = DeviceStatus{
+				ID:       device.ID,
+				Name:     device.Name,
+				Type:     device.Type,
+				LastSeen: device.LastUsed,
+			}
+		}
+		status.Groups = device.Groups
+		devices = append(devices, status)
+	}
+
+	response := map[string]interface{}{"devices": devices}
+	if device := requestDevice(r); device != nil {
+		response["self"] = device.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Group open connections by device, anonymous connections by kind
+func (cm *ConnectionManager) ConnectedDevices() []DeviceStatus {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	byDevice := make(map[string]*DeviceStatus)
+	for client := range cm.clients {
+		key := client.deviceKey()
+		status, ok := byDevice[key]
+		if !ok {
+			status = &DeviceStatus{Connected: true}
+			if device := client.Device(); device != nil {
+				status.ID = device.ID
+				status.Name = device.Name
+				status.Type = device.Type
+			} else {
+				status.Name = "Unregistered " + client.kind
+				status.Type = deviceTypeMobile
+				if client.kind == clientPC {
+					status.Type = deviceTypePC
+				}
+			}
+			byDevice[key] = status
+		}
+		status.Connections++
+		if lastSeen := client.LastSeen(); lastSeen.After(status.LastSeen) {
+			status.LastSeen = lastSeen
+		}
+	}
+
+	devices := make([]DeviceStatus, 0, len(byDevice))
+	for _, status := range byDevice {
+		devices = append(devices, *status)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeen.After(devices[j].LastSeen)
+	})
+	return devices
+}
+
+// Refresh the device info of open connections after a rename
+func (cm *ConnectionManager) UpdateDevice(device PairedDevice) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	device.TokenHash = ""
+	for client := range cm.clients {
+		if current := client.Device(); current != nil && current.ID == device.ID {
+			deviceCopy := device
+			client.device.Store(&deviceCopy)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send a registration request, with the device token if there is one
+func registerRequest(token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/devices/register", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handleDeviceRegister(w, r)
+	return w
+}
+
+func TestHandleDeviceRegister(t *testing.T) {
+	am := useTestAuthManager(t)
+
+	w := registerRequest("", `{"name":" Laptop ","type":"pc"}`)
+	var response struct {
+		Token    string   `json:"token"`
+		DeviceID string   `json:"deviceId"`
+		Name     string   `json:"name"`
+		Type     string   `json:"type"`
+		Groups   []string `json:"groups"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("register: status %d, err %v", w.Code, err)
+	}
+	device, ok := am.Validate(response.Token)
+	if !ok || device.ID != response.DeviceID || device.Name != "Laptop" || device.Type != deviceTypePC {
+		t.Fatalf("registered device = %+v, %v", device, ok)
+	}
+
+	// Registering again with the token renames the device, groups stay the admin's call
+	am.SetGroups(device.ID, []string{"family"})
+	w = registerRequest(response.Token, `{"name":"Work laptop","type":"pc","groups":["kids"]}`)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"token"`) {
+		t.Fatalf("rename: status %d, body %s", w.Code, w.Body)
+	}
+	if device, _ := am.Device(device.ID); device.Name != "Work laptop" || strings.Join(device.Groups, ",") != "family" {
+		t.Errorf("renamed device = %+v", device)
+	}
+	if len(am.Devices()) != 1 {
+		t.Errorf("%d devices after renaming", len(am.Devices()))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"no name", "POST", `{"type":"pc"}`, http.StatusBadRequest},
+		{"name too long", "POST", `{"name":"` + strings.Repeat("x", maxDeviceNameLength+1) + `"}`, http.StatusBadRequest},
+		{"unknown type", "POST", `{"name":"Phone","type":"watch"}`, http.StatusBadRequest},
+		{"invalid JSON", "POST", `{"name":`, http.StatusBadRequest},
+		{"other method", "GET", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleDeviceRegister(w, httptest.NewRequest(tt.method, "/devices/register", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
+
+func TestHandleDevices(t *testing.T) {
+	am := useTestAuthManager(t)
+	laptopToken, laptop, _ := am.Register("Laptop", deviceTypePC)
+	_, phone, _ := am.Register("Phone", deviceTypeMobile)
+	am.SetGroups(phone.ID, []string{"family"})
+
+	r := httptest.NewRequest("GET", "/devices", nil)
+	r.Header.Set("Authorization", "Bearer "+laptopToken)
+	w := httptest.NewRecorder()
+	handleDevices(w, r)
+	var response struct {
+		Devices []DeviceStatus `json:"devices"`
+		Self    string         `json:"self"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, err %v", w.Code, err)
+	}
+	if response.Self != laptop.ID || len(response.Devices) != 2 {
+		t.Fatalf("devices = %+v", response)
+	}
+	for _, device := range response.Devices {
+		if device.Connected || (device.ID == phone.ID) != (strings.Join(device.Groups, ",") == "family") {
+			t.Errorf("device entry = %+v", device)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handleDevices(w, httptest.NewRequest("POST", "/devices", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d", w.Code)
+	}
+}
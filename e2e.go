@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// End-to-end encrypted messages: every device publishes an ECDH P-256 public
+// key, senders encrypt the text for the keys of the recipient devices and the
+// server stores and relays the ciphertext without being able to read it.
+//
+// A message is sealed with a random AES-256-GCM content key. That key is
+// wrapped once per recipient with a key derived (HKDF-SHA256) from ECDH
+// between a fresh ephemeral key of the message and the recipient's key.
+const (
+	e2eKeyAlgorithm     = "ECDH-P256"
+	e2eMessageAlgorithm = "ECIES-P256-HKDF-SHA256-A256GCM"
+)
+
+// Limits for an encrypted message, the ciphertext is base64
+const (
+	maxE2EContentSize = 256 << 10
+	maxE2ERecipients  = 50
+)
+
+// Sizes of the decoded envelope fields
+const (
+	e2eIVSize         = 12
+	e2eWrappedKeySize = 32 + 16
+)
+
+var (
+	errE2ENeedsDevice = errors.New("Encrypted messages need a registered device")
+	errE2EStaleKey    = errors.New("Recipient key changed, fetch /keys again")
+)
+
+// Public key a device receives end-to-end messages with
+type DeviceKey struct {
+	Algorithm string    `json:"algorithm"`
+	Key       string    `json:"key"`   // base64 uncompressed P-256 point
+	KeyID     string    `json:"keyId"` // hex start of the key's SHA-256
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Envelope of an encrypted item. Content holds the base64 ciphertext.
+type E2EPayload struct {
+	Algorithm    string         `json:"algorithm"`
+	EphemeralKey string         `json:"ephemeralKey"` // base64 P-256 point, one per message
+	IV           string         `json:"iv"`           // base64 nonce of the content
+	Recipients   []E2ERecipient `json:"recipients"`
+}
+
+// The content key of a message, sealed for one device
+type E2ERecipient struct {
+	DeviceID   string `json:"deviceId"`
+	KeyID      string `json:"keyId"`
+	IV         string `json:"iv"`
+	WrappedKey string `json:"wrappedKey"`
+}
+
+// Key directory entry, also the data of key_rotated events
+type KeyEntry struct {
+	DeviceID string `json:"deviceId"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	DeviceKey
+	PreviousKeyID string `json:"previousKeyId,omitempty"`
+}
+
+// Check a published public key and work out its ID
+func newDeviceKey(algorithm, key string) (*DeviceKey, error) {
+	if algorithm != e2eKeyAlgorithm {
+		return nil, fmt.Errorf("Key algorithm must be %q", e2eKeyAlgorithm)
+	}
+	raw, err := decodeP256Key(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &DeviceKey{
+		Algorithm: algorithm,
+		Key:       base64.StdEncoding.EncodeToString(raw),
+		KeyID:     hex.EncodeToString(sum[:8]),
+		UpdatedAt: time.Now(),
+	}, nil
+}
+
+func decodeP256Key(key string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("Key must be base64")
+	}
+	if _, err := ecdh.P256().NewPublicKey(raw); err != nil {
+		return nil, fmt.Errorf("Key is not a valid P-256 public key")
+	}
+	return raw, nil
+}
+
+// Check that a base64 field decodes to the expected number of bytes
+func checkBase64Size(field, value string, size int) error {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(raw) != size {
+		return fmt.Errorf("Invalid %s", field)
+	}
+	return nil
+}
+
+// Check an encrypted message against the key directory and work out who it
+// goes to: the given targets, each of which must be able to decrypt it, or
+// else the devices it was encrypted for.
+// Errors wrapping errE2EStaleKey mean the sender used an outdated key.
+func prepareEncryptedMessage(device *PairedDevice, to []string, content string, payload *E2EPayload) ([]string, error) {
+	if device == nil {
+		return nil, errE2ENeedsDevice
+	}
+	if payload.Algorithm != e2eMessageAlgorithm {
+		return nil, fmt.Errorf("Message algorithm must be %q", e2eMessageAlgorithm)
+	}
+	if content == "" || len(content) > maxE2EContentSize {
+		return nil, fmt.Errorf("Encrypted content must be 1 to %d bytes", maxE2EContentSize)
+	}
+	if _, err := base64.StdEncoding.DecodeString(content); err != nil {
+		return nil, fmt.Errorf("Encrypted content must be base64")
+	}
+	if _, err := decodeP256Key(payload.EphemeralKey); err != nil {
+		return nil, fmt.Errorf("Invalid ephemeral key: %v", err)
+	}
+	if err := checkBase64Size("iv", payload.IV, e2eIVSize); err != nil {
+		return nil, err
+	}
+	if len(payload.Recipients) == 0 || len(payload.Recipients) > maxE2ERecipients {
+		return nil, fmt.Errorf("Encrypted messages need 1 to %d recipients", maxE2ERecipients)
+	}
+
+	recipients := make([]string, 0, len(payload.Recipients))
+	for _, recipient := range payload.Recipients {
+		if containsString(recipients, recipient.DeviceID) {
+			return nil, fmt.Errorf("Duplicate recipient %s", recipient.DeviceID)
+		}
+		target, ok := authManager.Device(recipient.DeviceID)
+		if !ok {
+			return nil, fmt.Errorf("Unknown recipient device %s", recipient.DeviceID)
+		}
+		if target.PublicKey == nil || target.PublicKey.KeyID != recipient.KeyID {
+			return nil, fmt.Errorf("%w: %s", errE2EStaleKey, recipient.DeviceID)
+		}
+		if err := checkBase64Size("recipient iv", recipient.IV, e2eIVSize); err != nil {
+			return nil, err
+		}
+		if err := checkBase64Size("wrapped key", recipient.WrappedKey, e2eWrappedKeySize); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient.DeviceID)
+	}
+
+	if len(to) == 0 {
+		return parseTargets(recipients, device)
+	}
+	// Groups count with every device in them
+	for _, deviceID := range itemRecipients(Item{DeviceID: device.ID, To: to}) {
+		if !containsString(recipients, deviceID) {
+			return nil, fmt.Errorf("Target device %s is not a recipient of the message", deviceID)
+		}
+	}
+	return to, nil
+}
+
+// Create and store an encrypted item, checked by prepareEncryptedMessage
+func addEncryptedItem(from string, device *PairedDevice, to []string, content string, payload *E2EPayload) (Item, error) {
+	item := newItem(from, device, to, "encrypted", content)
+	item.E2E = payload
+	if err := itemStore.Add(item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// HTTP status for an error from prepareEncryptedMessage
+func encryptedMessageStatus(err error) int {
+	if errors.Is(err, errE2EStaleKey) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// Get the key directory entry of a device, false if it has no key
+func deviceKeyEntry(device PairedDevice) (KeyEntry, bool) {
+	if device.PublicKey == nil {
+		return KeyEntry{}, false
+	}
+	return KeyEntry{
+		DeviceID:  device.ID,
+		Name:      device.Name,
+		Type:      device.Type,
+		DeviceKey: *device.PublicKey,
+	}, true
+}
+
+// Handle the key directory:
+//
+//	GET    /keys       public keys of all devices that have one
+//	GET    /keys/{id}  public key of one device
+//	PUT    /keys       publish or rotate the key of the calling device ({"algorithm", "key"})
+//	DELETE /keys       withdraw the key of the calling device
+//
+// Changes are announced with key_rotated and key_removed events.
+func handleKeys(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Keys endpoint called - Method: %s, URL: %s\n", r.Method, r.URL.Path)
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/keys"), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		keys := []KeyEntry{}
+		for _, device := range authManager.Devices() {
+			if entry, ok := deviceKeyEntry(device); ok {
+				keys = append(keys, entry)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+
+	case r.Method == "GET":
+		device, ok := authManager.Device(id)
+		if !ok {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		entry, ok := deviceKeyEntry(*device)
+		if !ok {
+			http.Error(w, "Device has no key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+
+	case (r.Method == "PUT" || r.Method == "DELETE") && id == "":
+		device := requestDevice(r)
+		if device == nil {
+			http.Error(w, "Only registered devices can publish a key", http.StatusForbidden)
+			return
+		}
+		if r.Method == "PUT" {
+			publishDeviceKey(w, r, device)
+		} else {
+			withdrawDeviceKey(w, device)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Set the key of the calling device and tell everyone
+func publishDeviceKey(w http.ResponseWriter, r *http.Request, device *PairedDevice) {
+	var keyData struct {
+		Algorithm string `json:"algorithm"`
+		Key       string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&keyData); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	key, err := newDeviceKey(keyData.Algorithm, keyData.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry := KeyEntry{DeviceID: device.ID, Name: device.Name, Type: device.Type, DeviceKey: *key}
+
+	// Publishing the same key again changes nothing
+	if device.PublicKey != nil && device.PublicKey.KeyID == key.KeyID {
+		entry.DeviceKey = *device.PublicKey
+	} else {
+		previous, err := authManager.SetPublicKey(device.ID, key)
+		if err != nil {
+			fmt.Printf("[ERROR] Keys: Error saving key of %s: %v\n", device.ID, err)
+			http.Error(w, "Error saving key", http.StatusInternalServerError)
+			return
+		}
+		if previous != nil {
+			entry.PreviousKeyID = previous.KeyID
+		}
+		fmt.Printf("[INFO] Keys: Device %s published key %s\n", device.ID, key.KeyID)
+		connectionManager.BroadcastEvent("key_rotated", entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "key": entry})
+}
+
+// Remove the key of the calling device, others stop encrypting to it
+func withdrawDeviceKey(w http.ResponseWriter, device *PairedDevice) {
+	if device.PublicKey != nil {
+		if _, err := authManager.SetPublicKey(device.ID, nil); err != nil {
+			fmt.Printf("[ERROR] Keys: Error removing key of %s: %v\n", device.ID, err)
+			http.Error(w, "Error removing key", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("[INFO] Keys: Device %s withdrew its key\n", device.ID)
+		connectionManager.BroadcastEvent("key_removed", map[string]string{"deviceId": device.ID})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "deviceId": device.ID})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Register a device with a fresh key pair in a temporary auth manager
+func registerKeyedDevice(t *testing.T, name string) (*PairedDevice, *ecdh.PrivateKey) {
+	t.Helper()
+	_, device, err := authManager.Register(name, deviceTypeMobile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := newDeviceKey(e2eKeyAlgorithm, base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authManager.SetPublicKey(device.ID, key); err != nil {
+		t.Fatal(err)
+	}
+	device, _ = authManager.Device(device.ID)
+	return device, private
+}
+
+// Encrypt a message the way clients do
+func sealTestMessage(t *testing.T, text string, recipients ...*PairedDevice) (string, *E2EPayload) {
+	t.Helper()
+	b64 := base64.StdEncoding.EncodeToString
+	seal := func(key, plaintext []byte) ([]byte, []byte) {
+		block, _ := aes.NewCipher(key)
+		gcm, _ := cipher.NewGCM(block)
+		iv := make([]byte, e2eIVSize)
+		rand.Read(iv)
+		return iv, gcm.Seal(nil, iv, plaintext, nil)
+	}
+
+	contentKey := make([]byte, 32)
+	rand.Read(contentKey)
+	iv, ciphertext := seal(contentKey, []byte(text))
+
+	ephemeral, _ := ecdh.P256().GenerateKey(rand.Reader)
+	payload := &E2EPayload{
+		Algorithm:    e2eMessageAlgorithm,
+		EphemeralKey: b64(ephemeral.PublicKey().Bytes()),
+		IV:           b64(iv),
+	}
+	for _, device := range recipients {
+		raw, _ := base64.StdEncoding.DecodeString(device.PublicKey.Key)
+		public, _ := ecdh.P256().NewPublicKey(raw)
+		shared, err := ephemeral.ECDH(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapKey, _ := hkdf.Key(sha256.New, shared, ephemeral.PublicKey().Bytes(), "orion e2e "+device.PublicKey.KeyID, 32)
+		wrapIV, wrapped := seal(wrapKey, contentKey)
+		payload.Recipients = append(payload.Recipients, E2ERecipient{
+			DeviceID:   device.ID,
+			KeyID:      device.PublicKey.KeyID,
+			IV:         b64(wrapIV),
+			WrappedKey: b64(wrapped),
+		})
+	}
+	return b64(ciphertext), payload
+}
+
+func TestNewDeviceKey(t *testing.T) {
+	private, _ := ecdh.P256().GenerateKey(rand.Reader)
+	raw := private.PublicKey().Bytes()
+
+	key, err := newDeviceKey(e2eKeyAlgorithm, base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key.KeyID) != 16 {
+		t.Errorf("key ID = %q", key.KeyID)
+	}
+
+	bad := []struct{ algorithm, key string }{
+		{"RSA", base64.StdEncoding.EncodeToString(raw)},
+		{e2eKeyAlgorithm, "not base64!"},
+		{e2eKeyAlgorithm, base64.StdEncoding.EncodeToString(raw[:33])},
+		{e2eKeyAlgorithm, base64.StdEncoding.EncodeToString(make([]byte, 65))},
+	}
+	for _, tt := range bad {
+		if _, err := newDeviceKey(tt.algorithm, tt.key); err == nil {
+			t.Errorf("newDeviceKey(%q, %q) accepted", tt.algorithm, tt.key)
+		}
+	}
+}
+
+func TestPrepareEncryptedMessage(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("memory", 0755)
+	saved := authManager
+	authManager = NewAuthManager()
+	t.Cleanup(func() { authManager = saved })
+
+	sender, _ := registerKeyedDevice(t, "Laptop")
+	phone, _ := registerKeyedDevice(t, "Phone")
+	_, plain, _ := authManager.Register("Tablet", deviceTypeMobile)
+
+	// Without targets the message goes to the devices it was encrypted for
+	content, payload := sealTestMessage(t, "hello", sender, phone)
+	to, err := prepareEncryptedMessage(sender, nil, content, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{sender.ID, phone.ID}; !reflect.DeepEqual(to, want) {
+		t.Errorf("targets = %q, want %q", to, want)
+	}
+
+	// Targets must all be able to decrypt the message, group members included
+	if to, err := prepareEncryptedMessage(sender, []string{phone.ID}, content, payload); err != nil || !reflect.DeepEqual(to, []string{phone.ID}) {
+		t.Errorf("target phone: %q, %v", to, err)
+	}
+	if _, err := prepareEncryptedMessage(sender, []string{phone.ID, plain.ID}, content, payload); err == nil {
+		t.Errorf("target without a recipient entry accepted")
+	}
+	authManager.SetGroups(phone.ID, []string{"family"})
+	if _, err := prepareEncryptedMessage(sender, []string{"group:family"}, content, payload); err != nil {
+		t.Errorf("group of recipients: err = %v", err)
+	}
+	authManager.SetGroups(plain.ID, []string{"family"})
+	if _, err := prepareEncryptedMessage(sender, []string{"group:family"}, content, payload); err == nil {
+		t.Errorf("group with a device that isn't a recipient accepted")
+	}
+
+	if _, err := prepareEncryptedMessage(nil, nil, content, payload); err != errE2ENeedsDevice {
+		t.Errorf("anonymous sender: err = %v", err)
+	}
+
+	// A key rotated since the sender fetched the directory
+	_, rotated := sealTestMessage(t, "hello", phone)
+	registerKeyedDevice(t, "Other")
+	newKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	key, _ := newDeviceKey(e2eKeyAlgorithm, base64.StdEncoding.EncodeToString(newKey.PublicKey().Bytes()))
+	authManager.SetPublicKey(phone.ID, key)
+	if _, err := prepareEncryptedMessage(sender, nil, content, rotated); !errors.Is(err, errE2EStaleKey) {
+		t.Errorf("stale key: err = %v", err)
+	}
+
+	// Devices without a key can't be encrypted to
+	_, payload = sealTestMessage(t, "hello", sender)
+	payload.Recipients = append(payload.Recipients, E2ERecipient{DeviceID: plain.ID, KeyID: "0000000000000000", IV: payload.IV, WrappedKey: payload.Recipients[0].WrappedKey})
+	if _, err := prepareEncryptedMessage(sender, nil, content, payload); !errors.Is(err, errE2EStaleKey) {
+		t.Errorf("recipient without key: err = %v", err)
+	}
+
+	_, payload = sealTestMessage(t, "hello", sender)
+	if _, err := prepareEncryptedMessage(sender, nil, "plain text!", payload); err == nil {
+		t.Errorf("content that isn't base64 accepted")
+	}
+
+	malformed := []func(p *E2EPayload){
+		func(p *E2EPayload) { p.Algorithm = "none" },
+		func(p *E2EPayload) { p.IV = "AAAA" },
+		func(p *E2EPayload) { p.EphemeralKey = "AAAA" },
+		func(p *E2EPayload) { p.Recipients = nil },
+		func(p *E2EPayload) { p.Recipients[0].WrappedKey = "AAAA" },
+		func(p *E2EPayload) { p.Recipients[0].DeviceID = "dev_missing" },
+		func(p *E2EPayload) { p.Recipients = append(p.Recipients, p.Recipients[0]) },
+	}
+	for i, modify := range malformed {
+		content, payload := sealTestMessage(t, "hello", sender)
+		modify(payload)
+		if _, err := prepareEncryptedMessage(sender, nil, content, payload); err == nil || errors.Is(err, errE2EStaleKey) {
+			t.Errorf("malformed message %d: err = %v", i, err)
+		}
+	}
+}
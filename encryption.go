@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Salt, KDF parameters and a key check for encrypted storage. Holds no secret.
+const encryptionFile = "memory/encryption.json"
+
+// Encryption modes for ServerSettings.EncryptionMode
+const (
+	encryptionModeOff        = "off"
+	encryptionModePassphrase = "passphrase"
+	encryptionModeKeyFile    = "keyfile"
+)
+
+// The passphrase is never written to disk, it is read from the environment on every start
+const passphraseEnvVar = "ORION_PASSPHRASE"
+
+const passphraseIterations = 600_000
+
+// Key files are random bytes, at least as many as the key they protect
+const minKeyFileSize = 32
+
+// Encrypted files start with this header: magic, version, chunk size, nonce.
+// The content follows as chunks sealed one by one so a download can seek.
+var encryptedFileMagic = []byte("ORIONENC")
+
+const (
+	encryptedFileVersion = 1
+	encryptedChunkSize   = 64 * 1024
+	encryptedHeaderSize  = 8 + 1 + 4 + 12
+)
+
+// Bound to every sealed journal line so it can't be mistaken for anything else
+var journalRecordAAD = []byte("orion journal")
+
+var encryptionCheckText = []byte("orion storage key")
+
+var (
+	errStorageLocked    = errors.New("storage is encrypted and no key is loaded")
+	errPlaintextJournal = errors.New("plaintext entry in a sealed item store")
+)
+
+// Encryption parameters structure, stored in encryptionFile
+type EncryptionInfo struct {
+	Version    int    `json:"version"`
+	Mode       string `json:"mode"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations,omitempty"`
+	Check      []byte `json:"check"`
+	// JournalSealed: the item store was rewritten sealed since encryption was
+	// turned on, plaintext lines in it were not written by the server
+	JournalSealed bool `json:"journalSealed,omitempty"`
+}
+
+// AES-256-GCM for the item store, uploads and thumbnails, nil when encryption is off
+var storageCipher cipher.AEAD
+
+// HMAC key for naming uploads, see blobNameFor. Nil when encryption is off.
+var blobNameKey []byte
+
+// Set from EncryptionInfo.JournalSealed, plaintext journal lines are only read
+// until the one compaction that seals the whole item store
+var journalSealed bool
+
+// Load the key for the configured encryption mode. Existing plaintext data is
+// encrypted the first time, data that is already encrypted needs the same
+// passphrase or key file it was encrypted with.
+func setupEncryption() error {
+	info, err := loadEncryptionInfo()
+	if err != nil {
+		return err
+	}
+
+	mode := serverSettings.EncryptionMode
+	if mode == "" || mode == encryptionModeOff {
+		if info != nil {
+			return fmt.Errorf("storage is encrypted with a %s, set encryptionMode to %q to open it", info.Mode, info.Mode)
+		}
+		return nil
+	}
+	if info != nil && info.Mode != mode {
+		return fmt.Errorf("storage is encrypted with a %s, not a %s", info.Mode, mode)
+	}
+
+	secret, err := encryptionSecret(mode)
+	if err != nil {
+		return err
+	}
+
+	fresh := info == nil
+	if fresh {
+		info = &EncryptionInfo{Version: 1, Mode: mode, Salt: make([]byte, 16)}
+		if _, err := rand.Read(info.Salt); err != nil {
+			return err
+		}
+		if mode == encryptionModePassphrase {
+			info.Iterations = passphraseIterations
+		}
+	}
+
+	aead, nameKey, err := deriveStorageKeys(info, secret)
+	if err != nil {
+		return err
+	}
+
+	if fresh {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		info.Check = aead.Seal(nonce, nonce, encryptionCheckText, nil)
+		if err := saveEncryptionInfo(info); err != nil {
+			return err
+		}
+	} else if len(info.Check) < aead.NonceSize() {
+		return fmt.Errorf("invalid key check in %s", encryptionFile)
+	} else {
+		nonce, sealed := info.Check[:aead.NonceSize()], info.Check[aead.NonceSize():]
+		if _, err := aead.Open(nil, nonce, sealed, nil); err != nil {
+			return errors.New("wrong passphrase or key file")
+		}
+	}
+
+	storageCipher, blobNameKey, journalSealed = aead, nameKey, info.JournalSealed
+	fmt.Printf("[INFO] Storage encryption enabled (%s)\n", mode)
+	if _, err := os.Stat(dataFile + ".migrated"); err == nil {
+		fmt.Printf("[INFO] %s.migrated still holds old history in plaintext, delete it if you no longer need it\n", dataFile)
+	}
+
+	// Also finishes a first encryption that was interrupted
+	return encryptExistingFiles()
+}
+
+// Read the passphrase or key file for a mode
+func encryptionSecret(mode string) ([]byte, error) {
+	switch mode {
+	case encryptionModePassphrase:
+		passphrase := os.Getenv(passphraseEnvVar)
+		if passphrase == "" {
+			return nil, fmt.Errorf("passphrase encryption needs the %s environment variable", passphraseEnvVar)
+		}
+		return []byte(passphrase), nil
+	case encryptionModeKeyFile:
+		if serverSettings.EncryptionKeyFile == "" {
+			return nil, errors.New("key file encryption needs encryptionKeyFile")
+		}
+		secret, err := os.ReadFile(serverSettings.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		if len(secret) < minKeyFileSize {
+			return nil, fmt.Errorf("key file must hold at least %d bytes", minKeyFileSize)
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unknown encryption mode: %s", mode)
+}
+
+// Turn the secret into the storage key, and the key that names uploads
+func deriveStorageKeys(info *EncryptionInfo, secret []byte) (cipher.AEAD, []byte, error) {
+	var key []byte
+	var err error
+	switch info.Mode {
+	case encryptionModePassphrase:
+		key, err = pbkdf2.Key(sha256.New, string(secret), info.Salt, info.Iterations, 32)
+	case encryptionModeKeyFile:
+		key, err = hkdf.Key(sha256.New, secret, info.Salt, "orion storage", 32)
+	default:
+		err = fmt.Errorf("unknown encryption mode: %s", info.Mode)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, key, nil, "orion blob names", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, nameKey, nil
+}
+
+// Record that the item store was just rewritten sealed, from now on a
+// plaintext line in it means it was tampered with
+func markJournalSealed() error {
+	if storageCipher == nil || journalSealed {
+		return nil
+	}
+	info, err := loadEncryptionInfo()
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("%s is missing", encryptionFile)
+	}
+	info.JournalSealed = true
+	if err := saveEncryptionInfo(info); err != nil {
+		return err
+	}
+	journalSealed = true
+	return nil
+}
+
+// Load the encryption parameters, nil if the storage was never encrypted
+func loadEncryptionInfo() (*EncryptionInfo, error) {
+	fileData, err := os.ReadFile(encryptionFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", encryptionFile, err)
+	}
+	var info EncryptionInfo
+	if err := json.Unmarshal(fileData, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", encryptionFile, err)
+	}
+	return &info, nil
+}
+
+func saveEncryptionInfo(info *EncryptionInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(encryptionFile), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(encryptionFile, data, 0600)
+}
+
+// Seal a journal line, lines stay as they are when encryption is off
+func encodeJournalLine(line []byte) ([]byte, error) {
+	if storageCipher == nil {
+		return line, nil
+	}
+	nonce := make([]byte, storageCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := storageCipher.Seal(nonce, nonce, line, journalRecordAAD)
+	return base64.StdEncoding.AppendEncode(nil, sealed), nil
+}
+
+// Open a journal line. Plaintext JSON lines from before encryption was turned
+// on are accepted until the compaction at the next start rewrites them sealed.
+func decodeJournalLine(line []byte) ([]byte, error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		if storageCipher != nil && journalSealed {
+			return nil, errPlaintextJournal
+		}
+		return line, nil
+	}
+	if storageCipher == nil {
+		return nil, errStorageLocked
+	}
+	sealed, err := base64.StdEncoding.AppendDecode(nil, line)
+	if err != nil {
+		return nil, err
+	}
+	size := storageCipher.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("sealed entry too short")
+	}
+	return storageCipher.Open(nil, sealed[:size], sealed[size:], journalRecordAAD)
+}
+
+// Create a file for stored content, encrypted when encryption is on. Close
+// must be called to write the last chunk.
+func createStoredFile(path string) (io.WriteCloser, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if storageCipher == nil {
+		return file, nil
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedFileMagic)
+	header[8] = encryptedFileVersion
+	binary.BigEndian.PutUint32(header[9:13], encryptedChunkSize)
+	if _, err := rand.Read(header[13:]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptedWriter{file: file, aead: storageCipher, nonce: header[13:]}, nil
+}
+
+// Writes the chunked format, keeping back the last chunk until Close so it
+// can be marked final and a truncated file is detected
+type encryptedWriter struct {
+	file  *os.File
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	index uint64
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > encryptedChunkSize {
+		if err := w.writeChunk(w.buf[:encryptedChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[encryptedChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *encryptedWriter) Close() error {
+	err := w.writeChunk(w.buf, true)
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *encryptedWriter) writeChunk(chunk []byte, final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.nonce, w.index), chunk, chunkAAD(w.index, final))
+	w.index++
+	_, err := w.file.Write(sealed)
+	return err
+}
+
+// Each chunk has its own nonce: the file's nonce with the chunk index mixed in
+func chunkNonce(base []byte, index uint64) []byte {
+	nonce := bytes.Clone(base)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ index
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// The index stops chunks from being reordered, the final flag from being dropped
+func chunkAAD(index uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, index)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// A stored upload or thumbnail opened for reading, decrypted on the fly
+// when it is encrypted
+type StoredFile struct {
+	file    *os.File
+	size    int64 // size of the content
+	modTime time.Time
+
+	// Encrypted files only
+	aead       cipher.AEAD
+	nonce      []byte
+	chunkSize  int64
+	chunks     int64
+	offset     int64
+	chunk      []byte
+	chunkIndex int64
+}
+
+// Open stored content, plaintext files from before encryption was turned on included
+func openStoredFile(path string) (*StoredFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	stored := &StoredFile{file: file, size: info.Size(), modTime: info.ModTime(), chunkIndex: -1}
+
+	// Without a key nothing was encrypted, setupEncryption refuses to start otherwise
+	if storageCipher == nil {
+		return stored, nil
+	}
+	header := make([]byte, encryptedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if n < encryptedHeaderSize || !bytes.HasPrefix(header, encryptedFileMagic) {
+		return stored, nil
+	}
+	if header[8] != encryptedFileVersion {
+		file.Close()
+		return nil, fmt.Errorf("unsupported encrypted file version %d", header[8])
+	}
+
+	stored.aead = storageCipher
+	stored.nonce = header[13:]
+	stored.chunkSize = int64(binary.BigEndian.Uint32(header[9:13]))
+	sealedChunk := stored.chunkSize + int64(storageCipher.Overhead())
+	body := info.Size() - encryptedHeaderSize
+	stored.chunks = max(1, (body+sealedChunk-1)/sealedChunk)
+	stored.size = body - stored.chunks*int64(storageCipher.Overhead())
+	if stored.chunkSize <= 0 || stored.size < 0 {
+		file.Close()
+		return nil, fmt.Errorf("corrupt encrypted file %s", path)
+	}
+	return stored, nil
+}
+
+// Size of the content, after decryption
+func (f *StoredFile) Size() int64 {
+	return f.size
+}
+
+func (f *StoredFile) ModTime() time.Time {
+	return f.modTime
+}
+
+func (f *StoredFile) Read(p []byte) (int, error) {
+	if f.aead == nil {
+		return f.file.Read(p)
+	}
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	index := f.offset / f.chunkSize
+	if index != f.chunkIndex {
+		if err := f.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.chunk[f.offset-index*f.chunkSize:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Read and authenticate one chunk
+func (f *StoredFile) loadChunk(index int64) error {
+	sealedChunk := f.chunkSize + int64(f.aead.Overhead())
+	start := encryptedHeaderSize + index*sealedChunk
+	sealed := make([]byte, sealedChunk)
+	n, err := f.file.ReadAt(sealed, start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	chunk, err := f.aead.Open(f.chunk[:0], chunkNonce(f.nonce, uint64(index)), sealed[:n], chunkAAD(uint64(index), index == f.chunks-1))
+	if err != nil {
+		return fmt.Errorf("encrypted file chunk %d failed authentication", index)
+	}
+	f.chunk = chunk
+	f.chunkIndex = index
+	return nil
+}
+
+func (f *StoredFile) Seek(offset int64, whence int) (int64, error) {
+	if f.aead == nil {
+		return f.file.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *StoredFile) Close() error {
+	return f.file.Close()
+}
+
+// Check if a file was encrypted with the current key. The first chunk must
+// decrypt, so an upload that merely starts with the magic is still encrypted.
+func isEncryptedFile(path string) bool {
+	file, err := openStoredFile(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return file.aead != nil && file.loadChunk(0) == nil
+}
+
+// Move a received file into storage, encrypting it on the way when
+// encryption is on. src and dst may be the same file.
+func storeFile(src, dst string) error {
+	if storageCipher == nil || isEncryptedFile(src) {
+		if src == dst {
+			return nil
+		}
+		return os.Rename(src, dst)
+	}
+
+	tmpPath := dst + ".tmp"
+	if err := encryptFile(src, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if src != dst {
+		os.Remove(src)
+	}
+	return nil
+}
+
+func encryptFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createStoredFile(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Encrypt the uploads, thumbnails and unfinished uploads still stored in plaintext
+func encryptExistingFiles() error {
+	encrypted := 0
+	for _, dir := range []string{uploadsDir, thumbsDir, partialUploadsDir} {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// Files still being written are encrypted when they are stored,
+			// the chunks of unfinished uploads wait for the client to resume
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, ".part") != (dir == partialUploadsDir) {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if isEncryptedFile(path) {
+				continue
+			}
+			if err := storeFile(path, path); err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", path, err)
+			}
+			encrypted++
+		}
+	}
+	if encrypted > 0 {
+		fmt.Printf("[INFO] Encrypted %d stored files\n", encrypted)
+	}
+	return nil
+}
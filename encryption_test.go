@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Encrypt storage with a fixed key for the rest of the test
+func useTestStorageKey(t *testing.T) {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageCipher, blobNameKey = aead, bytes.Repeat([]byte{8}, 32)
+	t.Cleanup(func() { storageCipher, blobNameKey, journalSealed = nil, nil, false })
+}
+
+func writeStoredFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	out, err := createStoredFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uneven writes so chunks don't line up with them
+	for len(content) > 0 {
+		n := min(len(content), 1000)
+		if _, err := out.Write(content[:n]); err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoredFileRoundTrip(t *testing.T) {
+	useTestStorageKey(t)
+	dir := t.TempDir()
+
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 3*encryptedChunkSize + 5} {
+		content := make([]byte, size)
+		for i := range content {
+			content[i] = byte(i * 31)
+		}
+		path := filepath.Join(dir, "blob")
+		writeStoredFile(t, path, content)
+
+		if raw, _ := os.ReadFile(path); size >= 64 && bytes.Contains(raw, content[:64]) {
+			t.Errorf("size %d: content stored in plaintext", size)
+		}
+
+		file, err := openStoredFile(path)
+		if err != nil {
+			t.Fatalf("size %d: open: %v", size, err)
+		}
+		if file.Size() != int64(size) {
+			t.Errorf("size %d: Size() = %d", size, file.Size())
+		}
+		got, err := io.ReadAll(file)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("size %d: read back %d bytes, err %v", size, len(got), err)
+		}
+
+		// Ranges across chunk boundaries, like ServeContent asks for
+		if size > 10 {
+			if _, err := file.Seek(-10, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			tail := make([]byte, 10)
+			if _, err := io.ReadFull(file, tail); err != nil || !bytes.Equal(tail, content[size-10:]) {
+				t.Errorf("size %d: tail = %v, err %v", size, tail, err)
+			}
+			middle := int64(size / 2)
+			file.Seek(middle, io.SeekStart)
+			part := make([]byte, min(size-int(middle), encryptedChunkSize+3))
+			if _, err := io.ReadFull(file, part); err != nil || !bytes.Equal(part, content[middle:middle+int64(len(part))]) {
+				t.Errorf("size %d: read at %d failed: %v", size, middle, err)
+			}
+		}
+		file.Close()
+	}
+}
+
+func TestStoredFileTampering(t *testing.T) {
+	useTestStorageKey(t)
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("secret "), encryptedChunkSize/3)
+
+	path := filepath.Join(dir, "tampered")
+	writeStoredFile(t, path, content)
+	raw, _ := os.ReadFile(path)
+	raw[encryptedHeaderSize+5] ^= 1
+	os.WriteFile(path, raw, 0600)
+	if file, err := openStoredFile(path); err == nil {
+		if _, err := io.ReadAll(file); err == nil {
+			t.Errorf("modified file read without error")
+		}
+		file.Close()
+	}
+
+	// Dropping the last chunk must not look like a shorter file
+	path = filepath.Join(dir, "truncated")
+	writeStoredFile(t, path, content)
+	raw, _ = os.ReadFile(path)
+	os.WriteFile(path, raw[:encryptedHeaderSize+encryptedChunkSize+storageCipher.Overhead()], 0600)
+	if file, err := openStoredFile(path); err == nil {
+		if _, err := io.ReadAll(file); err == nil {
+			t.Errorf("truncated file read without error")
+		}
+		file.Close()
+	}
+
+	// An upload that happens to start with the magic is not taken for encrypted
+	path = filepath.Join(dir, "lookalike")
+	os.WriteFile(path, append(bytes.Clone(encryptedFileMagic), bytes.Repeat([]byte{1}, 100)...), 0600)
+	if isEncryptedFile(path) {
+		t.Errorf("plaintext starting with the magic detected as encrypted")
+	}
+}
+
+func TestJournalStoreEncryption(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// Start with a plaintext store, then turn encryption on
+	store, err := NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Item{ID: "item_1", Timestamp: time.Now(), Type: "text", Content: "first secret"})
+	store.Close()
+
+	useTestStorageKey(t)
+	store, err = NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Item{ID: "item_2", Timestamp: time.Now(), Type: "text", Content: "second secret"})
+	store.Close()
+
+	raw, _ := os.ReadFile(itemsLogFile)
+	if strings.Contains(string(raw), "secret") {
+		t.Errorf("item store still holds plaintext: %q", raw)
+	}
+
+	store, err = NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := store.List(); len(items) != 2 || items[0].Content != "first secret" {
+		t.Errorf("reopened store items = %+v", items)
+	}
+	store.Close()
+
+	// Without the key the store must not open, and must not be emptied
+	raw, _ = os.ReadFile(itemsLogFile)
+	storageCipher = nil
+	if _, err := NewJournalStore(itemsLogFile); err == nil {
+		t.Errorf("encrypted store opened without a key")
+	}
+	if after, _ := os.ReadFile(itemsLogFile); !bytes.Equal(after, raw) {
+		t.Errorf("encrypted store changed by a failed open")
+	}
+}
+
+func TestSealedJournal(t *testing.T) {
+	t.Chdir(t.TempDir())
+	useTestStorageKey(t)
+	store, err := NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(Item{ID: "item_1", Timestamp: time.Now(), Type: "text", Content: "sealed"})
+	store.Close()
+
+	// Once the store was sealed, a plaintext line can only have been planted
+	journalSealed = true
+	planted := `{"op":"put","item":{"id":"item_2","type":"text","content":"planted"}}` + "\n"
+	for _, position := range []string{"last", "middle"} {
+		raw, _ := os.ReadFile(itemsLogFile)
+		tampered := append(bytes.Clone(raw), planted...)
+		if position == "middle" {
+			tampered = append([]byte(planted), raw...)
+		}
+		os.WriteFile(itemsLogFile, tampered, 0600)
+		if _, err := NewJournalStore(itemsLogFile); err == nil {
+			t.Errorf("%s: store with a plaintext line opened", position)
+		}
+		if after, _ := os.ReadFile(itemsLogFile); !bytes.Equal(after, tampered) {
+			t.Errorf("%s: store changed by a failed open", position)
+		}
+		os.WriteFile(itemsLogFile, raw, 0600)
+	}
+}
+
+func TestSetupEncryption(t *testing.T) {
+	t.Chdir(t.TempDir())
+	saved := serverSettings
+	t.Cleanup(func() {
+		serverSettings = saved
+		storageCipher, blobNameKey, journalSealed = nil, nil, false
+	})
+
+	os.MkdirAll(uploadsDir, 0755)
+	os.WriteFile(filepath.Join(uploadsDir, "old.txt"), []byte("plain upload"), 0644)
+	os.MkdirAll(partialUploadsDir, 0755)
+	os.WriteFile(filepath.Join(partialUploadsDir, "abc.0.part"), []byte("plain chunk"), 0644)
+	os.WriteFile("key1", bytes.Repeat([]byte{1}, 32), 0600)
+	os.WriteFile("key2", bytes.Repeat([]byte{2}, 32), 0600)
+
+	serverSettings.EncryptionMode = encryptionModeKeyFile
+	serverSettings.EncryptionKeyFile = "key1"
+	if err := setupEncryption(); err != nil {
+		t.Fatalf("first setup: %v", err)
+	}
+	if !isEncryptedFile(filepath.Join(uploadsDir, "old.txt")) || !isEncryptedFile(filepath.Join(partialUploadsDir, "abc.0.part")) {
+		t.Errorf("existing upload not encrypted")
+	}
+
+	storageCipher = nil
+	serverSettings.EncryptionKeyFile = "key2"
+	if err := setupEncryption(); err == nil {
+		t.Errorf("setup accepted the wrong key file")
+	}
+
+	serverSettings.EncryptionMode = encryptionModeOff
+	if err := setupEncryption(); err == nil {
+		t.Errorf("setup without a key accepted encrypted storage")
+	}
+
+	serverSettings.EncryptionMode = encryptionModeKeyFile
+	serverSettings.EncryptionKeyFile = "key1"
+	if err := setupEncryption(); err != nil {
+		t.Fatalf("setup with the right key: %v", err)
+	}
+	file, err := openStoredFile(filepath.Join(uploadsDir, "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); string(got) != "plain upload" {
+		t.Errorf("decrypted upload = %q", got)
+	}
+	// Opening the item store seals it for good
+	if journalSealed {
+		t.Errorf("journal sealed before the item store was compacted")
+	}
+	savedStore := itemStore
+	t.Cleanup(func() { itemStore = savedStore })
+	if err := openItemStore(); err != nil {
+		t.Fatal(err)
+	}
+	itemStore.Close()
+	if info, err := loadEncryptionInfo(); err != nil || !info.JournalSealed || !journalSealed {
+		t.Errorf("journal not marked sealed: %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Version of the sync messages below, bumped on incompatible changes
+const syncProtocolVersion = 1
+
+// Number of recent events kept for clients that reconnect. Replays must fit
+// in a client's send queue next to live traffic.
+const syncEventBacklog = clientSendQueueSize / 2
+
+// Sync event types
+const (
+	eventItemAdded   = "item_added"
+	eventItemUpdated = "item_updated"
+	eventItemDeleted = "item_deleted"
+	eventCleared     = "cleared"
+)
+
+// A change to the item history. Sequence numbers increase by one per event
+// and restart with a new epoch whenever the server restarts.
+type SyncEvent struct {
+	Type    string      `json:"type"`
+	Version int         `json:"v"`
+	Epoch   string      `json:"epoch"`
+	Seq     uint64      `json:"seq"`
+	Data    interface{} `json:"data"`
+
+	// Devices allowed to see the event, nil for everyone
+	visible func(*PairedDevice) bool
+}
+
+// Check if a connection may receive the event
+func (e SyncEvent) visibleTo(client *Client) bool {
+	return e.visible == nil || e.visible(client.Device())
+}
+
+// In-memory log of the most recent sync events
+type EventLog struct {
+	epoch  string
+	seq    uint64
+	events []SyncEvent
+	mutex  sync.Mutex
+}
+
+func NewEventLog() *EventLog {
+	epoch, err := randomHex(8)
+	if err != nil {
+		epoch = strconv.FormatInt(uniqueNanos(), 36)
+	}
+	return &EventLog{epoch: epoch}
+}
+
+var eventLog = NewEventLog()
+
+// Record an event and send it to every connection allowed to see it. The lock
+// is held while broadcasting so clients always receive events in sequence
+// order. Connections that may not see an event just observe a gap in seq.
+func (l *EventLog) Publish(eventType string, data interface{}, visible func(*PairedDevice) bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.seq++
+	event := SyncEvent{
+		Type:    eventType,
+		Version: syncProtocolVersion,
+		Epoch:   l.epoch,
+		Seq:     l.seq,
+		Data:    data,
+		visible: visible,
+	}
+
+	l.events = append(l.events, event)
+	if len(l.events) > syncEventBacklog {
+		l.events = append([]SyncEvent(nil), l.events[len(l.events)-syncEventBacklog:]...)
+	}
+
+	connectionManager.broadcast(event, event.visibleTo)
+}
+
+// Events after seq, or false if the client is from another epoch or too far behind
+func (l *EventLog) since(epoch string, seq uint64) ([]SyncEvent, bool) {
+	if epoch != l.epoch || seq > l.seq {
+		return nil, false
+	}
+	if seq == l.seq {
+		return nil, true
+	}
+	if len(l.events) == 0 || l.events[0].Seq > seq+1 {
+		return nil, false
+	}
+	return l.events[seq+1-l.events[0].Seq:], true
+}
+
+// Register a new connection and bring it up to date. Clients that pass
+// ?epoch=...&since=<seq> only receive the events they missed, everyone else
+// gets the newest page of the history. The log stays locked until the catch-up messages
+// are queued, so no live event can overtake them.
+func (l *EventLog) SyncConnection(client *Client, r *http.Request, register func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	register()
+
+	query := r.URL.Query()
+	if sinceValue := query.Get("since"); sinceValue != "" {
+		since, err := strconv.ParseUint(sinceValue, 10, 64)
+		if err == nil {
+			if events, ok := l.since(query.Get("epoch"), since); ok {
+				replayed := 0
+				for _, event := range events {
+					if event.visibleTo(client) {
+						client.Send(event)
+						replayed++
+					}
+				}
+				fmt.Printf("[DEBUG] Sync: Replayed %d events after seq %d\n", replayed, since)
+				client.Send(l.message("synced", map[string]int{"replayed": replayed}))
+				return
+			}
+		}
+		fmt.Printf("[DEBUG] Sync: Can't replay from seq %s, sending full history\n", sinceValue)
+	}
+
+	// Only the newest page, older items are fetched from /pc/items or /mobile/items on demand
+	page, _ := queryItems(client.Device(), ItemQuery{Limit: defaultItemPageSize})
+	client.Send(l.message("initial", page))
+}
+
+// A message carrying the current position, which doesn't advance the sequence
+func (l *EventLog) message(messageType string, data interface{}) SyncEvent {
+	return SyncEvent{
+		Type:    messageType,
+		Version: syncProtocolVersion,
+		Epoch:   l.epoch,
+		Seq:     l.seq,
+		Data:    data,
+	}
+}
+
+func publishItemAdded(item Item) {
+	searchIndex.Add(item)
+	eventLog.Publish(eventItemAdded, item, itemAudience(item))
+	if len(item.To) > 0 {
+		routeTargetedItem(item)
+	}
+}
+
+func publishItemUpdated(item Item) {
+	searchIndex.Add(item)
+	eventLog.Publish(eventItemUpdated, item, itemAudience(item))
+}
+
+func publishItemDeleted(item Item) {
+	searchIndex.Remove(item.ID)
+	deliveryQueue.RemoveItems(item.ID)
+	eventLog.Publish(eventItemDeleted, map[string]string{"id": item.ID}, itemAudience(item))
+}
+
+func publishCleared() {
+	searchIndex.Clear()
+	deliveryQueue.Clear()
+	eventLog.Publish(eventCleared, nil, nil)
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestEventLogSince(t *testing.T) {
+	log := NewEventLog()
+	total := uint64(syncEventBacklog + 10)
+	for i := uint64(0); i < total; i++ {
+		log.Publish(eventItemAdded, i, nil)
+	}
+	oldest := total - syncEventBacklog + 1 // first seq still in the backlog
+
+	tests := []struct {
+		name  string
+		epoch string
+		seq   uint64
+		ok    bool
+		first uint64 // seq of the first replayed event, 0 for none
+		count int
+	}{
+		{"up to date", log.epoch, total, true, 0, 0},
+		{"one behind", log.epoch, total - 1, true, total, 1},
+		{"oldest kept", log.epoch, oldest - 1, true, oldest, syncEventBacklog},
+		{"inside the backlog", log.epoch, oldest + 5, true, oldest + 6, syncEventBacklog - 6},
+		{"too far behind", log.epoch, oldest - 2, false, 0, 0},
+		{"from the start", log.epoch, 0, false, 0, 0},
+		{"ahead of the server", log.epoch, total + 1, false, 0, 0},
+		{"other epoch", "restarted", total, false, 0, 0},
+		{"no epoch", "", total - 1, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, ok := log.since(tt.epoch, tt.seq)
+			if ok != tt.ok || len(events) != tt.count {
+				t.Fatalf("since(%q, %d) = %d events, %v; want %d, %v", tt.epoch, tt.seq, len(events), ok, tt.count, tt.ok)
+			}
+			for i, event := range events {
+				if event.Seq != tt.first+uint64(i) || event.Data != tt.first+uint64(i)-1 {
+					t.Fatalf("event %d has seq %d, data %v", i, event.Seq, event.Data)
+				}
+			}
+		})
+	}
+
+	// A fresh log has nothing to replay but is up to date at 0
+	fresh := NewEventLog()
+	if events, ok := fresh.since(fresh.epoch, 0); !ok || len(events) != 0 {
+		t.Errorf("fresh log: %d events, %v", len(events), ok)
+	}
+	if fresh.epoch == log.epoch {
+		t.Errorf("two logs share epoch %q", log.epoch)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest stored display name in bytes, leaving room for the item_<nanos>_ prefix
+const maxFilenameLength = 200
+
+var errUnsafePath = errors.New("path escapes the base directory")
+
+// Names Windows refuses to create regardless of extension
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Turn a client supplied filename into a single safe path component.
+// Directory parts, control characters and characters that are invalid on
+// Windows are dropped.
+func sanitizeFilename(name string) string {
+	// Keep only the last path element, whichever separator the client used
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+
+	if name == "" {
+		return "file"
+	}
+
+	base := name
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	if reservedWindowsNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+
+	return truncateFilename(name, maxFilenameLength)
+}
+
+// Shorten a filename to at most max bytes, keeping the extension and valid UTF-8
+func truncateFilename(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > max/4 {
+		ext = ""
+	}
+	stem := name[:max-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// Join a single untrusted path component onto a base directory.
+// Anything that isn't a plain file name inside base is rejected.
+func safeJoin(base, name string) (string, error) {
+	if strings.Trim(name, ".") == "" || strings.ContainsAny(name, "/\\\x00") {
+		return "", errUnsafePath
+	}
+	// Drive letters and NTFS alternate data streams
+	if runtime.GOOS == "windows" && strings.Contains(name, ":") {
+		return "", errUnsafePath
+	}
+	if filepath.VolumeName(name) != "" || filepath.IsAbs(name) {
+		return "", errUnsafePath
+	}
+
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	joined := filepath.Join(absBase, name)
+	rel, err := filepath.Rel(absBase, joined)
+	if err != nil || rel != name {
+		return "", errUnsafePath
+	}
+
+	return filepath.Join(base, name), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "photo.jpg", "photo.jpg"},
+		{"unicode", "résumé 2024.pdf", "résumé 2024.pdf"},
+		{"unix traversal", "../../etc/passwd", "passwd"},
+		{"windows traversal", `..\..\Windows\win.ini`, "win.ini"},
+		{"absolute unix", "/etc/shadow", "shadow"},
+		{"absolute windows", `C:\Users\me\notes.txt`, "notes.txt"},
+		{"drive relative", "C:notes.txt", "C_notes.txt"},
+		{"trailing separator", "folder/", "file"},
+		{"only dots", "..", "file"},
+		{"many dots", "...", "file"},
+		{"empty", "", "file"},
+		{"spaces", "   ", "file"},
+		{"leading and trailing dots", ".hidden.", "hidden"},
+		{"pipe separator", "a|b.txt", "a_b.txt"},
+		{"windows invalid", `what?<is>"this"*.txt`, "what__is__this__.txt"},
+		{"alternate data stream", "file.txt:evil", "file.txt_evil"},
+		{"control characters", "bad\r\nname\t.txt", "badname.txt"},
+		{"nul byte", "evil.txt\x00.jpg", "evil.txt.jpg"},
+		{"escape sequence", "\x1b[31mred.txt", "[31mred.txt"},
+		{"invalid utf8", "bad\xffname.txt", "badname.txt"},
+		{"reserved name", "CON", "_CON"},
+		{"reserved name with extension", "nul.txt", "_nul.txt"},
+		{"reserved lookalike", "CONSOLE.txt", "CONSOLE.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.in)
+			if got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if _, err := safeJoin("uploads", got); err != nil {
+				t.Errorf("safeJoin rejected sanitized name %q: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLength(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		ext  string
+	}{
+		{"ascii", strings.Repeat("a", 500) + ".txt", ".txt"},
+		{"multibyte", strings.Repeat("日本", 200) + ".png", ".png"},
+		{"long extension", "a." + strings.Repeat("x", 300), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.in)
+			if len(got) > maxFilenameLength {
+				t.Errorf("length %d exceeds %d", len(got), maxFilenameLength)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("result is not valid UTF-8: %q", got)
+			}
+			if tt.ext != "" && !strings.HasSuffix(got, tt.ext) {
+				t.Errorf("extension %q lost: %q", tt.ext, got)
+			}
+		})
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	base := filepath.Join("memory", "uploads")
+
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{"plain", "item_1_photo.jpg", false},
+		{"dots inside name", "a..b.txt", false},
+		{"empty", "", true},
+		{"dot", ".", true},
+		{"dot dot", "..", true},
+		{"traversal", "../settings.json", true},
+		{"nested traversal", "x/../../auth.json", true},
+		{"subdirectory", "partial/abc.part", true},
+		{"backslash traversal", `..\..\win.ini`, true},
+		{"backslash", `a\b`, true},
+		{"absolute", "/etc/passwd", true},
+		{"nul byte", "x\x00.txt", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin(base, tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("safeJoin(%q) = %q, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeJoin(%q) unexpected error: %v", tt.in, err)
+			}
+			if want := filepath.Join(base, tt.in); got != want {
+				t.Errorf("safeJoin(%q) = %q, want %q", tt.in, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// End-to-end encrypted messages, the format is described in e2e.go on the server.
+// Every device has an ECDH P-256 key pair. A message is sealed with a random
+// AES-256-GCM key, which is wrapped for each recipient with a key derived
+// (HKDF-SHA256) from ECDH between a per-message ephemeral key and theirs.
+const E2E_KEY_ALGORITHM = 'ECDH-P256';
+const E2E_MESSAGE_ALGORITHM = 'ECIES-P256-HKDF-SHA256-A256GCM';
+
+function bytesToBase64(bytes) {
+    let binary = '';
+    for (const byte of new Uint8Array(bytes)) {
+        binary += String.fromCharCode(byte);
+    }
+    return btoa(binary);
+}
+
+function base64ToBytes(value) {
+    return Uint8Array.from(atob(value), c => c.charCodeAt(0));
+}
+
+// Key ID the server reports for a public key: hex start of its SHA-256
+async function e2eKeyId(rawPublicKey) {
+    const digest = new Uint8Array(await crypto.subtle.digest('SHA-256', rawPublicKey));
+    return Array.from(digest.slice(0, 8), byte => byte.toString(16).padStart(2, '0')).join('');
+}
+
+// Create a key pair, the private key is kept as a JWK in extension storage
+async function e2eGenerateKeyPair() {
+    const pair = await crypto.subtle.generateKey({ name: 'ECDH', namedCurve: 'P-256' }, true, ['deriveBits']);
+    const raw = await crypto.subtle.exportKey('raw', pair.publicKey);
+    return {
+        keyId: await e2eKeyId(raw),
+        publicKey: bytesToBase64(raw),
+        privateJwk: await crypto.subtle.exportKey('jwk', pair.privateKey)
+    };
+}
+
+// Key that wraps the content key for one recipient
+async function e2eWrappingKey(privateKey, publicKeyRaw, ephemeralRaw, keyId) {
+    const publicKey = await crypto.subtle.importKey('raw', publicKeyRaw, { name: 'ECDH', namedCurve: 'P-256' }, false, []);
+    const shared = await crypto.subtle.deriveBits({ name: 'ECDH', public: publicKey }, privateKey, 256);
+    const hkdfKey = await crypto.subtle.importKey('raw', shared, 'HKDF', false, ['deriveKey']);
+    return crypto.subtle.deriveKey(
+        { name: 'HKDF', hash: 'SHA-256', salt: ephemeralRaw, info: new TextEncoder().encode('orion e2e ' + keyId) },
+        hkdfKey,
+        { name: 'AES-GCM', length: 256 },
+        false,
+        ['encrypt', 'decrypt']
+    );
+}
+
+// Encrypt text for entries of the key directory, returns the message fields
+// the server expects: { text: ciphertext, e2e: envelope }
+async function e2eEncrypt(text, keys) {
+    const contentKey = crypto.getRandomValues(new Uint8Array(32));
+    const iv = crypto.getRandomValues(new Uint8Array(12));
+    const aesKey = await crypto.subtle.importKey('raw', contentKey, 'AES-GCM', false, ['encrypt']);
+    const ciphertext = await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, aesKey, new TextEncoder().encode(text));
+
+    const ephemeral = await crypto.subtle.generateKey({ name: 'ECDH', namedCurve: 'P-256' }, false, ['deriveBits']);
+    const ephemeralRaw = new Uint8Array(await crypto.subtle.exportKey('raw', ephemeral.publicKey));
+
+    const recipients = [];
+    for (const entry of keys) {
+        const wrappingKey = await e2eWrappingKey(ephemeral.privateKey, base64ToBytes(entry.key), ephemeralRaw, entry.keyId);
+        const wrapIv = crypto.getRandomValues(new Uint8Array(12));
+        const wrapped = await crypto.subtle.encrypt({ name: 'AES-GCM', iv: wrapIv }, wrappingKey, contentKey);
+        recipients.push({
+            deviceId: entry.deviceId,
+            keyId: entry.keyId,
+            iv: bytesToBase64(wrapIv),
+            wrappedKey: bytesToBase64(wrapped)
+        });
+    }
+
+    return {
+        text: bytesToBase64(ciphertext),
+        e2e: {
+            algorithm: E2E_MESSAGE_ALGORITHM,
+            ephemeralKey: bytesToBase64(ephemeralRaw),
+            iv: bytesToBase64(iv),
+            recipients
+        }
+    };
+}
+
+// Decrypt an "encrypted" item with this device's key, null if it wasn't
+// encrypted for that key or doesn't authenticate
+async function e2eDecrypt(item, deviceId, keyPair) {
+    const envelope = item.e2e;
+    if (!envelope || envelope.algorithm !== E2E_MESSAGE_ALGORITHM || !keyPair) {
+        return null;
+    }
+    const recipient = envelope.recipients.find(r => r.deviceId === deviceId && r.keyId === keyPair.keyId);
+    if (!recipient) {
+        return null;
+    }
+
+    try {
+        const privateKey = await crypto.subtle.importKey('jwk', keyPair.privateJwk, { name: 'ECDH', namedCurve: 'P-256' }, false, ['deriveBits']);
+        const ephemeralRaw = base64ToBytes(envelope.ephemeralKey);
+        const wrappingKey = await e2eWrappingKey(privateKey, ephemeralRaw, ephemeralRaw, recipient.keyId);
+        const contentKey = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: base64ToBytes(recipient.iv) }, wrappingKey, base64ToBytes(recipient.wrappedKey));
+        const aesKey = await crypto.subtle.importKey('raw', contentKey, 'AES-GCM', false, ['decrypt']);
+        const plaintext = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: base64ToBytes(envelope.iv) }, aesKey, base64ToBytes(item.content));
+        return new TextDecoder().decode(plaintext);
+    } catch (error) {
+        console.error('E2E: Could not decrypt item', item.id, error);
+        return null;
+    }
+}
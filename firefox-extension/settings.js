@@ -10,13 +10,23 @@ if (!extApi) {
 const DEFAULT_SETTINGS = {
     serverHost: '192.168.2.101',
     serverPort: 8000,
-    resizableSidebar: true
+    useHttps: false,
+    deviceName: 'My PC',
+    pairingPin: '',
+    resizableSidebar: true,
+    e2eEncryption: false,
+    clipboardSync: false
 };
 
 document.addEventListener('DOMContentLoaded', () => {
     const serverHost = document.getElementById('serverHost');
     const serverPort = document.getElementById('serverPort');
+    const useHttps = document.getElementById('useHttps');
+    const deviceName = document.getElementById('deviceName');
+    const pairingPin = document.getElementById('pairingPin');
     const resizableSidebar = document.getElementById('resizableSidebar');
+    const e2eEncryption = document.getElementById('e2eEncryption');
+    const clipboardSync = document.getElementById('clipboardSync');
     const status = document.getElementById('status');
 
     // Load settings
@@ -24,7 +34,12 @@ document.addEventListener('DOMContentLoaded', () => {
         const s = res && res.orionSettings ? res.orionSettings : DEFAULT_SETTINGS;
         serverHost.value = s.serverHost;
         serverPort.value = s.serverPort;
+        useHttps.checked = !!s.useHttps;
+        deviceName.value = s.deviceName || DEFAULT_SETTINGS.deviceName;
+        pairingPin.value = s.pairingPin || '';
         resizableSidebar.checked = !!s.resizableSidebar;
+        e2eEncryption.checked = !!s.e2eEncryption;
+        clipboardSync.checked = !!s.clipboardSync;
     });
 
     // Show status message with animation
@@ -56,7 +71,12 @@ document.addEventListener('DOMContentLoaded', () => {
         const newSettings = {
             serverHost: hostValue,
             serverPort: portValue,
-            resizableSidebar: resizableSidebar.checked
+            useHttps: useHttps.checked,
+            deviceName: deviceName.value.trim() || DEFAULT_SETTINGS.deviceName,
+            pairingPin: pairingPin.value.trim(),
+            resizableSidebar: resizableSidebar.checked,
+            e2eEncryption: e2eEncryption.checked,
+            clipboardSync: clipboardSync.checked
         };
 
         extApi.storage.local.set({ orionSettings: newSettings }, () => {
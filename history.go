@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for the item history
+const (
+	defaultItemPageSize = 50
+	maxItemPageSize     = 200
+)
+
+var errInvalidCursor = fmt.Errorf("Invalid cursor")
+
+// Filters and cursor for a page of the item history:
+//
+//	?limit=50                 newest 50 items
+//	&before=item_123          items older than item_123, for the next page, also after item_123 was deleted
+//	&type=text,file           only these item types
+//	&from=phone,dev_ab12      only items sent by these endpoints ("PC", "phone") or devices
+//	&since=...&until=...      only items sent in this range (RFC 3339 or unix milliseconds)
+type ItemQuery struct {
+	Before string
+	Limit  int
+	Types  []string
+	From   []string
+	Since  time.Time
+	Until  time.Time
+}
+
+// One page of the item history, oldest first. NextBefore is the cursor for
+// the page before this one and is only set while HasMore is true.
+type ItemPage struct {
+	Items      []Item `json:"items"`
+	HasMore    bool   `json:"hasMore"`
+	NextBefore string `json:"nextBefore,omitempty"`
+}
+
+// Read the cursor and filters from a query string
+func parseItemQuery(values url.Values) (ItemQuery, error) {
+	query := ItemQuery{
+		Before: values.Get("before"),
+		Limit:  defaultItemPageSize,
+		Types:  splitList(values.Get("type")),
+		From:   splitList(values.Get("from")),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return ItemQuery{}, fmt.Errorf("Invalid limit")
+		}
+		query.Limit = min(n, maxItemPageSize)
+	}
+
+	var err error
+	if query.Since, err = parseQueryTime(values.Get("since")); err != nil {
+		return ItemQuery{}, fmt.Errorf("Invalid since time")
+	}
+	if query.Until, err = parseQueryTime(values.Get("until")); err != nil {
+		return ItemQuery{}, fmt.Errorf("Invalid until time")
+	}
+	return query, nil
+}
+
+// Split a comma-separated filter value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Parse an RFC 3339 time or unix milliseconds, the zero time if empty
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Check if an item passes the filters, ignoring the cursor
+func (q ItemQuery) matches(item Item) bool {
+	if len(q.Types) > 0 && !containsString(q.Types, item.Type) {
+		return false
+	}
+	if len(q.From) > 0 && !containsString(q.From, item.From) &&
+		(item.DeviceID == "" || !containsString(q.From, item.DeviceID)) {
+		return false
+	}
+	if !q.Since.IsZero() && item.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && item.Timestamp.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Position of an item in the history: IDs are item_<nanos>, and the
+// nanoseconds grow with every item added
+func itemOrder(id string) (int64, bool) {
+	digits, ok := strings.CutPrefix(id, "item_")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	return n, err == nil
+}
+
+// Number of items before the cursor. Cursors are positions, not items: the
+// item may have been deleted since, by a retention sweep, a delete or a newer
+// clipboard, and paging goes on from where it was.
+func cursorIndex(items []Item, before string) (int, error) {
+	for i, item := range items {
+		if item.ID == before {
+			return i, nil
+		}
+	}
+
+	position, ok := itemOrder(before)
+	if !ok {
+		return 0, errInvalidCursor
+	}
+	end := 0
+	for i, item := range items {
+		if order, ok := itemOrder(item.ID); ok && order < position {
+			end = i + 1
+		}
+	}
+	return end, nil
+}
+
+// Get a page of the items a device may see, walking back from the cursor
+func queryItems(device *PairedDevice, query ItemQuery) (ItemPage, error) {
+	items := itemStore.List()
+
+	end := len(items)
+	if query.Before != "" {
+		var err error
+		if end, err = cursorIndex(items, query.Before); err != nil {
+			return ItemPage{}, err
+		}
+	}
+
+	// Collect newest first, then flip into the usual oldest-first order
+	page := ItemPage{Items: []Item{}}
+	for i := end - 1; i >= 0; i-- {
+		item := items[i]
+		if !itemVisibleTo(item, device) || !query.matches(item) {
+			continue
+		}
+		if len(page.Items) == query.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Items = append(page.Items, item)
+	}
+	for i, j := 0, len(page.Items)-1; i < j; i, j = i+1, j-1 {
+		page.Items[i], page.Items[j] = page.Items[j], page.Items[i]
+	}
+	if page.HasMore {
+		page.NextBefore = page.Items[0].ID
+	}
+	return page, nil
+}
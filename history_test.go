@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// IDs of a page, oldest first
+func pageIDs(page ItemPage) string {
+	ids := make([]string, len(page.Items))
+	for i, item := range page.Items {
+		ids[i] = strings.TrimPrefix(item.ID, "item_")
+	}
+	return strings.Join(ids, ",")
+}
+
+// Fill the store with items item_1 ... item_n, one minute apart
+func addHistoryItems(t *testing.T, n int, edit func(i int, item *Item)) time.Time {
+	t.Helper()
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		item := Item{ID: fmt.Sprintf("item_%d", i), Timestamp: start.Add(time.Duration(i) * time.Minute), From: "PC", Type: "text", Content: "text"}
+		if edit != nil {
+			edit(i, &item)
+		}
+		if err := itemStore.Add(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return start
+}
+
+func TestParseItemQuery(t *testing.T) {
+	query, err := parseItemQuery(url.Values{
+		"before": {"item_9"}, "limit": {"1000"}, "type": {"text, file,"}, "from": {"phone,dev_ab12"},
+		"since": {"1740830400000"}, "until": {"2025-03-02T00:00:00Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Before != "item_9" || query.Limit != maxItemPageSize || strings.Join(query.Types, "|") != "text|file" ||
+		len(query.From) != 2 || !query.Since.Equal(time.UnixMilli(1740830400000)) || query.Until.Day() != 2 {
+		t.Errorf("query = %+v", query)
+	}
+	if query, _ := parseItemQuery(url.Values{}); query.Limit != defaultItemPageSize {
+		t.Errorf("default limit = %d", query.Limit)
+	}
+
+	for _, values := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"ten"}},
+		{"since": {"yesterday"}},
+		{"until": {"2025-03-02"}},
+	} {
+		if _, err := parseItemQuery(values); err == nil {
+			t.Errorf("parseItemQuery(%v) accepted", values)
+		}
+	}
+}
+
+func TestQueryItemsCursor(t *testing.T) {
+	useTestItemStore(t)
+	addHistoryItems(t, 7, nil)
+
+	page, _ := queryItems(nil, ItemQuery{Limit: 3})
+	if pageIDs(page) != "5,6,7" || !page.HasMore || page.NextBefore != "item_5" {
+		t.Fatalf("newest page = %s, more %v, next %s", pageIDs(page), page.HasMore, page.NextBefore)
+	}
+
+	// The cursor item and the one before it go away while paging
+	itemStore.Delete("item_5")
+	itemStore.Delete("item_4")
+	page, err := queryItems(nil, ItemQuery{Limit: 3, Before: page.NextBefore})
+	if err != nil || pageIDs(page) != "1,2,3" || page.HasMore || page.NextBefore != "" {
+		t.Fatalf("page after a deleted cursor = %s, more %v, err %v", pageIDs(page), page.HasMore, err)
+	}
+
+	// A cursor from before every item is an empty last page
+	if page, err := queryItems(nil, ItemQuery{Limit: 3, Before: "item_0"}); err != nil || len(page.Items) != 0 || page.HasMore {
+		t.Errorf("cursor before the history = %s, err %v", pageIDs(page), err)
+	}
+	// A cursor newer than every item pages from the newest
+	if page, _ := queryItems(nil, ItemQuery{Limit: 2, Before: "item_100"}); pageIDs(page) != "6,7" {
+		t.Errorf("cursor after the history = %s", pageIDs(page))
+	}
+	for _, cursor := range []string{"7", "item_", "item_x", "clip_5"} {
+		if _, err := queryItems(nil, ItemQuery{Limit: 3, Before: cursor}); err != errInvalidCursor {
+			t.Errorf("cursor %q: err = %v", cursor, err)
+		}
+	}
+}
+
+func TestQueryItemsFilters(t *testing.T) {
+	useTestItemStore(t)
+	start := addHistoryItems(t, 8, func(i int, item *Item) {
+		if i%2 == 0 {
+			item.From, item.Type = "phone", "file"
+		}
+		if i == 3 {
+			item.DeviceID = "dev_laptop"
+		}
+	})
+
+	tests := []struct {
+		name  string
+		query ItemQuery
+		want  string
+	}{
+		{"all", ItemQuery{}, "1,2,3,4,5,6,7,8"},
+		{"type", ItemQuery{Types: []string{"file"}}, "2,4,6,8"},
+		{"types", ItemQuery{Types: []string{"file", "text"}}, "1,2,3,4,5,6,7,8"},
+		{"sender", ItemQuery{From: []string{"PC"}}, "1,3,5,7"},
+		{"device", ItemQuery{From: []string{"dev_laptop"}}, "3"},
+		{"since", ItemQuery{Since: start.Add(6 * time.Minute)}, "6,7,8"},
+		{"until", ItemQuery{Until: start.Add(2 * time.Minute)}, "1,2"},
+		{"range and type", ItemQuery{Types: []string{"text"}, Since: start.Add(2 * time.Minute), Until: start.Add(6 * time.Minute)}, "3,5"},
+		{"nothing", ItemQuery{Types: []string{"link"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.Limit = maxItemPageSize
+			page, err := queryItems(nil, tt.query)
+			if err != nil || pageIDs(page) != tt.want {
+				t.Errorf("items = %s, err %v; want %s", pageIDs(page), err, tt.want)
+			}
+		})
+	}
+
+	// Filtered pages are full pages, the cursor skips what doesn't match
+	page, _ := queryItems(nil, ItemQuery{Limit: 2, Types: []string{"text"}})
+	page, _ = queryItems(nil, ItemQuery{Limit: 2, Types: []string{"text"}, Before: page.NextBefore})
+	if pageIDs(page) != "1,3" || page.HasMore {
+		t.Errorf("second filtered page = %s, more %v", pageIDs(page), page.HasMore)
+	}
+}
+
+func TestQueryItemsVisibility(t *testing.T) {
+	useTestItemStore(t)
+	laptop := &PairedDevice{ID: "dev_laptop", Type: deviceTypePC, Groups: []string{"desk"}}
+	phone := &PairedDevice{ID: "dev_phone", Type: deviceTypeMobile}
+	tablet := &PairedDevice{ID: "dev_tablet", Type: deviceTypeMobile}
+	addHistoryItems(t, 5, func(i int, item *Item) {
+		switch i {
+		case 2:
+			item.DeviceID, item.To = laptop.ID, []string{phone.ID}
+		case 4:
+			item.DeviceID, item.To = phone.ID, []string{"group:desk"}
+		}
+	})
+
+	tests := []struct {
+		device *PairedDevice
+		want   string
+	}{
+		{nil, "1,3,5"},
+		{laptop, "1,2,3,4,5"},
+		{phone, "1,2,3,4,5"},
+		{tablet, "1,3,5"},
+	}
+	for _, tt := range tests {
+		page, _ := queryItems(tt.device, ItemQuery{Limit: maxItemPageSize})
+		if pageIDs(page) != tt.want {
+			t.Errorf("%+v sees %s, want %s", tt.device, pageIDs(page), tt.want)
+		}
+	}
+
+	// Hidden items don't count towards the page size or leak through the cursor
+	page, _ := queryItems(tablet, ItemQuery{Limit: 2})
+	if pageIDs(page) != "3,5" || !page.HasMore || page.NextBefore != "item_3" {
+		t.Errorf("tablet page = %s, more %v, next %s", pageIDs(page), page.HasMore, page.NextBefore)
+	}
+}
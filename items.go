@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Messages and edits are limited to the size of a WebSocket command
+var errMessageTooLarge = fmt.Errorf("Message is larger than %d KB", maxCommandSize>>10)
+
+var errMessageEmpty = errors.New("Message text is required")
+
+// Check the text of a message, the same for HTTP and WebSocket senders
+func validateMessageText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errMessageEmpty
+	}
+	return nil
+}
+
+// Handle single item endpoint (/items/{id})
+func handleItem(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Item endpoint called - Method: %s, URL: %s\n", r.Method, r.URL.Path)
+
+	id := strings.TrimPrefix(r.URL.Path, "/items/")
+	if id == "" || strings.Contains(id, "/") {
+		fmt.Printf("[ERROR] Item: Invalid item ID: '%s'\n", id)
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+
+	// Items addressed to other devices don't exist as far as this one is concerned
+	if item, ok := itemStore.Get(id); ok && !itemVisibleTo(item, requestDevice(r)) {
+		fmt.Printf("[ERROR] Item: Item %s is not visible to this device\n", id)
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "DELETE":
+		handleDeleteItem(w, r, id)
+	case "PATCH":
+		handleEditItem(w, r, id)
+	default:
+		fmt.Printf("[ERROR] Item: Method not allowed: %s\n", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Delete a single item and its stored file
+func handleDeleteItem(w http.ResponseWriter, r *http.Request, id string) {
+	item, err := deleteItem(id)
+	if err == errItemNotFound {
+		fmt.Printf("[ERROR] Delete item: Item not found: %s\n", id)
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Delete item: Error deleting item %s: %v\n", id, err)
+		http.Error(w, "Error deleting item", http.StatusInternalServerError)
+		return
+	}
+
+	publishItemDeleted(item)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "id": id})
+	fmt.Printf("[DEBUG] Delete item: Response sent successfully\n")
+}
+
+// Remove an item from the store together with its uploaded file
+func deleteItem(id string) (Item, error) {
+	item, err := itemStore.Delete(id)
+	if err != nil {
+		return Item{}, err
+	}
+
+	fmt.Printf("[DEBUG] Delete item: Removed item %s\n", id)
+
+	if item.File != nil {
+		if _, err := removeUploadedFile(item); err != nil {
+			// The item is already gone, a leftover file is not worth failing the request
+			fmt.Printf("[ERROR] Delete item: Failed to delete file for item %s: %v\n", id, err)
+		}
+	}
+	return item, nil
+}
+
+// Build a new item sent from an endpoint ("PC" or "phone") by an optional registered
+// device, addressed to everyone or to the targets checked by parseTargets
+func newItem(from string, device *PairedDevice, to []string, itemType, content string) Item {
+	item := Item{
+		ID:        generateID(),
+		Timestamp: time.Now(),
+		From:      from,
+		Type:      itemType,
+		Content:   content,
+		To:        to,
+		Schema:    itemSchemaVersion,
+	}
+	// A text that is a single URL becomes a link, see startUnfurl
+	if itemType == "text" {
+		if item.Link = newLinkPayload(content); item.Link != nil {
+			item.Type = "link"
+		}
+	}
+	if device != nil {
+		item.DeviceID = device.ID
+		item.DeviceName = device.Name
+	}
+	return item
+}
+
+// Create and store a new text or link item
+func addTextItem(from string, device *PairedDevice, to []string, text string) (Item, error) {
+	item := newItem(from, device, to, "text", text)
+	if err := itemStore.Add(item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// Replace the text of a single text item
+func handleEditItem(w http.ResponseWriter, r *http.Request, id string) {
+	var editData struct {
+		Text string `json:"text"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCommandSize)
+	if err := json.NewDecoder(r.Body).Decode(&editData); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, errMessageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Printf("[ERROR] Edit item: Invalid JSON: %v\n", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	item, ok := itemStore.Get(id)
+	if !ok {
+		fmt.Printf("[ERROR] Edit item: Item not found: %s\n", id)
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	}
+
+	if item.Type != "text" && item.Type != "link" {
+		fmt.Printf("[ERROR] Edit item: Item %s has type %s, only text can be edited\n", id, item.Type)
+		http.Error(w, "Only text items can be edited", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	link := newLinkPayload(editData.Text)
+	// Editing text into a link or back changes the type, the same link keeps its preview
+	if item.Link == nil || link == nil || item.Link.URL != link.URL {
+		item.Link = link
+	}
+	item.Type = "text"
+	if item.Link != nil {
+		item.Type = "link"
+	}
+	item.Content = editData.Text
+	item.EditedAt = &now
+
+	if err := itemStore.Update(item); err == errItemNotFound {
+		// Deleted between Get and Update
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Printf("[ERROR] Edit item: Error saving item %s: %v\n", id, err)
+		http.Error(w, "Error saving item", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[DEBUG] Edit item: Updated item %s\n", id)
+
+	publishItemUpdated(item)
+	startUnfurl(item)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "item": item})
+	fmt.Printf("[DEBUG] Edit item: Response sent successfully\n")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Send a request to the /items/{id} endpoint
+func itemRequest(method, id, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleItem(w, httptest.NewRequest(method, "/items/"+id, strings.NewReader(body)))
+	return w
+}
+
+func TestHandleEditItem(t *testing.T) {
+	useTestItemStore(t)
+	disableLinkPreviews(t)
+	itemStore.Add(Item{ID: "item_1", Type: "text", Content: "draft"})
+	itemStore.Add(Item{ID: "item_2", Type: "file", Content: "notes.txt", File: &FilePayload{Name: "notes.txt"}})
+
+	w := itemRequest("PATCH", "item_1", `{"text":"final"}`)
+	var response struct {
+		Status string `json:"status"`
+		Item   Item   `json:"item"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("edit: status %d, err %v", w.Code, err)
+	}
+	stored, _ := itemStore.Get("item_1")
+	if response.Item.Content != "final" || stored.Content != "final" || stored.EditedAt == nil {
+		t.Errorf("edited item = %+v, stored %+v", response.Item, stored)
+	}
+
+	// Editing a text into a single URL turns it into a link
+	itemRequest("PATCH", "item_1", `{"text":"https://example.com/a"}`)
+	if stored, _ := itemStore.Get("item_1"); stored.Type != "link" || stored.Link == nil {
+		t.Errorf("text edited into a URL stored as %+v", stored)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		id     string
+		body   string
+		status int
+	}{
+		{"file item", "PATCH", "item_2", `{"text":"renamed"}`, http.StatusBadRequest},
+		{"invalid JSON", "PATCH", "item_1", `{"text":`, http.StatusBadRequest},
+		{"too large", "PATCH", "item_1", `{"text":"` + strings.Repeat("x", maxCommandSize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"unknown item", "PATCH", "item_9", `{"text":"x"}`, http.StatusNotFound},
+		{"no ID", "PATCH", "", `{"text":"x"}`, http.StatusBadRequest},
+		{"nested path", "PATCH", "item_1/file", `{"text":"x"}`, http.StatusBadRequest},
+		{"other method", "GET", "item_1", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := itemRequest(tt.method, tt.id, tt.body); w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+	if stored, _ := itemStore.Get("item_2"); stored.Content != "notes.txt" {
+		t.Errorf("file item changed by a refused edit: %+v", stored)
+	}
+}
+
+func TestHandleDeleteItem(t *testing.T) {
+	useTestItemStore(t)
+	itemStore.Add(Item{ID: "item_1", Type: "text", Content: "one"})
+	itemStore.Add(Item{ID: "item_2", Type: "text", Content: "two"})
+
+	if w := itemRequest("DELETE", "item_1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":"item_1"`) {
+		t.Fatalf("delete: status %d, body %s", w.Code, w.Body)
+	}
+	if items := itemStore.List(); len(items) != 1 || items[0].ID != "item_2" {
+		t.Errorf("items after delete = %+v", items)
+	}
+	if w := itemRequest("DELETE", "item_1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d", w.Code)
+	}
+}
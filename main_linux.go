@@ -5,9 +5,8 @@ package main
 import (
 	_ "embed" // For embedding files
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -17,8 +16,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 var (
@@ -73,6 +70,33 @@ func startServer() {
 		os.Exit(1)
 	}
 
+	// Load paired devices and show the pairing PIN
+	if err := authManager.Load(); err != nil {
+		fmt.Printf("[ERROR] Failed to load paired devices: %v\n", err)
+		os.Exit(1)
+	}
+	authManager.CurrentPIN()
+
+	// Load targeted items still waiting for offline devices
+	if err := deliveryQueue.Load(); err != nil {
+		fmt.Printf("[ERROR] Failed to load delivery queue: %v\n", err)
+	}
+
+	// Load the storage key before anything encrypted is read
+	if err := setupEncryption(); err != nil {
+		fmt.Printf("[ERROR] Failed to set up storage encryption: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Open the item store (migrates data.json on first start)
+	if err := openItemStore(); err != nil {
+		fmt.Printf("[ERROR] Failed to open item store: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Start deleting items that fall outside the retention window
+	startRetentionSweeper()
+
 	http.HandleFunc("/", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
@@ -81,7 +105,10 @@ func startServer() {
 	}))
 
 	// Serve uploaded files
-	http.HandleFunc("/uploads/", corsMiddleware(handleFileDownload))
+	http.HandleFunc("/uploads/", corsMiddleware(requireDevice(handleFileDownload)))
+
+	// Serve image thumbnails by item ID
+	http.HandleFunc("/thumbs/", corsMiddleware(requireDevice(handleThumbnail)))
 
 	// Mobile web interface
 	http.HandleFunc("/mobile/", corsMiddleware(handleMobileWeb))
@@ -90,39 +117,101 @@ func startServer() {
 	http.HandleFunc("/imgs/", corsMiddleware(handleMobileAssets))
 
 	// WebSocket endpoints
-	http.HandleFunc("/pc/ws", corsMiddleware(handlePCWebSocket))
-	http.HandleFunc("/mobile/ws", corsMiddleware(handleMobileWebSocket))
+	http.HandleFunc("/pc/ws", corsMiddleware(requireDevice(handlePCWebSocket)))
+	http.HandleFunc("/mobile/ws", corsMiddleware(requireDevice(handleMobileWebSocket)))
 
 	// PC endpoints
-	http.HandleFunc("/pc/items", corsMiddleware(handlePCItems))
-	http.HandleFunc("/pc/message", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/pc/items", corsMiddleware(requireDevice(handlePCItems)))
+	http.HandleFunc("/pc/message", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
 		handleMessage(w, r, "PC")
-	}))
-	http.HandleFunc("/pc/file", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	})))
+	http.HandleFunc("/pc/clipboard", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleClipboard(w, r, "PC")
+	})))
+	http.HandleFunc("/pc/now-playing", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleNowPlaying(w, r, "PC")
+	})))
+	http.HandleFunc("/pc/file", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
 		handleFile(w, r, "PC")
-	}))
-	http.HandleFunc("/pc/youtube-info", corsMiddleware(handleYouTubeInfo))
+	})))
+	http.HandleFunc("/pc/uploads", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleResumableUpload(w, r, "PC")
+	})))
+	http.HandleFunc("/pc/uploads/", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleResumableUpload(w, r, "PC")
+	})))
 
 	// Mobile endpoints
-	http.HandleFunc("/mobile/items", corsMiddleware(handleMobileItems))
-	http.HandleFunc("/mobile/message", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/mobile/items", corsMiddleware(requireDevice(handleMobileItems)))
+
+	// Single item endpoints (DELETE, PATCH)
+	http.HandleFunc("/items/", corsMiddleware(requireDevice(handleItem)))
+
+	// Full-text search over message text and file names
+	http.HandleFunc("/search", corsMiddleware(requireDevice(handleSearch)))
+
+	// Public keys for end-to-end encrypted messages
+	http.HandleFunc("/keys", corsMiddleware(requireDevice(handleKeys)))
+	http.HandleFunc("/keys/", corsMiddleware(requireDevice(handleKeys)))
+	http.HandleFunc("/mobile/message", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
 		handleMessage(w, r, "phone")
-	}))
-	http.HandleFunc("/mobile/file", corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	})))
+	http.HandleFunc("/mobile/clipboard", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleClipboard(w, r, "phone")
+	})))
+	http.HandleFunc("/mobile/now-playing", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleNowPlaying(w, r, "phone")
+	})))
+	http.HandleFunc("/mobile/file", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
 		handleFile(w, r, "phone")
-	}))
+	})))
+	http.HandleFunc("/mobile/uploads", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleResumableUpload(w, r, "phone")
+	})))
+	http.HandleFunc("/mobile/uploads/", corsMiddleware(requireDevice(func(w http.ResponseWriter, r *http.Request) {
+		handleResumableUpload(w, r, "phone")
+	})))
 
 	// Server settings endpoints
-	http.HandleFunc("/settings", corsMiddleware(handleServerSettings))
+	http.HandleFunc("/settings", corsMiddleware(requireAdmin(handleServerSettings)))
 	http.HandleFunc("/settings/", corsMiddleware(handleServerSettingsPage))
 	http.HandleFunc("/status", corsMiddleware(handleServerStatus))
-	http.HandleFunc("/clear-history", corsMiddleware(handleClearHistory))
+	http.HandleFunc("/clear-history", corsMiddleware(requireAdmin(handleClearHistory)))
 	http.HandleFunc("/favicon.ico", corsMiddleware(handleFavicon))
 
-	fmt.Printf("[INFO] Server starting on http://%s:%s\n", serverHost, serverPort)
+	// Pairing endpoints
+	http.HandleFunc("/pair", corsMiddleware(handlePair))
+	http.HandleFunc("/pairing", corsMiddleware(requireAdmin(handlePairingPIN)))
+	http.HandleFunc("/tokens", corsMiddleware(requireAdmin(handleTokens)))
+	http.HandleFunc("/tokens/", corsMiddleware(requireAdmin(handleTokens)))
+
+	// Device registry
+	http.HandleFunc("/devices", corsMiddleware(requireDevice(handleDevices)))
+	http.HandleFunc("/devices/register", corsMiddleware(requireDevice(handleDeviceRegister)))
+
+	server := &http.Server{Addr: serverHost + ":" + serverPort}
+
+	// Load or generate the TLS certificate when HTTPS is enabled
+	if tlsEnabled() {
+		tlsConfig, err := loadTLSConfig(serverHost)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to set up TLS: %v\n", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	fmt.Printf("[INFO] Server starting on %s://%s:%s\n", serverScheme(), serverHost, serverPort)
+	fmt.Printf("[INFO] Settings: %s\n", settingsURL())
 
 	// Start the server
-	if err := http.ListenAndServe(serverHost+":"+serverPort, nil); err != nil {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		fmt.Printf("[ERROR] Server failed to start on %s:%s: %v\n", serverHost, serverPort, err)
 		fmt.Printf("[INFO] Try closing other applications using port %s and restart\n", serverPort)
 	}
@@ -145,24 +234,39 @@ func getLocalIP() string {
 
 // Get current server host (from settings or auto-detect)
 func getCurrentServerHost() string {
-	if serverSettings.ServerHost != "" {
-		return serverSettings.ServerHost
+	if host := currentSettings().ServerHost; host != "" {
+		return host
 	}
 	return getLocalIP()
 }
 
-// CORS middleware function
+// CORS middleware function: only the server's own pages and the browser
+// extensions may call the API from a browser, see allowedOrigin
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers for all requests (always enabled)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
-		w.Header().Set("Access-Control-Allow-Credentials", "false")
+		if !allowedOrigin(r) {
+			// Pages on other sites get no CORS headers, so they can't read
+			// responses, and can't change anything
+			if r.Method != "GET" && r.Method != "HEAD" {
+				fmt.Printf("[ERROR] CORS: Rejected %s %s from origin %s\n", r.Method, r.URL.Path, r.Header.Get("Origin"))
+				http.Error(w, "Forbidden origin", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Upload-Offset, Upload-Length")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length")
+		}
+		w.Header().Add("Vary", "Origin")
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -178,17 +282,22 @@ type Item struct {
 	From      string    `json:"from"`
 	Type      string    `json:"type"`
 	Content   string    `json:"content"`
-}
-
-// YouTube video info structure
-type YouTubeVideoInfo struct {
-	VideoID       string `json:"videoId"`
-	Title         string `json:"title"`
-	CurrentTime   int    `json:"currentTime"`
-	Duration      int    `json:"duration"`
-	TimestampLink string `json:"timestampLink"`
-	IsPlaying     bool   `json:"isPlaying"`
-	URL           string `json:"url"`
+	// EditedAt: set when a text item was changed after it was sent
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	// DeviceID and DeviceName: registered device that sent the item, empty for anonymous senders
+	DeviceID   string `json:"deviceId,omitempty"`
+	DeviceName string `json:"deviceName,omitempty"`
+	// To: device IDs and "group:<name>" targets, empty when the item is for everyone
+	To []string `json:"to,omitempty"`
+	// Schema: layout version of the item, see itemSchemaVersion
+	Schema int `json:"schema,omitempty"`
+	// File and Link: typed payloads of file items and of text items that are a link
+	File *FilePayload `json:"file,omitempty"`
+	Link *LinkPayload `json:"link,omitempty"`
+	// E2E: envelope of an "encrypted" item, whose Content is ciphertext the server can't read
+	E2E *E2EPayload `json:"e2e,omitempty"`
+	// Clipboard: set on "clipboard" items, whose Content is the copied text
+	Clipboard *ClipboardPayload `json:"clipboard,omitempty"`
 }
 
 // Server settings structure
@@ -197,6 +306,20 @@ type ServerSettings struct {
 	ServerPort string `json:"serverPort"`
 	// DataRetention: number of days to keep files; 0 means never delete
 	DataRetention int `json:"dataRetention"`
+	// RequirePairing: clients need a token from /pair, or the admin secret for the settings page
+	RequirePairing bool `json:"requirePairing"`
+	// TLSMode: "off", "self-signed" (generated under memory/) or "custom" (TLSCertFile/TLSKeyFile)
+	TLSMode     string `json:"tlsMode"`
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// MaxUploadSizeMB: largest accepted upload in megabytes; 0 means no limit
+	MaxUploadSizeMB int `json:"maxUploadSizeMB"`
+	// EncryptionMode: "off", "passphrase" (from ORION_PASSPHRASE) or "keyfile" (EncryptionKeyFile);
+	// encrypts the item store, uploads and thumbnails, applied on the next start
+	EncryptionMode    string `json:"encryptionMode"`
+	EncryptionKeyFile string `json:"encryptionKeyFile"`
+	// LinkPreviews: fetch title, description and icon of links sent as messages
+	LinkPreviews bool `json:"linkPreviews"`
 }
 
 // Server status structure
@@ -205,6 +328,14 @@ type ServerStatus struct {
 	Uptime      string `json:"uptime"`
 	Version     string `json:"version"`
 	Connections int    `json:"connections"`
+	// Retention: stats of the last retention sweep, nil until it has run
+	Retention *RetentionStats `json:"retention"`
+	// Storage: uploaded files on disk and the space saved by storing duplicates once
+	Storage StorageStats `json:"storage"`
+	// TLS: listener mode and certificate fingerprint for verification on the phone
+	TLS TLSStatus `json:"tls"`
+	// Devices: connected devices with their last activity, only shown to authorized clients
+	Devices []DeviceStatus `json:"devices,omitempty"`
 }
 
 // Flow data structure
@@ -219,20 +350,35 @@ const settingsFile = "memory/settings.json"
 var (
 	serverSettings  = getDefaultSettings()
 	serverStartTime = time.Now()
+	// settingsMutex guards serverSettings once the server is running
+	settingsMutex sync.RWMutex
 )
 
+// Get a copy of the current server settings, safe to call from any goroutine
+func currentSettings() ServerSettings {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return serverSettings
+}
+
 // Get default server settings
 func getDefaultSettings() ServerSettings {
 	return ServerSettings{
-		ServerHost:    "",
-		ServerPort:    "8000",
-		DataRetention: 30, // 0 means never delete
+		ServerHost:      "",
+		ServerPort:      "8000",
+		DataRetention:   30, // 0 means never delete
+		RequirePairing:  true,
+		TLSMode:         tlsModeOff,
+		MaxUploadSizeMB: 4096,
+		EncryptionMode:  encryptionModeOff,
+		LinkPreviews:    true,
 	}
 }
 
 // Load server settings from file
 func loadSettings() ServerSettings {
-	var settings ServerSettings
+	// Start from defaults so fields missing from older files keep their default
+	settings := getDefaultSettings()
 
 	if _, err := os.Stat(settingsFile); os.IsNotExist(err) {
 		fmt.Printf("[DEBUG] Settings file doesn't exist, using defaults\n")
@@ -269,52 +415,12 @@ func saveSettings(settings ServerSettings) error {
 	return os.WriteFile(settingsFile, jsonData, 0644)
 }
 
-// Load data from file
-func loadData() FlowData {
-	var data FlowData
-
-	if _, err := os.Stat(dataFile); os.IsNotExist(err) {
-		fmt.Printf("[DEBUG] Data file doesn't exist, creating directory and returning empty data\n")
-		// Create directory if it doesn't exist
-		os.MkdirAll("memory", 0755)
-		return data
-	}
-
-	fmt.Printf("[DEBUG] Loading data from file: %s\n", dataFile)
-	fileData, err := os.ReadFile(dataFile)
-	if err != nil {
-		fmt.Printf("[ERROR] Error reading file: %v\n", err)
-		return data
-	}
-
-	fmt.Printf("[DEBUG] File read successfully, size: %d bytes\n", len(fileData))
-
-	err = json.Unmarshal(fileData, &data)
-	if err != nil {
-		fmt.Printf("[ERROR] Error parsing JSON: %v\n", err)
-		return data
-	}
-
-	fmt.Printf("[DEBUG] Data loaded successfully, items count: %d\n", len(data.Items))
-	return data
-}
-
-// Save data to file
-func saveFlowData(data FlowData) error {
-	jsonData, err := json.MarshalIndent(data, "", "    ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(dataFile, jsonData, 0644)
-}
-
 // Generate unique ID
 func generateID() string {
-	return fmt.Sprintf("item_%d", time.Now().UnixNano())
+	return fmt.Sprintf("item_%d", uniqueNanos())
 }
 
-// Handle PC items endpoint
+// Handle PC items endpoint: GET returns a page of the history, see ItemQuery
 func handlePCItems(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[DEBUG] PC items endpoint called - Method: %s\n", r.Method)
 
@@ -324,15 +430,25 @@ func handlePCItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := loadData()
-	fmt.Printf("[DEBUG] PC items: Loaded %d items from data file\n", len(data.Items))
+	query, err := parseItemQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := queryItems(requestDevice(r), query)
+	if err != nil {
+		fmt.Printf("[ERROR] PC items: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("[DEBUG] PC items: Loaded %d items from store (more: %t)\n", len(page.Items), page.HasMore)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	json.NewEncoder(w).Encode(page)
 	fmt.Printf("[DEBUG] PC items: Response sent successfully\n")
 }
 
-// Handle mobile items endpoint
+// Handle mobile items endpoint: GET returns a page of the history, see ItemQuery
 func handleMobileItems(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[DEBUG] Mobile items endpoint called - Method: %s\n", r.Method)
 
@@ -342,11 +458,21 @@ func handleMobileItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := loadData()
-	fmt.Printf("[DEBUG] Mobile items: Loaded %d items from data file\n", len(data.Items))
+	query, err := parseItemQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := queryItems(requestDevice(r), query)
+	if err != nil {
+		fmt.Printf("[ERROR] Mobile items: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("[DEBUG] Mobile items: Loaded %d items from store (more: %t)\n", len(page.Items), page.HasMore)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	json.NewEncoder(w).Encode(page)
 	fmt.Printf("[DEBUG] Mobile items: Response sent successfully\n")
 }
 
@@ -360,145 +486,68 @@ func handleMessage(w http.ResponseWriter, r *http.Request, from string) {
 		return
 	}
 
+	// With e2e set, text is the ciphertext of an end-to-end encrypted message
 	var msgData struct {
-		Text string `json:"text"`
+		Text string      `json:"text"`
+		To   []string    `json:"to"`
+		E2E  *E2EPayload `json:"e2e"`
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxCommandSize)
 	if err := json.NewDecoder(r.Body).Decode(&msgData); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, errMessageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		fmt.Printf("[ERROR] Message: Invalid JSON: %v\n", err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
-
-	fmt.Printf("[DEBUG] Message: Received text from %s: '%s'\n", from, msgData.Text)
-
-	// Create new item
-	item := Item{
-		ID:        generateID(),
-		Timestamp: time.Now(),
-		From:      from,
-		Type:      "text",
-		Content:   msgData.Text,
-	}
-
-	fmt.Printf("[DEBUG] Message: Created item with ID: %s\n", item.ID)
-
-	// Load current data, add item, and save
-	data := loadData()
-	fmt.Printf("[DEBUG] Message: Loaded existing data with %d items\n", len(data.Items))
-
-	data.Items = append(data.Items, item)
-	fmt.Printf("[DEBUG] Message: Added new item, total items: %d\n", len(data.Items))
-
-	if err := saveFlowData(data); err != nil {
-		fmt.Printf("[ERROR] Message: Error saving data: %v\n", err)
-		http.Error(w, "Error saving data", http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Printf("[DEBUG] Message: Data saved successfully\n")
-
-	// Broadcast update to all WebSocket connections
-	connectionManager.BroadcastUpdate()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success", "id": item.ID})
-	fmt.Printf("[DEBUG] Message: Response sent successfully\n")
-}
-
-// Handle file endpoint
-func handleFile(w http.ResponseWriter, r *http.Request, from string) {
-	fmt.Printf("[DEBUG] File endpoint called - From: %s, Method: %s\n", from, r.Method)
-
-	if r.Method != "POST" {
-		fmt.Printf("[ERROR] File: Method not allowed: %s\n", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err := validateMessageText(msgData.Text); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Parse the multipart form
-	err := r.ParseMultipartForm(10 << 20) // 10 MB max
+	device := requestDevice(r)
+	to, err := parseTargets(msgData.To, device)
 	if err != nil {
-		fmt.Printf("[ERROR] File: Unable to parse form: %v\n", err)
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		fmt.Printf("[ERROR] Message: Invalid targets: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		fmt.Printf("[ERROR] File: Unable to get file: %v\n", err)
-		http.Error(w, "Unable to get file", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	fmt.Printf("[DEBUG] File: Received file from %s: '%s' (size: %d bytes)\n", from, header.Filename, header.Size)
+	var item Item
+	if msgData.E2E != nil {
+		fmt.Printf("[DEBUG] Message: Received encrypted message from %s (%d bytes)\n", from, len(msgData.Text))
 
-	// Generate unique filename to avoid conflicts
-	uniqueFilename := fmt.Sprintf("%s_%s", generateID(), header.Filename)
-	filePath := filepath.Join(uploadsDir, uniqueFilename)
-
-	fmt.Printf("[DEBUG] File: Saving to path: %s\n", filePath)
+		if to, err = prepareEncryptedMessage(device, to, msgData.Text, msgData.E2E); err != nil {
+			fmt.Printf("[ERROR] Message: Invalid encrypted message: %v\n", err)
+			http.Error(w, err.Error(), encryptedMessageStatus(err))
+			return
+		}
+		item, err = addEncryptedItem(from, device, to, msgData.Text, msgData.E2E)
+	} else {
+		fmt.Printf("[DEBUG] Message: Received text from %s: '%s'\n", from, msgData.Text)
 
-	// Create the file on disk
-	dst, err := os.Create(filePath)
-	if err != nil {
-		fmt.Printf("[ERROR] File: Unable to create file: %v\n", err)
-		http.Error(w, "Unable to save file", http.StatusInternalServerError)
-		return
+		// Create new item and add it to the store
+		item, err = addTextItem(from, device, to, msgData.Text)
 	}
-	defer dst.Close()
-
-	// Copy file content
-	_, err = io.Copy(dst, file)
 	if err != nil {
-		fmt.Printf("[ERROR] File: Unable to save file content: %v\n", err)
-		http.Error(w, "Unable to save file", http.StatusInternalServerError)
-		return
-	}
-
-	fmt.Printf("[DEBUG] File: File saved successfully\n")
-
-	// Create new item with the unique filename for storage
-	item := Item{
-		ID:        generateID(),
-		Timestamp: time.Now(),
-		From:      from,
-		Type:      "file",
-		Content:   fmt.Sprintf("%s|%s", header.Filename, uniqueFilename), // Store both display name and unique filename
-	}
-
-	fmt.Printf("[DEBUG] File: Created item with ID: %s\n", item.ID)
-
-	// Load current data, add item, and save
-	data := loadData()
-	fmt.Printf("[DEBUG] File: Loaded existing data with %d items\n", len(data.Items))
-
-	data.Items = append(data.Items, item)
-	fmt.Printf("[DEBUG] File: Added new item, total items: %d\n", len(data.Items))
-
-	if err := saveFlowData(data); err != nil {
-		fmt.Printf("[ERROR] File: Error saving data: %v\n", err)
+		fmt.Printf("[ERROR] Message: Error saving data: %v\n", err)
 		http.Error(w, "Error saving data", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("[DEBUG] File: Data saved successfully\n")
-
-	// Broadcast update to all WebSocket connections
-	connectionManager.BroadcastUpdate()
+	fmt.Printf("[DEBUG] Message: Saved item with ID: %s\n", item.ID)
 
-	// Generate file URL using the unique filename
-	fileURL := fmt.Sprintf("http://%s:%s/uploads/%s", getCurrentServerHost(), serverPort, uniqueFilename)
-	fmt.Printf("[DEBUG] File: Generated download URL: %s\n", fileURL)
+	// Broadcast the new item to the WebSocket connections that may see it
+	publishItemAdded(item)
+	startUnfurl(item)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "success",
-		"id":     item.ID,
-		"url":    fileURL,
-	})
-	fmt.Printf("[DEBUG] File: Response sent successfully\n")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "id": item.ID})
+	fmt.Printf("[DEBUG] Message: Response sent successfully\n")
 }
 
 // Ensure uploads directory exists
@@ -513,44 +562,6 @@ func ensureUploadsDir() error {
 	return nil
 }
 
-// Handle file downloads
-func handleFileDownload(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("[DEBUG] File download requested - URL: %s\n", r.URL.Path)
-
-	if r.Method != "GET" {
-		fmt.Printf("[ERROR] File download: Method not allowed: %s\n", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Extract filename from URL path (remove "/uploads/" prefix)
-	filename := r.URL.Path[9:] // Remove "/uploads/"
-	if filename == "" {
-		fmt.Printf("[ERROR] File download: No filename provided\n")
-		http.Error(w, "No filename provided", http.StatusBadRequest)
-		return
-	}
-
-	filePath := filepath.Join(uploadsDir, filename)
-	fmt.Printf("[DEBUG] File download: Looking for file at %s\n", filePath)
-
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		fmt.Printf("[ERROR] File download: File not found: %s\n", filePath)
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-
-	// Set headers to force download
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-
-	// Serve the file
-	fmt.Printf("[DEBUG] File download: Serving file %s\n", filename)
-	http.ServeFile(w, r, filePath)
-	fmt.Printf("[DEBUG] File download: File served successfully\n")
-}
-
 // Handle mobile web interface
 func handleMobileWeb(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[DEBUG] Mobile web interface requested - URL: %s\n", r.URL.Path)
@@ -583,8 +594,13 @@ func handleMobileAssets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Construct full file path
-	filePath := filepath.Join("mobile", "imgs", assetPath)
+	// Construct full file path, rejecting anything outside mobile/imgs
+	filePath, err := safeJoin(filepath.Join("mobile", "imgs"), assetPath)
+	if err != nil {
+		fmt.Printf("[ERROR] Mobile asset: Rejected unsafe path: %q\n", assetPath)
+		http.Error(w, "Invalid asset path", http.StatusBadRequest)
+		return
+	}
 	fmt.Printf("[DEBUG] Mobile asset: Looking for file at %s\n", filePath)
 
 	// Check if file exists
@@ -615,305 +631,6 @@ func handleMobileAssets(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[DEBUG] Mobile asset: File served successfully\n")
 }
 
-// Handle PC WebSocket connections
-func handlePCWebSocket(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("[DEBUG] PC WebSocket connection requested\n")
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade PC WebSocket connection: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Set connection timeouts
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
-	// Set ping/pong handlers for connection health checking
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
-	// Add connection to manager
-	connectionManager.AddPCConnection(conn)
-	defer connectionManager.RemovePCConnection(conn)
-
-	fmt.Printf("[DEBUG] PC WebSocket connection established\n")
-
-	// Send initial data
-	data := loadData()
-	err = conn.WriteJSON(map[string]interface{}{
-		"type": "initial",
-		"data": data,
-	})
-	if err != nil {
-		log.Printf("Error sending initial data to PC WebSocket: %v", err)
-		return
-	}
-
-	// Start ping ticker
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	// Handle messages and pings
-	go func() {
-		defer conn.Close()
-		for range ticker.C {
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				fmt.Printf("[DEBUG] PC WebSocket ping failed: %v\n", err)
-				return
-			}
-		}
-	}()
-
-	// Keep connection alive and handle incoming messages
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("PC WebSocket connection closed: %v", err)
-			break
-		}
-	}
-}
-
-// Handle mobile WebSocket connections
-func handleMobileWebSocket(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("[DEBUG] Mobile WebSocket connection requested\n")
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade mobile WebSocket connection: %v", err)
-		return
-	}
-	defer conn.Close()
-
-	// Set connection timeouts
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
-	// Set ping/pong handlers for connection health checking
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
-	// Add connection to manager
-	connectionManager.AddMobileConnection(conn)
-	defer connectionManager.RemoveMobileConnection(conn)
-
-	fmt.Printf("[DEBUG] Mobile WebSocket connection established\n")
-
-	// Send initial data
-	data := loadData()
-	err = conn.WriteJSON(map[string]interface{}{
-		"type": "initial",
-		"data": data,
-	})
-	if err != nil {
-		log.Printf("Error sending initial data to mobile WebSocket: %v", err)
-		return
-	}
-	// If there is a current YouTube video playing, send it to the new mobile connection
-	if latestYouTubeVideoInfo != nil && latestYouTubeVideoInfo.IsPlaying {
-		err = conn.WriteJSON(map[string]interface{}{
-			"type": "youtube_info",
-			"data": latestYouTubeVideoInfo,
-		})
-		if err != nil {
-			log.Printf("Error sending YouTube info to new mobile WebSocket: %v", err)
-		}
-	}
-
-	// Start ping ticker
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	// Handle messages and pings
-	go func() {
-		defer conn.Close()
-		for range ticker.C {
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				fmt.Printf("[DEBUG] Mobile WebSocket ping failed: %v\n", err)
-				return
-			}
-		}
-	}()
-
-	// Keep connection alive and handle incoming messages
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Mobile WebSocket connection closed: %v", err)
-			break
-		}
-	}
-}
-
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for simplicity
-	},
-	ReadBufferSize:   1024,
-	WriteBufferSize:  1024,
-	HandshakeTimeout: 45 * time.Second,
-}
-
-// WebSocket connection management
-type ConnectionManager struct {
-	pcConnections     map[*websocket.Conn]bool
-	mobileConnections map[*websocket.Conn]bool
-	mutex             sync.RWMutex
-}
-
-func NewConnectionManager() *ConnectionManager {
-	return &ConnectionManager{
-		pcConnections:     make(map[*websocket.Conn]bool),
-		mobileConnections: make(map[*websocket.Conn]bool),
-	}
-}
-
-func (cm *ConnectionManager) AddPCConnection(conn *websocket.Conn) {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	cm.pcConnections[conn] = true
-	fmt.Printf("[DEBUG] ConnectionManager: Added PC connection, total PC: %d\n", len(cm.pcConnections))
-}
-
-func (cm *ConnectionManager) AddMobileConnection(conn *websocket.Conn) {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	cm.mobileConnections[conn] = true
-	fmt.Printf("[DEBUG] ConnectionManager: Added mobile connection, total mobile: %d\n", len(cm.mobileConnections))
-}
-
-func (cm *ConnectionManager) RemovePCConnection(conn *websocket.Conn) {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	delete(cm.pcConnections, conn)
-	fmt.Printf("[DEBUG] ConnectionManager: Removed PC connection, total PC: %d\n", len(cm.pcConnections))
-}
-
-func (cm *ConnectionManager) RemoveMobileConnection(conn *websocket.Conn) {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
-	delete(cm.mobileConnections, conn)
-	fmt.Printf("[DEBUG] ConnectionManager: Removed mobile connection, total mobile: %d\n", len(cm.mobileConnections))
-}
-
-func (cm *ConnectionManager) BroadcastUpdate() {
-	// Load latest data first (outside the lock)
-	data := loadData()
-
-	cm.mutex.RLock()
-
-	// Create snapshots of connections to avoid holding the lock too long
-	pcConnections := make([]*websocket.Conn, 0, len(cm.pcConnections))
-	mobileConnections := make([]*websocket.Conn, 0, len(cm.mobileConnections))
-
-	for conn := range cm.pcConnections {
-		pcConnections = append(pcConnections, conn)
-	}
-	for conn := range cm.mobileConnections {
-		mobileConnections = append(mobileConnections, conn)
-	}
-
-	cm.mutex.RUnlock()
-
-	// Track connections to remove due to errors
-	var pcToRemove []*websocket.Conn
-	var mobileToRemove []*websocket.Conn
-
-	// Create the message once
-	message := map[string]interface{}{
-		"type": "update",
-		"data": data,
-	}
-
-	// Broadcast to PC connections concurrently
-	for _, conn := range pcConnections {
-		err := conn.WriteJSON(message)
-		if err != nil {
-			fmt.Printf("[DEBUG] Error broadcasting to PC connection: %v\n", err)
-			pcToRemove = append(pcToRemove, conn)
-		}
-	}
-
-	// Broadcast to mobile connections concurrently
-	for _, conn := range mobileConnections {
-		err := conn.WriteJSON(message)
-		if err != nil {
-			fmt.Printf("[DEBUG] Error broadcasting to mobile connection: %v\n", err)
-			mobileToRemove = append(mobileToRemove, conn)
-		}
-	}
-
-	// Remove failed connections (acquire write lock only if needed)
-	if len(pcToRemove) > 0 || len(mobileToRemove) > 0 {
-		cm.mutex.Lock()
-		for _, conn := range pcToRemove {
-			delete(cm.pcConnections, conn)
-			conn.Close()
-		}
-		for _, conn := range mobileToRemove {
-			delete(cm.mobileConnections, conn)
-			conn.Close()
-		}
-		fmt.Printf("[DEBUG] Removed %d failed PC connections, %d failed mobile connections\n", len(pcToRemove), len(mobileToRemove))
-		fmt.Printf("[DEBUG] Active connections - PC: %d, Mobile: %d\n", len(cm.pcConnections), len(cm.mobileConnections))
-		cm.mutex.Unlock()
-	}
-}
-
-// Broadcast YouTube video info to mobile connections only
-func (cm *ConnectionManager) BroadcastYouTubeInfo(videoInfo YouTubeVideoInfo) {
-	cm.mutex.RLock()
-
-	// Create snapshot of mobile connections
-	mobileConnections := make([]*websocket.Conn, 0, len(cm.mobileConnections))
-	for conn := range cm.mobileConnections {
-		mobileConnections = append(mobileConnections, conn)
-	}
-
-	cm.mutex.RUnlock()
-
-	// Track connections to remove due to errors
-	var mobileToRemove []*websocket.Conn
-
-	// Create the message once
-	message := map[string]interface{}{
-		"type": "youtube_info",
-		"data": videoInfo,
-	}
-
-	// Send only to mobile connections
-	for _, conn := range mobileConnections {
-		if err := conn.WriteJSON(message); err != nil {
-			fmt.Printf("[DEBUG] Error broadcasting YouTube info to mobile connection: %v\n", err)
-			mobileToRemove = append(mobileToRemove, conn)
-		}
-	}
-
-	// Remove failed connections (acquire write lock only if needed)
-	if len(mobileToRemove) > 0 {
-		cm.mutex.Lock()
-		for _, conn := range mobileToRemove {
-			delete(cm.mobileConnections, conn)
-			conn.Close()
-		}
-		fmt.Printf("[DEBUG] Removed %d failed mobile connections during YouTube broadcast, total mobile: %d\n", len(mobileToRemove), len(cm.mobileConnections))
-		cm.mutex.Unlock()
-	}
-}
-
-// Store the latest YouTube video info in memory
-var latestYouTubeVideoInfo *YouTubeVideoInfo = nil
-var latestYouTubeVideoInfoTimer *time.Timer = nil
-
-const youtubeInfoTimeout = 10 * time.Minute
-
-var connectionManager = NewConnectionManager()
-
 func main() {
 	// On Linux and other OSes, just run as CLI (no systray, no noconsole)
 	fmt.Println("[INFO] Orion server running as CLI app (no systray)")
@@ -952,44 +669,6 @@ func openURL(url string) {
 	}
 }
 
-// Handle YouTube video info from PC
-func handleYouTubeInfo(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("[DEBUG] YouTube info endpoint called - Method: %s\n", r.Method)
-
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var videoInfo YouTubeVideoInfo
-	err := json.NewDecoder(r.Body).Decode(&videoInfo)
-	if err != nil {
-		fmt.Printf("[DEBUG] YouTube info: Error decoding JSON: %v\n", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
-	}
-
-	fmt.Printf("[DEBUG] YouTube info: Received video info - Title: '%s', VideoID: '%s', CurrentTime: %d\n",
-		videoInfo.Title, videoInfo.VideoID, videoInfo.CurrentTime)
-
-	// Store the latest video info in memory
-	latestYouTubeVideoInfo = &videoInfo
-	go connectionManager.BroadcastYouTubeInfo(videoInfo)
-
-	// Reset the timeout timer
-	if latestYouTubeVideoInfoTimer != nil {
-		latestYouTubeVideoInfoTimer.Stop()
-	}
-	latestYouTubeVideoInfoTimer = time.AfterFunc(youtubeInfoTimeout, func() {
-		latestYouTubeVideoInfo = nil
-		fmt.Printf("[DEBUG] YouTube info: Cleared due to timeout (no update for %v)\n", youtubeInfoTimeout)
-	})
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
-	fmt.Printf("[DEBUG] YouTube info: Response sent successfully\n")
-}
-
 // Handle server settings API endpoint
 func handleServerSettings(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("[DEBUG] Server settings endpoint called - Method: %s\n", r.Method)
@@ -998,12 +677,12 @@ func handleServerSettings(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		// Return current settings
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(serverSettings)
+		json.NewEncoder(w).Encode(currentSettings())
 		fmt.Printf("[DEBUG] Server settings: Current settings sent\n")
 
 	case "POST":
-		// Update settings
-		var newSettings ServerSettings
+		// Update settings, fields missing from the request keep their current value
+		newSettings := currentSettings()
 		err := json.NewDecoder(r.Body).Decode(&newSettings)
 		if err != nil {
 			fmt.Printf("[ERROR] Server settings: Invalid JSON: %v\n", err)
@@ -1012,16 +691,49 @@ func handleServerSettings(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Validate settings
-		if newSettings.ServerPort == "" || newSettings.DataRetention < 0 {
+		if newSettings.ServerPort == "" || newSettings.DataRetention < 0 || newSettings.MaxUploadSizeMB < 0 {
 			http.Error(w, "Invalid settings values", http.StatusBadRequest)
 			return
 		}
+		switch newSettings.TLSMode {
+		case "":
+			newSettings.TLSMode = tlsModeOff
+		case tlsModeOff, tlsModeSelfSigned:
+		case tlsModeCustom:
+			if newSettings.TLSCertFile == "" || newSettings.TLSKeyFile == "" {
+				http.Error(w, "Custom TLS needs a certificate and key file", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Invalid TLS mode", http.StatusBadRequest)
+			return
+		}
+		switch newSettings.EncryptionMode {
+		case "":
+			newSettings.EncryptionMode = encryptionModeOff
+		case encryptionModeOff, encryptionModePassphrase:
+		case encryptionModeKeyFile:
+			if newSettings.EncryptionKeyFile == "" {
+				http.Error(w, "Key file encryption needs a key file", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Invalid encryption mode", http.StatusBadRequest)
+			return
+		}
+		// Encrypted data can only be read back with the kind of key it was encrypted with
+		if info, err := loadEncryptionInfo(); err == nil && info != nil && newSettings.EncryptionMode != info.Mode {
+			http.Error(w, fmt.Sprintf("Storage is encrypted with a %s, the encryption mode can't be changed", info.Mode), http.StatusBadRequest)
+			return
+		}
 
 		// Update global settings
+		settingsMutex.Lock()
 		serverSettings = newSettings
+		settingsMutex.Unlock()
 
 		// Save to file
-		if err := saveSettings(serverSettings); err != nil {
+		if err := saveSettings(newSettings); err != nil {
 			fmt.Printf("[ERROR] Server settings: Error saving settings: %v\n", err)
 			http.Error(w, "Error saving settings", http.StatusInternalServerError)
 			return
@@ -1029,6 +741,9 @@ func handleServerSettings(w http.ResponseWriter, r *http.Request) {
 
 		fmt.Printf("[DEBUG] Server settings: Settings updated successfully\n")
 
+		// Apply a changed retention window right away
+		go runRetentionSweep(newSettings.DataRetention)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Settings updated successfully"})
 
@@ -1050,16 +765,17 @@ func handleServerStatus(w http.ResponseWriter, r *http.Request) {
 	uptime := time.Since(serverStartTime)
 	uptimeStr := fmt.Sprintf("%dh %dm", int(uptime.Hours()), int(uptime.Minutes())%60)
 
-	// Get connection count
-	connectionManager.mutex.RLock()
-	totalConnections := len(connectionManager.pcConnections) + len(connectionManager.mobileConnections)
-	connectionManager.mutex.RUnlock()
-
 	status := ServerStatus{
 		IsOnline:    true,
 		Uptime:      uptimeStr,
 		Version:     "1.0.0",
-		Connections: totalConnections,
+		Connections: connectionManager.Count(),
+		Retention:   getRetentionStats(),
+		Storage:     blobStore.Stats(),
+		TLS:         tlsStatus,
+	}
+	if isAuthorized(r) {
+		status.Devices = connectionManager.ConnectedDevices()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1075,6 +791,9 @@ func handleServerSettingsPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if handleAdminLink(w, r) {
+		return
+	}
 
 	// Serve the embedded settings HTML
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -1091,22 +810,65 @@ func handleClearHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clear all items from data
-	emptyData := FlowData{Items: []Item{}}
+	// Uploaded files are deleted by default; "quarantine" moves them aside and "keep" leaves them
+	var clearData struct {
+		Files string `json:"files"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&clearData); err != nil {
+			fmt.Printf("[ERROR] Clear history: Invalid JSON: %v\n", err)
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if mode := r.URL.Query().Get("files"); mode != "" {
+		clearData.Files = mode
+	}
+	if clearData.Files == "" {
+		clearData.Files = uploadsModeDelete
+	}
+	switch clearData.Files {
+	case uploadsModeDelete, uploadsModeQuarantine, uploadsModeKeep:
+	default:
+		http.Error(w, "Invalid files mode", http.StatusBadRequest)
+		return
+	}
 
-	if err := saveFlowData(emptyData); err != nil {
-		fmt.Printf("[ERROR] Clear history: Error saving empty data: %v\n", err)
+	// Clear all items from the store
+	removed, err := itemStore.Clear()
+	if err != nil {
+		fmt.Printf("[ERROR] Clear history: Error clearing store: %v\n", err)
 		http.Error(w, "Error clearing history", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("[DEBUG] Clear history: History cleared successfully\n")
+	fmt.Printf("[DEBUG] Clear history: History cleared successfully (%d items)\n", len(removed))
+
+	// Purge uploaded files now that no item references them
+	fileStats, err := clearUploadedFiles(clearData.Files, removed)
+	if err != nil {
+		fmt.Printf("[ERROR] Clear history: Error clearing uploaded files: %v\n", err)
+		// History is already cleared, report the file errors in the response
+	}
+
+	// Thumbnails only exist for items, which are all gone
+	clearThumbnails()
 
-	// Broadcast update to all WebSocket connections
-	connectionManager.BroadcastUpdate()
+	// Tell all WebSocket connections to drop their history
+	publishCleared()
+
+	message := "History cleared successfully"
+	if fileStats.Files > 0 {
+		message = fmt.Sprintf("History cleared, %d files freed (%d bytes)", fileStats.Files, fileStats.Bytes)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "History cleared successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": message,
+		"items":   len(removed),
+		"files":   fileStats,
+	})
 	fmt.Printf("[DEBUG] Clear history: Response sent successfully\n")
 }
 
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media handoff: devices report the video or song they are playing, in a
+// browser tab or a local media player, and the other devices receive it as
+// now_playing events so they can continue it at the same position. Reports
+// carry the page URL; the provider registry below recognizes the site, the
+// media on the page and how to open that media at a position.
+//
+// Every device has its own now-playing state. It ends when the device reports
+// a stop (now_playing_stopped) or sends no update for nowPlayingTimeout.
+
+const nowPlayingTimeout = 10 * time.Minute
+
+// Kinds of media
+const (
+	mediaKindVideo = "video"
+	mediaKindAudio = "audio"
+)
+
+// Providers that aren't in the registry
+const (
+	mediaProviderWeb   = "web"   // any other page playing a media element
+	mediaProviderLocal = "local" // local media players, reported without a web URL
+)
+
+// Longest title, artist and player name kept, in characters
+const maxNowPlayingTextLength = 200
+
+// Longest position or duration accepted, in seconds
+const maxMediaSeconds = 30 * 24 * 60 * 60
+
+var errNowPlayingTitle = errors.New("Local media needs a title")
+
+// What a device is playing. Position is measured at UpdatedAt.
+type NowPlaying struct {
+	DeviceID   string    `json:"deviceId,omitempty"`
+	DeviceName string    `json:"deviceName,omitempty"`
+	From       string    `json:"from"`
+	Provider   string    `json:"provider"`
+	Kind       string    `json:"kind"`              // "video" or "audio"
+	MediaID    string    `json:"mediaId,omitempty"` // ID of the media at the provider
+	Title      string    `json:"title"`
+	Artist     string    `json:"artist,omitempty"`
+	Player     string    `json:"player,omitempty"` // local media player, e.g. "VLC"
+	URL        string    `json:"url,omitempty"`
+	ResumeURL  string    `json:"resumeUrl,omitempty"` // opens the media at Position, empty if other devices can't
+	Position   float64   `json:"position"`            // seconds
+	Duration   float64   `json:"duration"`            // seconds, 0 if unknown or live
+	Playing    bool      `json:"playing"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// A site media can be handed off from
+type MediaProvider struct {
+	Name  string
+	Kind  string   // kind of media, unless the device reports one
+	Hosts []string // matched with their subdomains, none for any host
+	// ID of the media on a page of the provider, "" if the page doesn't show one
+	MediaID func(u *url.URL) string
+	// URL that opens the media at a position in seconds
+	ResumeURL func(u *url.URL, id string, position int) string
+}
+
+// Registry of the providers, checked in order. Providers matching any host
+// only apply to URLs they find media in.
+var mediaProviders = []MediaProvider{
+	{
+		Name:    "youtube",
+		Kind:    mediaKindVideo,
+		Hosts:   []string{"youtube.com", "youtu.be", "youtube-nocookie.com"},
+		MediaID: youTubeMediaID,
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return fmt.Sprintf("https://youtu.be/%s?t=%d", id, position)
+		},
+	},
+	{
+		Name:    "vimeo",
+		Kind:    mediaKindVideo,
+		Hosts:   []string{"vimeo.com"},
+		MediaID: vimeoMediaID,
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return fmt.Sprintf("https://vimeo.com/%s#t=%ds", id, position)
+		},
+	},
+	{
+		Name:  "twitch",
+		Kind:  mediaKindVideo,
+		Hosts: []string{"twitch.tv"},
+		// Past broadcasts, live channels have no position to resume at
+		MediaID: func(u *url.URL) string {
+			return pathID(u, "/videos/", digitsPattern)
+		},
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return fmt.Sprintf("https://www.twitch.tv/videos/%s?t=%dh%dm%ds", id, position/3600, position/60%60, position%60)
+		},
+	},
+	{
+		Name:    "dailymotion",
+		Kind:    mediaKindVideo,
+		Hosts:   []string{"dailymotion.com", "dai.ly"},
+		MediaID: dailymotionMediaID,
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return fmt.Sprintf("https://www.dailymotion.com/video/%s?start=%d", id, position)
+		},
+	},
+	{
+		Name:    "soundcloud",
+		Kind:    mediaKindAudio,
+		Hosts:   []string{"soundcloud.com"},
+		MediaID: soundCloudMediaID,
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return fmt.Sprintf("https://soundcloud.com/%s#t=%d:%02d", id, position/60, position%60)
+		},
+	},
+	{
+		Name:    "spotify",
+		Kind:    mediaKindAudio,
+		Hosts:   []string{"open.spotify.com"},
+		MediaID: spotifyMediaID,
+		// Spotify links can't carry a position, the app resumes on its own
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			return "https://open.spotify.com/" + id
+		},
+	},
+	{
+		// Audio and video files opened directly, browsers seek to a media fragment
+		Name: "file",
+		Kind: mediaKindVideo,
+		MediaID: func(u *url.URL) string {
+			if mediaFileExtensions[strings.ToLower(path.Ext(u.Path))] {
+				return path.Base(u.Path)
+			}
+			return ""
+		},
+		ResumeURL: func(u *url.URL, id string, position int) string {
+			resume := *u
+			resume.Fragment = fmt.Sprintf("t=%d", position)
+			return resume.String()
+		},
+	},
+}
+
+var mediaFileExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".webm": true, ".mkv": true, ".mov": true, ".ogv": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".oga": true, ".opus": true, ".flac": true, ".wav": true,
+}
+
+var (
+	youTubeIDPattern     = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	dailymotionIDPattern = regexp.MustCompile(`^x[0-9a-z]+$`)
+	spotifyIDPattern     = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+	digitsPattern        = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// ID in the path segment after prefix, if it matches the pattern
+func pathID(u *url.URL, prefix string, pattern *regexp.Regexp) string {
+	if !strings.HasPrefix(u.Path, prefix) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(u.Path, prefix), "/")
+	if !pattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+func youTubeMediaID(u *url.URL) string {
+	if strings.TrimPrefix(u.Hostname(), "www.") == "youtu.be" {
+		return pathID(u, "/", youTubeIDPattern)
+	}
+	if id := u.Query().Get("v"); u.Path == "/watch" && youTubeIDPattern.MatchString(id) {
+		return id
+	}
+	for _, prefix := range []string{"/shorts/", "/embed/", "/live/", "/v/"} {
+		if id := pathID(u, prefix, youTubeIDPattern); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// vimeo.com/123, vimeo.com/channels/name/123 and player.vimeo.com/video/123
+func vimeoMediaID(u *url.URL) string {
+	for _, segment := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		if digitsPattern.MatchString(segment) {
+			return segment
+		}
+	}
+	return ""
+}
+
+// dailymotion.com/video/x8abc12 and dai.ly/x8abc12
+func dailymotionMediaID(u *url.URL) string {
+	if strings.TrimPrefix(u.Hostname(), "www.") == "dai.ly" {
+		return pathID(u, "/", dailymotionIDPattern)
+	}
+	return pathID(u, "/video/", dailymotionIDPattern)
+}
+
+// soundcloud.com/artist/track, the ID is "artist/track"
+func soundCloudMediaID(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) != 2 || segments[0] == "" || segments[1] == "" {
+		return ""
+	}
+	switch segments[0] {
+	case "discover", "feed", "search", "stream", "you", "charts", "upload":
+		return ""
+	}
+	switch segments[1] {
+	case "sets", "tracks", "albums", "likes", "reposts", "followers", "following", "popular-tracks":
+		return ""
+	}
+	return segments[0] + "/" + segments[1]
+}
+
+// open.spotify.com/track/ID and /episode/ID, also under /intl-xx/; the ID is "track/ID"
+func spotifyMediaID(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) > 0 && strings.HasPrefix(segments[0], "intl-") {
+		segments = segments[1:]
+	}
+	if len(segments) < 2 || (segments[0] != "track" && segments[0] != "episode") || !spotifyIDPattern.MatchString(segments[1]) {
+		return ""
+	}
+	return segments[0] + "/" + segments[1]
+}
+
+func matchesHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the provider of a page and the media on it, nil if no provider knows it
+func identifyMedia(u *url.URL) (*MediaProvider, string) {
+	host := strings.ToLower(u.Hostname())
+	for i := range mediaProviders {
+		provider := &mediaProviders[i]
+		if len(provider.Hosts) > 0 && !matchesHost(host, provider.Hosts) {
+			continue
+		}
+		id := provider.MediaID(u)
+		if id == "" && len(provider.Hosts) == 0 {
+			continue
+		}
+		return provider, id
+	}
+	return nil, ""
+}
+
+func mediaProviderByName(name string) *MediaProvider {
+	for i := range mediaProviders {
+		if mediaProviders[i].Name == name {
+			return &mediaProviders[i]
+		}
+	}
+	return nil
+}
+
+// URL that opens the media at its current position. Pages the registry knows
+// no media on open as they are, local media can't be opened elsewhere.
+func resumeURL(np NowPlaying) string {
+	u, err := url.Parse(np.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	provider := mediaProviderByName(np.Provider)
+	if provider == nil || np.MediaID == "" {
+		return np.URL
+	}
+	return provider.ResumeURL(u, np.MediaID, int(np.Position))
+}
+
+// A device's report of what it is playing
+type nowPlayingReport struct {
+	URL      string  `json:"url"`
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist"`
+	Player   string  `json:"player"`
+	Kind     string  `json:"kind"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Playing  bool    `json:"playing"`
+}
+
+// Check a report and work out provider and media. Media without an http(s)
+// URL comes from a local player.
+func newNowPlaying(from string, device *PairedDevice, report nowPlayingReport) (NowPlaying, error) {
+	for _, seconds := range []float64{report.Position, report.Duration} {
+		if seconds < 0 || seconds > maxMediaSeconds || math.IsNaN(seconds) {
+			return NowPlaying{}, fmt.Errorf("Position and duration must be 0 to %d seconds", maxMediaSeconds)
+		}
+	}
+
+	np := NowPlaying{
+		From:      from,
+		Provider:  mediaProviderLocal,
+		Title:     cleanPreviewText(report.Title, maxNowPlayingTextLength),
+		Artist:    cleanPreviewText(report.Artist, maxNowPlayingTextLength),
+		Player:    cleanPreviewText(report.Player, maxNowPlayingTextLength),
+		Position:  report.Position,
+		Duration:  report.Duration,
+		Playing:   report.Playing,
+		UpdatedAt: time.Now(),
+	}
+	if device != nil {
+		np.DeviceID = device.ID
+		np.DeviceName = device.Name
+	}
+
+	kind := mediaKindVideo
+	if report.URL != "" {
+		u, err := url.Parse(report.URL)
+		if err != nil || u.Scheme == "" {
+			return NowPlaying{}, fmt.Errorf("Invalid media URL")
+		}
+		np.URL = u.String()
+
+		switch u.Scheme {
+		case "http", "https":
+			np.Provider = mediaProviderWeb
+			if provider, id := identifyMedia(u); provider != nil {
+				np.Provider, np.MediaID, kind = provider.Name, id, provider.Kind
+			}
+			if np.Title == "" {
+				np.Title = u.Hostname()
+			}
+		case "file":
+			// Local media players may report the file they play
+			if np.Title == "" {
+				np.Title = path.Base(u.Path)
+			}
+		default:
+			return NowPlaying{}, fmt.Errorf("Media URL must be http(s) or file")
+		}
+	}
+	if np.Title == "" {
+		return NowPlaying{}, errNowPlayingTitle
+	}
+
+	switch report.Kind {
+	case mediaKindVideo, mediaKindAudio:
+		kind = report.Kind
+	case "":
+	default:
+		return NowPlaying{}, fmt.Errorf("Media kind must be %q or %q", mediaKindVideo, mediaKindAudio)
+	}
+	np.Kind = kind
+	np.ResumeURL = resumeURL(np)
+	return np, nil
+}
+
+// The state at a later time: the position of playing media moves on with the clock
+func (np NowPlaying) at(now time.Time) NowPlaying {
+	if !np.Playing || !now.After(np.UpdatedAt) {
+		return np
+	}
+	np.Position += now.Sub(np.UpdatedAt).Seconds()
+	if np.Duration > 0 && np.Position > np.Duration {
+		np.Position = np.Duration
+	}
+	np.UpdatedAt = now
+	np.ResumeURL = resumeURL(np)
+	return np
+}
+
+// Now-playing state of every device, see senderKey
+type NowPlayingState struct {
+	devices map[string]*nowPlayingEntry
+	timeout time.Duration
+	mutex   sync.Mutex
+}
+
+type nowPlayingEntry struct {
+	playing NowPlaying
+	expiry  *time.Timer
+}
+
+func NewNowPlayingState(timeout time.Duration) *NowPlayingState {
+	return &NowPlayingState{devices: make(map[string]*nowPlayingEntry), timeout: timeout}
+}
+
+var nowPlaying = NewNowPlayingState(nowPlayingTimeout)
+
+// Replace what a device is playing, it ends unless updated within the timeout
+func (s *NowPlayingState) Update(key string, np NowPlaying) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if previous, ok := s.devices[key]; ok {
+		previous.expiry.Stop()
+	}
+	entry := &nowPlayingEntry{playing: np}
+	entry.expiry = time.AfterFunc(s.timeout, func() { s.expire(key, entry) })
+	s.devices[key] = entry
+}
+
+// End what a device is playing, false if it wasn't playing anything
+func (s *NowPlayingState) Stop(key string) (NowPlaying, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.devices[key]
+	if !ok {
+		return NowPlaying{}, false
+	}
+	entry.expiry.Stop()
+	delete(s.devices, key)
+	return entry.playing, true
+}
+
+func (s *NowPlayingState) expire(key string, entry *nowPlayingEntry) {
+	s.mutex.Lock()
+	current, ok := s.devices[key]
+	if ok && current == entry {
+		delete(s.devices, key)
+	}
+	s.mutex.Unlock()
+
+	// Updated again while the timer fired
+	if !ok || current != entry {
+		return
+	}
+	fmt.Printf("[DEBUG] Now playing: %s ended after no update for %v\n", key, s.timeout)
+	publishNowPlayingStopped(entry.playing)
+}
+
+// What every device is playing right now, the most recent report first
+func (s *NowPlayingState) List() []NowPlaying {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	list := make([]NowPlaying, 0, len(s.devices))
+	for _, entry := range s.devices {
+		list = append(list, entry.playing.at(now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	return list
+}
+
+// Tell the other devices what a device plays now
+func publishNowPlaying(np NowPlaying) {
+	connectionManager.BroadcastNowPlaying("now_playing", np, np.DeviceID)
+}
+
+func publishNowPlayingStopped(np NowPlaying) {
+	connectionManager.BroadcastNowPlaying("now_playing_stopped", map[string]string{
+		"deviceId": np.DeviceID,
+		"from":     np.From,
+	}, np.DeviceID)
+}
+
+// Send a new connection the media other devices are playing
+func sendNowPlaying(client *Client) {
+	device := client.Device()
+	for _, np := range nowPlaying.List() {
+		if np.Playing && (device == nil || np.DeviceID != device.ID) {
+			client.Send(map[string]interface{}{"type": "now_playing", "data": np})
+		}
+	}
+}
+
+// Handle the now-playing endpoints (/pc/now-playing and /mobile/now-playing):
+//
+//	GET     what every device is playing
+//	POST    report what the calling device plays ({"url", "title", "artist", "player",
+//	        "kind", "position", "duration", "playing"}), again on every change
+//	DELETE  the calling device stopped playing
+func handleNowPlaying(w http.ResponseWriter, r *http.Request, from string) {
+	fmt.Printf("[DEBUG] Now playing endpoint called - From: %s, Method: %s\n", from, r.Method)
+
+	device := requestDevice(r)
+	key := senderKey(from, device)
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"playing": nowPlaying.List()})
+
+	case "POST":
+		var report nowPlayingReport
+		r.Body = http.MaxBytesReader(w, r.Body, maxCommandSize)
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		np, err := newNowPlaying(from, device, report)
+		if err != nil {
+			fmt.Printf("[ERROR] Now playing: Invalid report from %s: %v\n", key, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fmt.Printf("[DEBUG] Now playing: %s plays %s '%s' at %.0fs (playing: %v)\n", key, np.Provider, np.Title, np.Position, np.Playing)
+		nowPlaying.Update(key, np)
+		publishNowPlaying(np)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "nowPlaying": np})
+
+	case "DELETE":
+		if np, ok := nowPlaying.Stop(key); ok {
+			fmt.Printf("[DEBUG] Now playing: %s stopped\n", key)
+			publishNowPlayingStopped(np)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIdentifyMedia(t *testing.T) {
+	tests := []struct {
+		url      string
+		provider string // "" when no provider knows the page
+		id       string
+		resume   string // at 3725 seconds
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=x", "youtube", "dQw4w9WgXcQ", "https://youtu.be/dQw4w9WgXcQ?t=3725"},
+		{"https://youtu.be/dQw4w9WgXcQ?si=abc", "youtube", "dQw4w9WgXcQ", "https://youtu.be/dQw4w9WgXcQ?t=3725"},
+		{"https://m.youtube.com/shorts/dQw4w9WgXcQ", "youtube", "dQw4w9WgXcQ", "https://youtu.be/dQw4w9WgXcQ?t=3725"},
+		{"https://www.youtube.com/feed/subscriptions", "youtube", "", ""},
+		{"https://notyoutube.com/watch?v=dQw4w9WgXcQ", "", "", ""},
+		{"https://vimeo.com/channels/staffpicks/76979871", "vimeo", "76979871", "https://vimeo.com/76979871#t=3725s"},
+		{"https://player.vimeo.com/video/76979871", "vimeo", "76979871", "https://vimeo.com/76979871#t=3725s"},
+		{"https://www.twitch.tv/videos/1234567", "twitch", "1234567", "https://www.twitch.tv/videos/1234567?t=1h2m5s"},
+		{"https://www.twitch.tv/somechannel", "twitch", "", ""},
+		{"https://www.dailymotion.com/video/x8abc12", "dailymotion", "x8abc12", "https://www.dailymotion.com/video/x8abc12?start=3725"},
+		{"https://dai.ly/x8abc12", "dailymotion", "x8abc12", "https://www.dailymotion.com/video/x8abc12?start=3725"},
+		{"https://soundcloud.com/artist/a-track", "soundcloud", "artist/a-track", "https://soundcloud.com/artist/a-track#t=62:05"},
+		{"https://soundcloud.com/artist/sets", "soundcloud", "", ""},
+		{"https://open.spotify.com/intl-de/episode/4rOoJ6Egrf8K2IrywzwOMk", "spotify", "episode/4rOoJ6Egrf8K2IrywzwOMk", "https://open.spotify.com/episode/4rOoJ6Egrf8K2IrywzwOMk"},
+		{"http://192.168.1.5/media/Talk.MP3?x=1", "file", "Talk.MP3", "http://192.168.1.5/media/Talk.MP3?x=1#t=3725"},
+		{"https://example.com/article", "", "", ""},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		provider, id := identifyMedia(u)
+		name, resume := "", ""
+		if provider != nil {
+			name = provider.Name
+			if id != "" {
+				resume = provider.ResumeURL(u, id, 3725)
+			}
+		}
+		if name != tt.provider || id != tt.id || resume != tt.resume {
+			t.Errorf("%s: provider %q, id %q, resume %q; want %q, %q, %q", tt.url, name, id, resume, tt.provider, tt.id, tt.resume)
+		}
+	}
+}
+
+func TestNewNowPlaying(t *testing.T) {
+	device := &PairedDevice{ID: "dev_laptop", Name: "Laptop"}
+
+	np, err := newNowPlaying("PC", device, nowPlayingReport{URL: "https://soundcloud.com/artist/a-track", Title: " A  track ", Position: 61.6, Duration: 200, Playing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if np.Provider != "soundcloud" || np.Kind != mediaKindAudio || np.Title != "A track" || np.DeviceID != device.ID || np.ResumeURL != "https://soundcloud.com/artist/a-track#t=1:01" {
+		t.Errorf("soundcloud report = %+v", np)
+	}
+
+	// Pages no provider knows open as they are
+	np, _ = newNowPlaying("PC", nil, nowPlayingReport{URL: "https://example.com/lecture", Kind: mediaKindAudio})
+	if np.Provider != mediaProviderWeb || np.Kind != mediaKindAudio || np.Title != "example.com" || np.ResumeURL != "https://example.com/lecture" {
+		t.Errorf("web report = %+v", np)
+	}
+
+	// Local players can't be resumed elsewhere
+	np, _ = newNowPlaying("PC", nil, nowPlayingReport{URL: "file:///home/me/Music/song.flac", Player: "VLC", Kind: mediaKindAudio})
+	if np.Provider != mediaProviderLocal || np.Title != "song.flac" || np.ResumeURL != "" {
+		t.Errorf("local file report = %+v", np)
+	}
+	np, _ = newNowPlaying("PC", nil, nowPlayingReport{Title: "Podcast", Player: "mpv"})
+	if np.Provider != mediaProviderLocal || np.Player != "mpv" || np.URL != "" {
+		t.Errorf("local report = %+v", np)
+	}
+
+	bad := []nowPlayingReport{
+		{Player: "mpv"}, // no title
+		{URL: "javascript:alert(1)", Title: "x"},
+		{URL: "not a url", Title: "x"},
+		{URL: "https://example.com", Kind: "podcast"},
+		{URL: "https://example.com", Position: -1},
+		{URL: "https://example.com", Duration: maxMediaSeconds + 1},
+	}
+	for _, report := range bad {
+		if _, err := newNowPlaying("PC", nil, report); err == nil {
+			t.Errorf("report %+v accepted", report)
+		}
+	}
+}
+
+func TestNowPlayingAt(t *testing.T) {
+	np, _ := newNowPlaying("PC", nil, nowPlayingReport{URL: "https://youtu.be/dQw4w9WgXcQ", Position: 10, Duration: 100, Playing: true})
+
+	later := np.at(np.UpdatedAt.Add(5 * time.Second))
+	if later.Position != 15 || later.ResumeURL != "https://youtu.be/dQw4w9WgXcQ?t=15" {
+		t.Errorf("5s later: position %v, resume %s", later.Position, later.ResumeURL)
+	}
+	if end := np.at(np.UpdatedAt.Add(time.Hour)); end.Position != 100 {
+		t.Errorf("past the end: position %v", end.Position)
+	}
+
+	np.Playing = false
+	if paused := np.at(np.UpdatedAt.Add(time.Minute)); paused.Position != 10 {
+		t.Errorf("paused: position %v", paused.Position)
+	}
+}
+
+func TestNowPlayingState(t *testing.T) {
+	state := NewNowPlayingState(50 * time.Millisecond)
+	laptop, _ := newNowPlaying("PC", &PairedDevice{ID: "dev_laptop"}, nowPlayingReport{URL: "https://vimeo.com/1", Playing: true})
+	phone, _ := newNowPlaying("phone", nil, nowPlayingReport{Title: "Song", Player: "Music"})
+	phone.UpdatedAt = laptop.UpdatedAt.Add(-time.Second)
+
+	state.Update("dev_laptop", laptop)
+	state.Update(senderKey("phone", nil), phone)
+	if list := state.List(); len(list) != 2 || list[0].DeviceID != "dev_laptop" {
+		t.Fatalf("state = %+v", list)
+	}
+
+	// A device plays one thing at a time
+	laptop.Title = "Next video"
+	state.Update("dev_laptop", laptop)
+	if list := state.List(); len(list) != 2 || list[0].Title != "Next video" {
+		t.Errorf("after a second report: %+v", list)
+	}
+
+	if stopped, ok := state.Stop(senderKey("phone", nil)); !ok || stopped.Title != "Song" {
+		t.Errorf("stop: %+v, %v", stopped, ok)
+	}
+	if _, ok := state.Stop(senderKey("phone", nil)); ok {
+		t.Errorf("stopped twice")
+	}
+
+	// Devices that stop reporting are dropped
+	time.Sleep(150 * time.Millisecond)
+	if list := state.List(); len(list) != 0 {
+		t.Errorf("expired state kept: %+v", list)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Version of the Item layout. Items written by older versions are upgraded
+// by migrateItem when the store is opened.
+//
+//	1: file items keep "display|unique" in Content
+//	2: typed File and Link payloads, Content of a file item is its display name
+//	3: uploads stored once under their content hash, see BlobStore
+//	4: text that is a single link has type "link"
+const itemSchemaVersion = 4
+
+// Payload of a file item
+type FilePayload struct {
+	Name       string `json:"name"`       // name the file was sent with
+	StoredName string `json:"storedName"` // file name in the uploads folder
+	Size       int64  `json:"size"`
+	MIMEType   string `json:"mimeType,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	// Images only: original dimensions and the thumbnail served from /thumbs/{id}
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// Payload of a link item, a message that is nothing but a URL. The preview
+// fields are filled in by unfurlLink once the page was fetched.
+type LinkPayload struct {
+	URL         string     `json:"url"`
+	Host        string     `json:"host"`
+	Title       string     `json:"title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Favicon     string     `json:"favicon,omitempty"`    // data: URL of the site icon
+	UnfurledAt  *time.Time `json:"unfurledAt,omitempty"` // unset until the page was fetched
+}
+
+// Describe a stored upload: size, content type and checksum
+func newFilePayload(name, storedName string) (*FilePayload, error) {
+	filePath, err := safeJoin(uploadsDir, storedName)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	contentType, err := detectContentType(file, name)
+	if err != nil {
+		return nil, err
+	}
+	payload := &FilePayload{
+		Name:       name,
+		StoredName: storedName,
+		MIMEType:   contentType,
+	}
+
+	// A blob named after its plain checksum needn't be read again
+	if isBlobName(storedName) && blobNameKey == nil {
+		payload.Size = file.Size()
+		payload.SHA256 = storedName
+		return payload, nil
+	}
+
+	hash := sha256.New()
+	payload.Size, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+	payload.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return payload, nil
+}
+
+// Get the link payload for a text that is nothing but an http(s) URL, nil otherwise
+func newLinkPayload(text string) *LinkPayload {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.ContainsAny(text, " \t\r\n") {
+		return nil
+	}
+	link, err := url.Parse(text)
+	if err != nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" {
+		return nil
+	}
+	return &LinkPayload{URL: link.String(), Host: link.Hostname()}
+}
+
+var legacyStoredNamePattern = regexp.MustCompile(`\|item_[0-9]+_`)
+
+// Split the Content of a version 1 file item. It was "display|unique", with
+// unique being item_<nanos>_display, and either name could contain a "|". The
+// right split is the one whose unique name ends in the display name before it.
+func splitLegacyFileContent(content string) (string, string) {
+	matches := legacyStoredNamePattern.FindAllStringIndex(content, -1)
+	for _, match := range matches {
+		name := content[:match[0]]
+		if content[match[1]:] == name {
+			return name, content[match[0]+1:]
+		}
+	}
+	// Names that don't repeat, split at the last stored name or separator
+	if len(matches) > 0 {
+		i := matches[len(matches)-1][0]
+		return content[:i], content[i+1:]
+	}
+	if i := strings.LastIndex(content, "|"); i >= 0 {
+		return content[:i], content[i+1:]
+	}
+	return content, content
+}
+
+// Upgrade an item to the current schema, false if it already is
+func migrateItem(item Item) (Item, bool) {
+	if item.Schema >= itemSchemaVersion {
+		return item, false
+	}
+
+	// 1 -> 2: split "display|unique" into the display and stored names
+	if item.Type == "file" && item.File == nil {
+		name, storedName := splitLegacyFileContent(item.Content)
+
+		payload, err := newFilePayload(name, storedName)
+		if err != nil {
+			// The upload is gone or unreadable, keep what the item itself knows
+			fmt.Printf("[DEBUG] Migrate: No file details for item %s: %v\n", item.ID, err)
+			payload = &FilePayload{
+				Name:       name,
+				StoredName: storedName,
+				MIMEType:   mime.TypeByExtension(filepath.Ext(name)),
+			}
+		}
+		item.File = payload
+		item.Content = name
+	}
+	if item.Type == "text" && item.Link == nil {
+		item.Link = newLinkPayload(item.Content)
+	}
+
+	// 2 -> 3: move the upload to its content hash, duplicates collapse into one file
+	if item.File != nil && item.File.StoredName != "" && !isBlobName(item.File.StoredName) {
+		if name, err := adoptUpload(item.File); err != nil {
+			fmt.Printf("[DEBUG] Migrate: Keeping upload %s of item %s in place: %v\n", item.File.StoredName, item.ID, err)
+		} else {
+			item.File.StoredName = name
+		}
+	}
+
+	// 3 -> 4: links get their own type, previews are only fetched for new links
+	if item.Type == "text" && item.Link != nil {
+		item.Type = "link"
+	}
+
+	item.Schema = itemSchemaVersion
+	return item, true
+}
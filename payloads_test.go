@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewLinkPayload(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // expected host, "" for no link
+	}{
+		{"https://example.com/watch?v=1", "example.com"},
+		{"  http://192.168.1.5:8000/mobile/ \n", "192.168.1.5"},
+		{"see https://example.com", ""},
+		{"example.com", ""},
+		{"ftp://example.com/file", ""},
+		{"https://", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		link := newLinkPayload(tt.in)
+		host := ""
+		if link != nil {
+			host = link.Host
+		}
+		if host != tt.want {
+			t.Errorf("newLinkPayload(%q) host = %q, want %q", tt.in, host, tt.want)
+		}
+	}
+}
+
+func TestSplitLegacyFileContent(t *testing.T) {
+	tests := []struct {
+		content    string
+		name       string
+		storedName string
+	}{
+		{"photo.jpg|item_1712345678901234567_photo.jpg", "photo.jpg", "item_1712345678901234567_photo.jpg"},
+		{"a|b.txt|item_1_a|b.txt", "a|b.txt", "item_1_a|b.txt"},
+		{"x|item_2_y.txt|item_3_x|item_2_y.txt", "x|item_2_y.txt", "item_3_x|item_2_y.txt"},
+		{"item_5_|item_9_item_5_", "item_5_", "item_9_item_5_"},
+		// Sanitized stored names no longer repeat the display name
+		{"a|b.txt|item_1_a_b.txt", "a|b.txt", "item_1_a_b.txt"},
+		{"name|stored", "name", "stored"},
+		{"plain.txt", "plain.txt", "plain.txt"},
+	}
+	for _, tt := range tests {
+		name, storedName := splitLegacyFileContent(tt.content)
+		if name != tt.name || storedName != tt.storedName {
+			t.Errorf("splitLegacyFileContent(%q) = %q, %q; want %q, %q", tt.content, name, storedName, tt.name, tt.storedName)
+		}
+	}
+}
+
+func TestMigrateItem(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadsDir, "item_1_a|b.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Names from before sanitizing could contain the separator, on both sides
+	item, ok := migrateItem(Item{ID: "item_1", Type: "file", Content: "a|b.txt|item_1_a|b.txt"})
+	if !ok {
+		t.Fatal("version 1 file item not migrated")
+	}
+	if item.Schema != itemSchemaVersion || item.Content != "a|b.txt" || item.File == nil {
+		t.Fatalf("migrated item = %+v", item)
+	}
+	// The upload moves to its content hash
+	want := FilePayload{
+		Name:       "a|b.txt",
+		StoredName: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Size:       5,
+		MIMEType:   "text/plain; charset=utf-8",
+		SHA256:     "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+	}
+	if *item.File != want {
+		t.Errorf("file payload = %+v, want %+v", *item.File, want)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, want.StoredName)); err != nil {
+		t.Errorf("upload not moved to its blob: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, "item_1_a|b.txt")); !os.IsNotExist(err) {
+		t.Errorf("old upload still there: %v", err)
+	}
+
+	// A missing upload still gets a payload from the item itself
+	item, _ = migrateItem(Item{ID: "item_2", Type: "file", Content: "gone.pdf|item_2_gone.pdf"})
+	if item.File == nil || item.File.StoredName != "item_2_gone.pdf" || item.File.SHA256 != "" {
+		t.Errorf("missing file payload = %+v", item.File)
+	}
+
+	item, _ = migrateItem(Item{ID: "item_3", Type: "text", Content: "https://example.com"})
+	if item.Type != "link" || item.Link == nil || item.Link.URL != "https://example.com" {
+		t.Errorf("link item = %+v", item)
+	}
+
+	if _, ok := migrateItem(item); ok {
+		t.Errorf("current item migrated again")
+	}
+}
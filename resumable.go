@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partial uploads live in their own folder so clear-history and downloads never see them.
+// Every chunk is stored as its own segment file, written through
+// createStoredFile so it is encrypted like any other upload; finalizing joins
+// the segments into one file for the blob store.
+var partialUploadsDir = filepath.Join(uploadsDir, "partial")
+
+// Unfinished uploads untouched for this long are removed by the retention sweeper
+const partialUploadExpiry = 24 * time.Hour
+
+// Resumable upload state structure, stored next to the partial files
+type ResumableUpload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	From      string    `json:"from"`
+	DeviceID  string    `json:"deviceId,omitempty"`
+	To        []string  `json:"to,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Lock for one upload, counting the requests that hold or wait for it
+type resumableLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	// One lock per upload so chunks for the same upload are applied in order,
+	// kept only while a request uses it so unknown IDs leave nothing behind
+	resumableLocks      = make(map[string]*resumableLock)
+	resumableLocksMutex sync.Mutex
+)
+
+func lockResumableUpload(id string) func() {
+	resumableLocksMutex.Lock()
+	lock, ok := resumableLocks[id]
+	if !ok {
+		lock = &resumableLock{}
+		resumableLocks[id] = lock
+	}
+	lock.refs++
+	resumableLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		resumableLocksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(resumableLocks, id)
+		}
+		resumableLocksMutex.Unlock()
+	}
+}
+
+// The joined upload, handed to the blob store when the upload is finalized
+func partialDataPath(id string) string {
+	return filepath.Join(partialUploadsDir, id+".part")
+}
+
+// The segment holding the chunk that starts at offset
+func partialSegmentPath(id string, offset int64) string {
+	return filepath.Join(partialUploadsDir, fmt.Sprintf("%s.%d.part", id, offset))
+}
+
+// Start offsets of the stored segments of an upload, in order
+func partialSegments(id string) ([]int64, error) {
+	paths, err := filepath.Glob(filepath.Join(partialUploadsDir, id+".*.part"))
+	if err != nil {
+		return nil, err
+	}
+	var offsets []int64
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), id+"."), ".part")
+		if offset, err := strconv.ParseInt(name, 10, 64); err == nil && offset >= 0 {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	// Uploads started before segments were kept in a single file
+	if len(offsets) == 0 {
+		if err := os.Rename(partialDataPath(id), partialSegmentPath(id, 0)); err == nil {
+			offsets = append(offsets, 0)
+		}
+	}
+	return offsets, nil
+}
+
+func partialInfoPath(id string) string {
+	return filepath.Join(partialUploadsDir, id+".json")
+}
+
+func loadResumableUpload(id string) (*ResumableUpload, error) {
+	fileData, err := os.ReadFile(partialInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var upload ResumableUpload
+	if err := json.Unmarshal(fileData, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func saveResumableUpload(upload *ResumableUpload) error {
+	jsonData, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(partialInfoPath(upload.ID), jsonData, 0644)
+}
+
+func removeResumableUpload(id string) {
+	offsets, _ := partialSegments(id)
+	for _, offset := range offsets {
+		os.Remove(partialSegmentPath(id, offset))
+	}
+	os.Remove(partialDataPath(id))
+	os.Remove(partialInfoPath(id))
+}
+
+// Handle resumable upload endpoints under /pc/uploads and /mobile/uploads:
+//
+//	POST   .../uploads                start an upload ({"filename", "size"})
+//	HEAD   .../uploads/{id}           current offset in the Upload-Offset header
+//	GET    .../uploads/{id}           upload state as JSON
+//	PUT    .../uploads/{id}           append a chunk at Upload-Offset
+//	POST   .../uploads/{id}/finalize  turn the completed upload into an item
+//	DELETE .../uploads/{id}           abort and remove the partial files
+func handleResumableUpload(w http.ResponseWriter, r *http.Request, from string) {
+	fmt.Printf("[DEBUG] Resumable upload endpoint called - From: %s, Method: %s, URL: %s\n", from, r.Method, r.URL.Path)
+
+	rest := r.URL.Path[strings.Index(r.URL.Path, "/uploads")+len("/uploads"):]
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createResumableUpload(w, r, from)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	if !isValidUploadID(id) {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockResumableUpload(id)
+	defer unlock()
+
+	upload, err := loadResumableUpload(id)
+	if os.IsNotExist(err) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Error loading upload %s: %v\n", id, err)
+		http.Error(w, "Error loading upload", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && (r.Method == "HEAD" || r.Method == "GET"):
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upload)
+	case action == "" && (r.Method == "PUT" || r.Method == "PATCH"):
+		appendResumableChunk(w, r, upload)
+	case action == "" && r.Method == "DELETE":
+		removeResumableUpload(id)
+		fmt.Printf("[DEBUG] Resumable upload: Aborted upload %s\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "finalize" && r.Method == "POST":
+		finalizeResumableUpload(w, upload)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func isValidUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Start a new resumable upload
+func createResumableUpload(w http.ResponseWriter, r *http.Request, from string) {
+	var createData struct {
+		Filename string   `json:"filename"`
+		Size     int64    `json:"size"`
+		To       []string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&createData); err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Invalid JSON: %v\n", err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if createData.Filename == "" || createData.Size < 0 {
+		http.Error(w, "Filename and size are required", http.StatusBadRequest)
+		return
+	}
+	if limit := maxUploadBytes(); limit > 0 && createData.Size > limit {
+		fmt.Printf("[ERROR] Resumable upload: Declared size %d exceeds limit\n", createData.Size)
+		uploadTooLarge(w)
+		return
+	}
+
+	device := requestDevice(r)
+	to, err := parseTargets(createData.To, device)
+	if err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Invalid targets: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.MkdirAll(partialUploadsDir, 0755); err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Failed to create partial directory: %v\n", err)
+		http.Error(w, "Unable to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "Unable to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	upload := &ResumableUpload{
+		ID:        id,
+		Filename:  sanitizeFilename(createData.Filename),
+		Size:      createData.Size,
+		From:      from,
+		To:        to,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if device != nil {
+		upload.DeviceID = device.ID
+	}
+
+	if err := saveResumableUpload(upload); err != nil {
+		removeResumableUpload(id)
+		fmt.Printf("[ERROR] Resumable upload: Unable to save upload state: %v\n", err)
+		http.Error(w, "Unable to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[DEBUG] Resumable upload: Started upload %s for '%s' (%d bytes)\n", id, upload.Filename, upload.Size)
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// Append a chunk at the client's offset, which must match what the server has
+func appendResumableChunk(w http.ResponseWriter, r *http.Request, upload *ResumableUpload) {
+	offsetValue := r.Header.Get("Upload-Offset")
+	if offsetValue == "" {
+		offsetValue = r.URL.Query().Get("offset")
+	}
+	offset, err := strconv.ParseInt(offsetValue, 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		// The client lost track, tell it where to continue from
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, fmt.Sprintf("Offset mismatch, server has %d bytes", upload.Offset), http.StatusConflict)
+		return
+	}
+
+	// Drop anything past the acknowledged offset left over from an interrupted chunk
+	offsets, err := partialSegments(upload.ID)
+	if err != nil {
+		http.Error(w, "Unable to save chunk", http.StatusInternalServerError)
+		return
+	}
+	for _, start := range offsets {
+		if start >= upload.Offset {
+			os.Remove(partialSegmentPath(upload.ID, start))
+		}
+	}
+
+	segmentPath := partialSegmentPath(upload.ID, upload.Offset)
+	segment, err := createStoredFile(segmentPath)
+	if err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Unable to create partial file: %v\n", err)
+		http.Error(w, "Unable to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	remaining := upload.Size - upload.Offset
+	written, copyErr := io.Copy(segment, io.LimitReader(r.Body, remaining+1))
+	// Closing writes the end of an encrypted segment, also after an interrupted copy
+	if closeErr := segment.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr == nil && written > remaining {
+		os.Remove(segmentPath)
+		http.Error(w, "Chunk goes past the declared upload size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if written == 0 {
+		os.Remove(segmentPath)
+	} else if syncErr := syncFile(segmentPath); copyErr == nil {
+		copyErr = syncErr
+	}
+
+	// Keep whatever arrived before a dropped connection so the client can resume from there
+	upload.Offset += written
+	upload.UpdatedAt = time.Now()
+	if err := saveResumableUpload(upload); err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Unable to save upload state: %v\n", err)
+		http.Error(w, "Unable to save chunk", http.StatusInternalServerError)
+		return
+	}
+
+	if copyErr != nil {
+		fmt.Printf("[DEBUG] Resumable upload: Chunk for %s interrupted at %d bytes: %v\n", upload.ID, upload.Offset, copyErr)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, "Chunk interrupted", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("[DEBUG] Resumable upload: %s at %d/%d bytes\n", upload.ID, upload.Offset, upload.Size)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Move a completed upload into the uploads folder and create its item
+func finalizeResumableUpload(w http.ResponseWriter, upload *ResumableUpload) {
+	if upload.Offset != upload.Size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		http.Error(w, fmt.Sprintf("Upload incomplete, %d of %d bytes received", upload.Offset, upload.Size), http.StatusConflict)
+		return
+	}
+
+	if err := joinPartialUpload(upload); err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Unable to join upload %s: %v\n", upload.ID, err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+
+	storedName, err := blobStore.Ingest(partialDataPath(upload.ID))
+	if err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Unable to store completed file: %v\n", err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+
+	// The data has moved to the blob store, the upload can't be finalized twice
+	removeResumableUpload(upload.ID)
+
+	// The device may have been revoked since the upload started
+	device, _ := authManager.Device(upload.DeviceID)
+	item, err := addFileItem(upload.From, device, upload.To, upload.Filename, storedName)
+	if err != nil {
+		fmt.Printf("[ERROR] Resumable upload: Error saving data: %v\n", err)
+		blobStore.Release(storedName)
+		http.Error(w, "Error saving data", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[DEBUG] Resumable upload: Finalized %s as item %s\n", upload.ID, item.ID)
+
+	// Only now does the file show up for everyone
+	publishItemAdded(item)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"id":     item.ID,
+		"url":    fileDownloadURL(item),
+		"size":   upload.Size,
+		"file":   item.File,
+	})
+}
+
+// Join the segments of a completed upload into one file at partialDataPath
+func joinPartialUpload(upload *ResumableUpload) error {
+	offsets, err := partialSegments(upload.ID)
+	if err != nil {
+		return err
+	}
+	out, err := createStoredFile(partialDataPath(upload.ID))
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, start := range offsets {
+		if start >= upload.Offset {
+			break
+		}
+		if start != size {
+			err = fmt.Errorf("segment at %d, expected %d", start, size)
+			break
+		}
+		var segment *StoredFile
+		if segment, err = openStoredFile(partialSegmentPath(upload.ID, start)); err != nil {
+			break
+		}
+		var n int64
+		n, err = io.Copy(out, segment)
+		segment.Close()
+		size += n
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size != upload.Size {
+		err = fmt.Errorf("segments hold %d of %d bytes", size, upload.Size)
+	}
+	if err != nil {
+		os.Remove(partialDataPath(upload.ID))
+	}
+	return err
+}
+
+// Flush a written file to disk before its data is acknowledged
+func syncFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Remove partial uploads that were abandoned
+func cleanupStalePartialUploads() (int, error) {
+	entries, err := os.ReadDir(partialUploadsDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		unlock := lockResumableUpload(id)
+		upload, err := loadResumableUpload(id)
+		if err == nil && time.Since(upload.UpdatedAt) > partialUploadExpiry ||
+			err != nil && !errors.Is(err, os.ErrNotExist) {
+			removeResumableUpload(id)
+			removed++
+		}
+		unlock()
+	}
+
+	if removed > 0 {
+		fmt.Printf("[DEBUG] Removed %d stale partial uploads\n", removed)
+	}
+	return removed, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func lockedUploads() int {
+	resumableLocksMutex.Lock()
+	defer resumableLocksMutex.Unlock()
+	return len(resumableLocks)
+}
+
+func TestResumableUploadLocks(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// Probing unknown IDs leaves no locks behind
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handleResumableUpload(w, httptest.NewRequest("HEAD", fmt.Sprintf("/pc/uploads/%032x", i), nil), "PC")
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("unknown upload: status %d", w.Code)
+		}
+	}
+	if n := lockedUploads(); n != 0 {
+		t.Errorf("%d locks left after probing unknown uploads", n)
+	}
+
+	// Requests for the same upload take turns, the lock goes with the last one
+	unlock := lockResumableUpload("abc")
+	var order []string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		release := lockResumableUpload("abc")
+		mutex.Lock()
+		order = append(order, "second")
+		mutex.Unlock()
+		release()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	mutex.Lock()
+	order = append(order, "first")
+	mutex.Unlock()
+	if n := lockedUploads(); n != 1 {
+		t.Errorf("%d locks while the upload is in use, want 1", n)
+	}
+	unlock()
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "first" {
+		t.Errorf("lock order = %v", order)
+	}
+	if n := lockedUploads(); n != 0 {
+		t.Errorf("%d locks left after the last request", n)
+	}
+}
+
+// Send a resumable upload request and return the response
+func resumableRequest(t *testing.T, method, path, offset, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if offset != "" {
+		r.Header.Set("Upload-Offset", offset)
+	}
+	w := httptest.NewRecorder()
+	handleResumableUpload(w, r, "PC")
+	return w
+}
+
+func TestResumableUploadEncrypted(t *testing.T) {
+	useTestItemStore(t)
+	useTestBlobStore(t)
+	useTestStorageKey(t)
+
+	w := resumableRequest(t, "POST", "/pc/uploads", "", `{"filename":"notes.txt","size":11}`)
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil || created.ID == "" {
+		t.Fatalf("create: status %d, err %v", w.Code, err)
+	}
+	path := "/pc/uploads/" + created.ID
+
+	putChunk := func(offset, data string) {
+		t.Helper()
+		if w := resumableRequest(t, "PUT", path, offset, data); w.Code != http.StatusNoContent {
+			t.Fatalf("chunk at %s: status %d", offset, w.Code)
+		}
+	}
+	putChunk("0", "secret")
+	putChunk("6", " no")
+
+	// A chunk written but never acknowledged is replaced when the client resends it
+	upload, _ := loadResumableUpload(created.ID)
+	upload.Offset = 6
+	saveResumableUpload(upload)
+	putChunk("6", " note")
+
+	// No chunk is on disk in plaintext
+	segments, _ := filepath.Glob(filepath.Join(partialUploadsDir, created.ID+".*.part"))
+	if len(segments) != 2 {
+		t.Errorf("segments = %v", segments)
+	}
+	for _, segment := range segments {
+		if !isEncryptedFile(segment) {
+			t.Errorf("segment %s stored in plaintext", segment)
+		}
+	}
+
+	w = resumableRequest(t, "POST", path+"/finalize", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("finalize: status %d, body %s", w.Code, w.Body)
+	}
+	items := itemStore.List()
+	if len(items) != 1 || items[0].File == nil {
+		t.Fatalf("items = %+v", items)
+	}
+	file, err := openStoredFile(filepath.Join(uploadsDir, items[0].File.StoredName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if got, _ := io.ReadAll(file); string(got) != "secret note" {
+		t.Errorf("finalized upload = %q", got)
+	}
+	if left := folderFiles(partialUploadsDir); left != "" {
+		t.Errorf("partial files left after finalize: %s", left)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, items[0].File.SHA256)); !os.IsNotExist(err) {
+		t.Errorf("upload stored under its plain checksum")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How often the retention sweeper checks for expired items
+const retentionSweepInterval = 1 * time.Hour
+
+// Retention sweep statistics structure
+type RetentionStats struct {
+	LastRun       time.Time `json:"lastRun"`
+	Duration      string    `json:"duration"`
+	RetentionDays int       `json:"retentionDays"`
+	ItemsRemoved  int       `json:"itemsRemoved"`
+	FilesRemoved  int       `json:"filesRemoved"`
+	BytesFreed    int64     `json:"bytesFreed"`
+	Error         string    `json:"error,omitempty"`
+}
+
+var (
+	lastRetentionStats *RetentionStats
+	retentionMutex     sync.Mutex
+)
+
+// Start the background retention sweeper
+func startRetentionSweeper() {
+	fmt.Printf("[INFO] Retention sweeper started (interval: %v)\n", retentionSweepInterval)
+
+	go func() {
+		// Run once on startup so expired items don't wait for the first tick
+		for {
+			runRetentionSweep(currentSettings().DataRetention)
+			if _, err := cleanupStalePartialUploads(); err != nil {
+				fmt.Printf("[ERROR] Retention: Failed to clean partial uploads: %v\n", err)
+			}
+			time.Sleep(retentionSweepInterval)
+		}
+	}()
+}
+
+// Remove items older than retentionDays, 0 keeps everything
+func runRetentionSweep(retentionDays int) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	start := time.Now()
+	stats := RetentionStats{
+		LastRun:       start,
+		RetentionDays: retentionDays,
+	}
+
+	defer func() {
+		stats.Duration = time.Since(start).String()
+		lastRetentionStats = &stats
+	}()
+
+	if retentionDays <= 0 {
+		fmt.Printf("[DEBUG] Retention: Disabled, nothing to do\n")
+		return
+	}
+
+	cutoff := start.Add(-time.Duration(retentionDays) * 24 * time.Hour)
+	fmt.Printf("[DEBUG] Retention: Removing items older than %s\n", cutoff.Format(time.RFC3339))
+
+	expired, err := itemStore.DeleteFunc(func(item Item) bool {
+		return item.Timestamp.Before(cutoff)
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] Retention: Error deleting items: %v\n", err)
+		stats.Error = err.Error()
+		return
+	}
+	if len(expired) == 0 {
+		fmt.Printf("[DEBUG] Retention: No expired items\n")
+		return
+	}
+	stats.ItemsRemoved = len(expired)
+
+	// Delete backing files only after the items are gone from the store
+	for _, item := range expired {
+		if item.Type != "file" {
+			continue
+		}
+		size, err := removeUploadedFile(item)
+		if err != nil {
+			fmt.Printf("[ERROR] Retention: Failed to delete file for item %s: %v\n", item.ID, err)
+			stats.Error = err.Error()
+			continue
+		}
+		if size >= 0 {
+			stats.FilesRemoved++
+			stats.BytesFreed += size
+		}
+	}
+
+	fmt.Printf("[INFO] Retention: Removed %d items and %d files (%d bytes)\n", stats.ItemsRemoved, stats.FilesRemoved, stats.BytesFreed)
+
+	for _, item := range expired {
+		publishItemDeleted(item)
+	}
+}
+
+// Get a copy of the last retention sweep stats, nil if it never ran
+func getRetentionStats() *RetentionStats {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	if lastRetentionStats == nil {
+		return nil
+	}
+	stats := *lastRetentionStats
+	return &stats
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunRetentionSweep(t *testing.T) {
+	useTestItemStore(t)
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	savedBlobs := blobStore
+	blobStore = NewBlobStore()
+	t.Cleanup(func() { blobStore = savedBlobs })
+
+	addFile := func(id, content string, age time.Duration) Item {
+		t.Helper()
+		path := filepath.Join(uploadsDir, id+".txt")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := blobStore.Ingest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		item := Item{ID: id, Timestamp: time.Now().Add(-age), From: "PC", Type: "file",
+			File: &FilePayload{Name: id + ".txt", StoredName: stored, Size: int64(len(content))}}
+		if err := itemStore.Add(item); err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	day := 24 * time.Hour
+
+	old := addFile("item_1", "old file", 10*day)
+	shared := addFile("item_2", "shared", 10*day)
+	addFile("item_3", "shared", day) // keeps the shared blob alive
+	itemStore.Add(Item{ID: "item_4", Timestamp: time.Now().Add(-10 * day), From: "PC", Type: "text", Content: "old"})
+	itemStore.Add(Item{ID: "item_5", Timestamp: time.Now(), From: "PC", Type: "text", Content: "new"})
+
+	// Disabled retention keeps everything
+	runRetentionSweep(0)
+	if stats := getRetentionStats(); stats == nil || stats.ItemsRemoved != 0 || len(itemStore.List()) != 5 {
+		t.Fatalf("disabled sweep: stats %+v, %d items", stats, len(itemStore.List()))
+	}
+
+	runRetentionSweep(7)
+	stats := getRetentionStats()
+	if stats.RetentionDays != 7 || stats.ItemsRemoved != 3 || stats.FilesRemoved != 1 || stats.BytesFreed != int64(len("old file")) || stats.Error != "" {
+		t.Errorf("stats = %+v", stats)
+	}
+	for _, id := range []string{"item_1", "item_2", "item_4"} {
+		if _, ok := itemStore.Get(id); ok {
+			t.Errorf("expired item %s kept", id)
+		}
+	}
+	if len(itemStore.List()) != 2 {
+		t.Errorf("store holds %d items, want 2", len(itemStore.List()))
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadsDir, old.File.StoredName)); !os.IsNotExist(err) {
+		t.Errorf("file of an expired item still on disk: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, shared.File.StoredName)); err != nil {
+		t.Errorf("file still used by a newer item deleted: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Page sizes for search results
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+// Longest query accepted and the terms used from it
+const (
+	maxSearchQueryLength = 256
+	maxSearchTerms       = 10
+)
+
+// Characters of context shown around the first match
+const searchSnippetContext = 60
+const searchSnippetLength = 200
+
+// Weight of a term that only matches the start of a word, relative to a whole-word match
+const searchPrefixWeight = 0.5
+
+// Inverted index over item text and file display names. Every query term must
+// match a word, either whole or as its prefix, so results show up while typing.
+type SearchIndex struct {
+	postings map[string]map[string]int // term -> item ID -> occurrences
+	lengths  map[string]int            // item ID -> number of terms
+	terms    map[string][]string       // item ID -> distinct terms, to remove it again
+	mutex    sync.RWMutex
+}
+
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		postings: make(map[string]map[string]int),
+		lengths:  make(map[string]int),
+		terms:    make(map[string][]string),
+	}
+}
+
+var searchIndex = NewSearchIndex()
+
+// One search hit. Highlight is HTML: escaped text around the first match,
+// with every matching word wrapped in <mark>.
+type SearchResult struct {
+	Item      Item    `json:"item"`
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight"`
+}
+
+// A page of search results, best first
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	HasMore bool           `json:"hasMore"`
+	Results []SearchResult `json:"results"`
+}
+
+// Text of an item that is searchable: the message and its link preview, or the
+// name a file was sent with. Encrypted messages are ciphertext to the server
+// and can't be searched.
+func itemSearchText(item Item) string {
+	if item.File != nil {
+		return item.File.Name
+	}
+	if item.E2E != nil {
+		return ""
+	}
+	if item.Link != nil {
+		return strings.Join([]string{item.Content, item.Link.Title, item.Link.Description}, "\n")
+	}
+	return item.Content
+}
+
+// A word in a text, with its byte offsets
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+// Split text into lowercase words of letters and digits
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			tokens = append(tokens, searchToken{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// Rebuild the index from every stored item
+func (s *SearchIndex) Rebuild(items []Item) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.postings = make(map[string]map[string]int)
+	s.lengths = make(map[string]int)
+	s.terms = make(map[string][]string)
+	for _, item := range items {
+		s.add(item)
+	}
+	fmt.Printf("[DEBUG] Search: Indexed %d items, %d terms\n", len(s.lengths), len(s.postings))
+}
+
+// Index a new or changed item
+func (s *SearchIndex) Add(item Item) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(item.ID)
+	s.add(item)
+}
+
+// Drop an item from the index
+func (s *SearchIndex) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(id)
+}
+
+// Drop every item from the index
+func (s *SearchIndex) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.postings = make(map[string]map[string]int)
+	s.lengths = make(map[string]int)
+	s.terms = make(map[string][]string)
+}
+
+// Caller must hold the mutex
+func (s *SearchIndex) add(item Item) {
+	tokens := tokenize(itemSearchText(item))
+	var terms []string
+	for _, token := range tokens {
+		postings, ok := s.postings[token.term]
+		if !ok {
+			postings = make(map[string]int)
+			s.postings[token.term] = postings
+		}
+		if postings[item.ID] == 0 {
+			terms = append(terms, token.term)
+		}
+		postings[item.ID]++
+	}
+	s.lengths[item.ID] = len(tokens)
+	s.terms[item.ID] = terms
+}
+
+// Caller must hold the mutex. Terms come from the list kept when the item was
+// indexed, the item itself may already be gone from the store.
+func (s *SearchIndex) remove(id string) {
+	if _, ok := s.lengths[id]; !ok {
+		return
+	}
+	for _, term := range s.terms[id] {
+		postings := s.postings[term]
+		delete(postings, id)
+		if len(postings) == 0 {
+			delete(s.postings, term)
+		}
+	}
+	delete(s.lengths, id)
+	delete(s.terms, id)
+}
+
+// Score every item containing all query terms, whole words count more than
+// prefixes and rare words more than common ones
+func (s *SearchIndex) Search(terms []string) map[string]float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	documents := float64(len(s.lengths))
+	var scores map[string]float64
+	for _, queryTerm := range terms {
+		termScores := make(map[string]float64)
+		for term, postings := range s.postings {
+			if !strings.HasPrefix(term, queryTerm) {
+				continue
+			}
+			weight := 1.0
+			if term != queryTerm {
+				weight = searchPrefixWeight
+			}
+			idf := math.Log(1 + documents/float64(len(postings)))
+			for id, count := range postings {
+				// Damp repeated words and long messages
+				tf := float64(count) / math.Sqrt(float64(s.lengths[id]))
+				termScores[id] += weight * tf * idf
+			}
+		}
+
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for id, score := range scores {
+			if termScore, ok := termScores[id]; ok {
+				scores[id] = score + termScore
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// Split a query into distinct search terms
+func searchTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, token := range tokenize(query) {
+		if seen[token.term] {
+			continue
+		}
+		seen[token.term] = true
+		terms = append(terms, token.term)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// Cut a snippet around the first matching word and mark every match in it
+func highlightMatches(text string, terms []string) string {
+	var matches []searchToken
+	for _, token := range tokenize(text) {
+		for _, term := range terms {
+			if strings.HasPrefix(token.term, term) {
+				matches = append(matches, token)
+				break
+			}
+		}
+	}
+
+	start, end := 0, len(text)
+	if len(matches) > 0 && len(text) > searchSnippetLength {
+		start = max(0, matches[0].start-searchSnippetContext)
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		end = min(len(text), start+searchSnippetLength)
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+	} else if len(text) > searchSnippetLength {
+		end = searchSnippetLength
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end++
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	position := start
+	for _, match := range matches {
+		if match.start < start || match.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[position:match.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[match.start:match.end]))
+		b.WriteString("</mark>")
+		position = match.end
+	}
+	b.WriteString(html.EscapeString(text[position:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// Handle search endpoint: GET /search?q=...&limit=20&offset=0
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Search endpoint called - Method: %s\n", r.Method)
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	values := r.URL.Query()
+	query := strings.TrimSpace(values.Get("q"))
+	if query == "" {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+	if len(query) > maxSearchQueryLength {
+		http.Error(w, fmt.Sprintf("Search query is too long (max %d characters)", maxSearchQueryLength), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchPageSize
+	if value := values.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchPageSize)
+	}
+	offset := 0
+	if value := values.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	page := searchItems(requestDevice(r), query, limit, offset)
+	fmt.Printf("[DEBUG] Search: %d results for %q\n", page.Total, query)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// Rank the items a device may see for a query and return one page of them
+func searchItems(device *PairedDevice, query string, limit, offset int) SearchPage {
+	page := SearchPage{Query: query, Offset: offset, Results: []SearchResult{}}
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return page
+	}
+
+	var results []SearchResult
+	for id, score := range searchIndex.Search(terms) {
+		item, ok := itemStore.Get(id)
+		if !ok || !itemVisibleTo(item, device) {
+			continue
+		}
+		results = append(results, SearchResult{Item: item, Score: score})
+	}
+
+	// Best match first, newer first among equals
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Item.Timestamp.After(results[j].Item.Timestamp)
+	})
+
+	page.Total = len(results)
+	if offset >= len(results) {
+		return page
+	}
+	end := min(len(results), offset+limit)
+	page.HasMore = end < len(results)
+	page.Results = results[offset:end]
+	for i := range page.Results {
+		page.Results[i].Highlight = highlightMatches(itemSearchText(page.Results[i].Item), terms)
+	}
+	return page
+}
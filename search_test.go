@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("See https://Example.com/a-b, Ünïcode 42!")
+	var terms []string
+	for _, token := range tokens {
+		terms = append(terms, token.term)
+	}
+	want := []string{"see", "https", "example", "com", "a", "b", "ünïcode", "42"}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("tokenize terms = %q, want %q", terms, want)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	index := NewSearchIndex()
+	index.Add(Item{ID: "a", Type: "text", Content: "meeting notes for tomorrow"})
+	index.Add(Item{ID: "b", Type: "text", Content: "notes"})
+	index.Add(Item{ID: "c", Type: "file", Content: "Meeting Slides.pdf", File: &FilePayload{
+		Name:       "Meeting Slides.pdf",
+		StoredName: "item_1_Meeting_Slides.pdf",
+	}})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"notes", []string{"a", "b"}},
+		{"meet", []string{"a", "c"}},
+		{"meeting notes", []string{"a"}},
+		{"item_1", nil}, // stored file names are not searchable
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		scores := index.Search(searchTerms(tt.query))
+		var got []string
+		for _, id := range []string{"a", "b", "c"} {
+			if _, ok := scores[id]; ok {
+				got = append(got, id)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// A short message that is all match ranks above a long one
+	scores := index.Search(searchTerms("notes"))
+	if scores["b"] <= scores["a"] {
+		t.Errorf("score of exact short match %f not above %f", scores["b"], scores["a"])
+	}
+
+	index.Remove("b")
+	if _, ok := index.Search(searchTerms("notes"))["b"]; ok {
+		t.Errorf("removed item still found")
+	}
+
+	// Re-adding an item replaces its old text
+	index.Add(Item{ID: "a", Type: "text", Content: "agenda"})
+	if _, ok := index.Search(searchTerms("meeting"))["a"]; ok {
+		t.Errorf("edited item still found by its old text")
+	}
+
+	// Removing only touches the item's own terms and leaves nothing behind
+	index.Add(Item{ID: "d", Type: "text", Content: "notes notes agenda"})
+	index.Remove("d")
+	index.Remove("c")
+	index.Remove("a")
+	if len(index.postings) != 0 || len(index.lengths) != 0 || len(index.terms) != 0 {
+		t.Errorf("index left after removing every item: %v %v %v", index.postings, index.lengths, index.terms)
+	}
+}
+
+func TestHighlightMatches(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"Hello World", []string{"wor"}, "Hello <mark>World</mark>"},
+		{"<b>bold</b> move", []string{"bold"}, "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; move"},
+		{"nothing here", []string{"zzz"}, "nothing here"},
+	}
+	for _, tt := range tests {
+		if got := highlightMatches(tt.text, tt.terms); got != tt.want {
+			t.Errorf("highlightMatches(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
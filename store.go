@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const itemsLogFile = "memory/items.log"
+
+// Compact the journal once it holds this many more entries than live items
+const journalCompactSlack = 500
+
+var errItemNotFound = errors.New("item not found")
+
+var lastIDNanos atomic.Int64
+
+// Current time in nanoseconds, bumped so that concurrent callers never collide
+func uniqueNanos() int64 {
+	for {
+		now := time.Now().UnixNano()
+		last := lastIDNanos.Load()
+		if now <= last {
+			now = last + 1
+		}
+		if lastIDNanos.CompareAndSwap(last, now) {
+			return now
+		}
+	}
+}
+
+// ItemStore is the storage layer for flow items
+type ItemStore interface {
+	// List returns a copy of all items in insertion order
+	List() []Item
+	// Get returns a single item by ID
+	Get(id string) (Item, bool)
+	// Add appends a new item
+	Add(item Item) error
+	// Update replaces an existing item with the same ID
+	Update(item Item) error
+	// UpdateFunc changes an item in place and stores it, all under the store
+	// lock; nothing is stored when change returns an error
+	UpdateFunc(id string, change func(item *Item) error) (Item, error)
+	// Delete removes a single item by ID
+	Delete(id string) (Item, error)
+	// DeleteFunc removes every item matching the predicate and returns them
+	DeleteFunc(match func(Item) bool) ([]Item, error)
+	// Clear removes every item and returns them
+	Clear() ([]Item, error)
+	// Close flushes and releases the backend
+	Close() error
+}
+
+// Journal entry structure, one JSON object per line in the items log
+type journalEntry struct {
+	Op   string `json:"op"`
+	Item *Item  `json:"item,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+const (
+	journalOpPut    = "put"
+	journalOpDelete = "delete"
+	journalOpClear  = "clear"
+)
+
+// JournalStore keeps items in memory and persists every change to an
+// append-only log that is compacted into a fresh snapshot from time to time
+type JournalStore struct {
+	path    string
+	file    *os.File
+	items   []Item
+	index   map[string]int
+	entries int
+	mutex   sync.RWMutex
+}
+
+var itemStore ItemStore
+
+// Open the item store, migrating the legacy data file on first start
+func openItemStore() error {
+	store, err := NewJournalStore(itemsLogFile)
+	if err != nil {
+		return err
+	}
+	// The open compacted the store, with encryption on it is sealed now
+	if err := markJournalSealed(); err != nil {
+		return err
+	}
+	if err := rekeyBlobNames(store); err != nil {
+		return err
+	}
+	itemStore = store
+	searchIndex.Rebuild(store.List())
+	blobStore.Rebuild(store.List())
+	clipboard.Rebuild(store.List())
+	return nil
+}
+
+func NewJournalStore(path string) (*JournalStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	store := &JournalStore{
+		path:  path,
+		index: make(map[string]int),
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := store.migrateLegacyData(); err != nil {
+			return nil, err
+		}
+	} else if err := store.replay(); err != nil {
+		return nil, err
+	}
+
+	store.migrate()
+
+	// Always start from a compacted log so a torn final line is dropped,
+	// this also persists migrated items
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("[DEBUG] Item store opened: %s (%d items)\n", path, len(store.items))
+	return store, nil
+}
+
+// Import items from the old whole-file data.json
+func (s *JournalStore) migrateLegacyData() error {
+	fileData, err := os.ReadFile(dataFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read legacy data file: %w", err)
+	}
+
+	var data FlowData
+	if err := json.Unmarshal(fileData, &data); err != nil {
+		return fmt.Errorf("failed to parse legacy data file: %w", err)
+	}
+
+	for _, item := range data.Items {
+		s.apply(journalEntry{Op: journalOpPut, Item: &item})
+	}
+
+	// Write the new log before moving the old file out of the way
+	if err := s.compact(); err != nil {
+		return err
+	}
+	if err := os.Rename(dataFile, dataFile+".migrated"); err != nil {
+		return fmt.Errorf("failed to rename legacy data file: %w", err)
+	}
+
+	fmt.Printf("[INFO] Migrated %d items from %s\n", len(s.items), dataFile)
+	return nil
+}
+
+// Upgrade items written with an older schema
+func (s *JournalStore) migrate() {
+	migrated := 0
+	for i, item := range s.items {
+		if upgraded, ok := migrateItem(item); ok {
+			s.items[i] = upgraded
+			migrated++
+		}
+	}
+	if migrated > 0 {
+		fmt.Printf("[INFO] Item store: Migrated %d items to schema %d\n", migrated, itemSchemaVersion)
+	}
+}
+
+// Rebuild the in-memory cache from the journal
+func (s *JournalStore) replay() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to open item store: %w", err)
+	}
+	defer file.Close()
+
+	// Lines are read whole, however large, an item that was written can always be read back
+	reader := bufio.NewReader(file)
+	line := 0
+	for {
+		raw, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("failed to read item store: %w", readErr)
+		}
+		raw = bytes.TrimRight(raw, "\r\n")
+		line++
+		if len(raw) == 0 {
+			if readErr == io.EOF {
+				return nil
+			}
+			continue
+		}
+		data, err := decodeJournalLine(raw)
+		if err == errStorageLocked {
+			// Skipping would drop every item at the next compaction
+			return fmt.Errorf("item store is encrypted, storage encryption must be set up to open it")
+		}
+		if err == errPlaintextJournal {
+			// Sealed lines never start like JSON, not even torn ones
+			return fmt.Errorf("item store %s has a plaintext entry at line %d that the server did not write", s.path, line)
+		}
+		var entry journalEntry
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil {
+			// A torn write can only affect the last line, anything else is
+			// damage that compacting would turn into silent data loss
+			if readErr == io.EOF || atEOF(reader) {
+				fmt.Printf("[ERROR] Item store: Dropping torn entry at line %d: %v\n", line, err)
+				return nil
+			}
+			return fmt.Errorf("item store %s is corrupt at line %d: %w", s.path, line, err)
+		}
+		s.apply(entry)
+		s.entries++
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Check if nothing but line breaks is left to read
+func atEOF(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return true
+		}
+		if b != '\n' && b != '\r' {
+			reader.UnreadByte()
+			return false
+		}
+	}
+}
+
+// Apply a journal entry to the in-memory cache
+func (s *JournalStore) apply(entry journalEntry) {
+	switch entry.Op {
+	case journalOpPut:
+		if entry.Item == nil {
+			return
+		}
+		if i, ok := s.index[entry.Item.ID]; ok {
+			s.items[i] = *entry.Item
+			return
+		}
+		s.index[entry.Item.ID] = len(s.items)
+		s.items = append(s.items, *entry.Item)
+	case journalOpDelete:
+		i, ok := s.index[entry.ID]
+		if !ok {
+			return
+		}
+		s.items = append(s.items[:i], s.items[i+1:]...)
+		delete(s.index, entry.ID)
+		for j := i; j < len(s.items); j++ {
+			s.index[s.items[j].ID] = j
+		}
+	case journalOpClear:
+		s.items = nil
+		s.index = make(map[string]int)
+	}
+}
+
+// Append entries to the journal and fsync before touching the cache
+func (s *JournalStore) write(entries ...journalEntry) error {
+	if s.file == nil {
+		return errors.New("item store is closed")
+	}
+
+	var buf []byte
+	for _, entry := range entries {
+		line, err := encodeJournalEntry(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(buf)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// Cut off what made it to disk, a half-written line in the middle
+		// of the journal would stop it from being read back
+		if truncErr := s.file.Truncate(info.Size()); truncErr != nil {
+			fmt.Printf("[ERROR] Item store: Unable to undo failed write: %v\n", truncErr)
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		s.apply(entry)
+	}
+	s.entries += len(entries)
+
+	if s.entries > len(s.items)+journalCompactSlack {
+		if err := s.compact(); err != nil {
+			fmt.Printf("[ERROR] Item store: Compaction failed: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// Marshal a journal entry into one line, sealed when encryption is on
+func encodeJournalEntry(entry journalEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return encodeJournalLine(line)
+}
+
+// Rewrite the journal as one put per live item and swap it in atomically
+func (s *JournalStore) compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted store: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for i := range s.items {
+		line, err := encodeJournalEntry(journalEntry{Op: journalOpPut, Item: &s.items[i]})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	tmp.Close()
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		// Keep appending to the old journal, it still holds everything
+		if file, openErr := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600); openErr == nil {
+			s.file = file
+		}
+		return fmt.Errorf("failed to replace item store: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen item store: %w", err)
+	}
+	s.file = file
+	s.entries = len(s.items)
+	return nil
+}
+
+func (s *JournalStore) List() []Item {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	items := make([]Item, len(s.items))
+	copy(items, s.items)
+	return items
+}
+
+func (s *JournalStore) Get(id string) (Item, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i, ok := s.index[id]
+	if !ok {
+		return Item{}, false
+	}
+	return s.items[i], true
+}
+
+func (s *JournalStore) Add(item Item) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.index[item.ID]; ok {
+		return fmt.Errorf("item %s already exists", item.ID)
+	}
+	return s.write(journalEntry{Op: journalOpPut, Item: &item})
+}
+
+func (s *JournalStore) Update(item Item) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.index[item.ID]; !ok {
+		return errItemNotFound
+	}
+	return s.write(journalEntry{Op: journalOpPut, Item: &item})
+}
+
+func (s *JournalStore) UpdateFunc(id string, change func(item *Item) error) (Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i, ok := s.index[id]
+	if !ok {
+		return Item{}, errItemNotFound
+	}
+	item := s.items[i]
+	if err := change(&item); err != nil {
+		return Item{}, err
+	}
+	if err := s.write(journalEntry{Op: journalOpPut, Item: &item}); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+func (s *JournalStore) Delete(id string) (Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i, ok := s.index[id]
+	if !ok {
+		return Item{}, errItemNotFound
+	}
+	item := s.items[i]
+	if err := s.write(journalEntry{Op: journalOpDelete, ID: id}); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+func (s *JournalStore) DeleteFunc(match func(Item) bool) ([]Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var removed []Item
+	var entries []journalEntry
+	for _, item := range s.items {
+		if match(item) {
+			removed = append(removed, item)
+			entries = append(entries, journalEntry{Op: journalOpDelete, ID: item.ID})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if err := s.write(entries...); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *JournalStore) Clear() ([]Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := make([]Item, len(s.items))
+	copy(removed, s.items)
+	if err := s.write(journalEntry{Op: journalOpClear}); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (s *JournalStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Get a snapshot of all items in the flow
+func loadFlowData() FlowData {
+	return FlowData{Items: itemStore.List()}
+}
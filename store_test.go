@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Use a fresh item store and clipboard in a temporary folder for the rest of the test
+func useTestItemStore(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	store, err := NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedStore, savedClipboard := itemStore, clipboard
+	itemStore, clipboard = store, NewClipboard()
+	t.Cleanup(func() {
+		store.Close()
+		itemStore, clipboard = savedStore, savedClipboard
+	})
+}
+
+func openTestJournal(t *testing.T) *JournalStore {
+	t.Helper()
+	store, err := NewJournalStore(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func journalLines(t *testing.T) int {
+	t.Helper()
+	data, err := os.ReadFile(itemsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestJournalStoreReplay(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := openTestJournal(t)
+
+	large := strings.Repeat("x", 17<<20) // beyond any line buffer
+	for i, content := range []string{"one", "two", large, "four"} {
+		if err := store.Add(Item{ID: fmt.Sprintf("item_%d", i+1), Type: "text", Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edited, _ := store.Get("item_2")
+	edited.Content = "two, edited"
+	store.Update(edited)
+	store.Delete("item_4")
+	store.Close()
+
+	reopened := openTestJournal(t)
+	items := reopened.List()
+	if len(items) != 3 || items[1].Content != "two, edited" || items[2].Content != large {
+		t.Fatalf("replayed %d items", len(items))
+	}
+	if _, ok := reopened.Get("item_4"); ok {
+		t.Errorf("deleted item replayed")
+	}
+}
+
+func TestJournalStoreTornTail(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := openTestJournal(t)
+	store.Add(Item{ID: "item_1", Type: "text", Content: "kept"})
+	store.Add(Item{ID: "item_2", Type: "text", Content: "kept too"})
+	store.Close()
+
+	// A crash in the middle of an append leaves half a line
+	file, err := os.OpenFile(itemsLogFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"put","item":{"id":"item_3","conte`)
+	file.Close()
+
+	reopened := openTestJournal(t)
+	if items := reopened.List(); len(items) != 2 || items[1].ID != "item_2" {
+		t.Fatalf("items after a torn write = %+v", items)
+	}
+	// The torn line is gone, new entries start on a line of their own
+	if err := reopened.Add(Item{ID: "item_4", Type: "text", Content: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	if items := openTestJournal(t).List(); len(items) != 3 || items[2].ID != "item_4" {
+		t.Errorf("items after reopening = %+v", items)
+	}
+}
+
+func TestJournalStoreCorruptEntry(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := openTestJournal(t)
+	for i := 1; i <= 3; i++ {
+		store.Add(Item{ID: fmt.Sprintf("item_%d", i), Type: "text", Content: "kept"})
+	}
+	store.Close()
+
+	// Damage before the last line is no torn write, the store must not open
+	data, _ := os.ReadFile(itemsLogFile)
+	damaged := bytes.Replace(data, []byte(`"item_2"`), []byte(`"item_2`), 1)
+	os.WriteFile(itemsLogFile, damaged, 0600)
+	if _, err := NewJournalStore(itemsLogFile); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("corrupt journal opened: %v", err)
+	}
+	if after, _ := os.ReadFile(itemsLogFile); !bytes.Equal(after, damaged) {
+		t.Errorf("corrupt journal rewritten by a failed open")
+	}
+
+	// The same damage on the last line is dropped
+	os.WriteFile(itemsLogFile, bytes.Replace(data, []byte(`"item_3"`), []byte(`"item_3`), 1), 0600)
+	if items := openTestJournal(t).List(); len(items) != 2 {
+		t.Errorf("items after a damaged last line = %+v", items)
+	}
+}
+
+func TestJournalStoreCompaction(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := openTestJournal(t)
+	store.Add(Item{ID: "item_1", Type: "text", Content: "kept"})
+
+	// The put that takes the journal past the slack rewrites it
+	edits := journalCompactSlack + 2
+	for i := 0; i < edits; i++ {
+		item := Item{ID: "item_2", Type: "text", Content: fmt.Sprintf("edit %d", i)}
+		if i == 0 {
+			store.Add(item)
+		} else {
+			store.Update(item)
+		}
+	}
+	if lines := journalLines(t); lines != 2 {
+		t.Errorf("journal has %d lines after compaction, want 2", lines)
+	}
+
+	if _, err := store.DeleteFunc(func(item Item) bool { return item.ID == "item_1" }); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if items := openTestJournal(t).List(); len(items) != 1 || items[0].Content != fmt.Sprintf("edit %d", edits-1) {
+		t.Errorf("items after compaction = %+v", items)
+	}
+}
+
+func TestJournalStoreLegacyMigration(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("memory", 0755)
+	legacy := `{"items":[
+		{"id":"item_1","timestamp":"2024-05-01T10:00:00Z","from":"PC","type":"text","content":"hello"},
+		{"id":"item_2","timestamp":"2024-05-01T10:01:00Z","from":"phone","type":"text","content":"https://example.com"}
+	]}`
+	if err := os.WriteFile(dataFile, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openTestJournal(t)
+	items := store.List()
+	if len(items) != 2 || items[0].Content != "hello" || !items[0].Timestamp.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("migrated items = %+v", items)
+	}
+	if items[1].Type != "link" || items[1].Schema != itemSchemaVersion {
+		t.Errorf("legacy link migrated as %+v", items[1])
+	}
+	if _, err := os.Stat(dataFile); !os.IsNotExist(err) {
+		t.Errorf("data.json still in place: %v", err)
+	}
+	if _, err := os.Stat(dataFile + ".migrated"); err != nil {
+		t.Errorf("data.json not kept aside: %v", err)
+	}
+
+	// Later starts read the journal, not the old file
+	store.Close()
+	os.WriteFile(dataFile, []byte(`{"items":[]}`), 0644)
+	if items := openTestJournal(t).List(); len(items) != 2 {
+		t.Errorf("reopened store has %d items, want 2", len(items))
+	}
+}
+
+func TestJournalStoreConcurrentAdd(t *testing.T) {
+	t.Chdir(t.TempDir())
+	store := openTestJournal(t)
+
+	const writers, perWriter = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if err := store.Add(Item{ID: generateID(), Type: "text", Content: "concurrent"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(store.List()); n != writers*perWriter {
+		t.Errorf("store holds %d items, want %d", n, writers*perWriter)
+	}
+	store.Close()
+	if n := len(openTestJournal(t).List()); n != writers*perWriter {
+		t.Errorf("reopened store holds %d items, want %d", n, writers*perWriter)
+	}
+}
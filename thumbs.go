@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const thumbsDir = "memory/thumbs"
+
+// Longest side of a thumbnail in pixels
+const thumbnailMaxSize = 320
+
+// Images with more pixels than this are not decoded, so a small file that
+// claims huge dimensions can't exhaust memory
+const thumbnailMaxSourcePixels = 50_000_000
+
+const thumbnailJPEGQuality = 80
+
+// Check if thumbnails can be made for a content type
+func isThumbnailType(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Decode a stored image upload and write a downscaled copy for the item.
+// Returns the thumbnail file name and the size of the original image.
+func createThumbnail(uploadPath, itemID string) (string, int, int, error) {
+	file, err := openStoredFile(uploadPath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer file.Close()
+
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > thumbnailMaxSourcePixels {
+		return "", config.Width, config.Height, fmt.Errorf("image too large for a thumbnail: %dx%d", config.Width, config.Height)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", 0, 0, err
+	}
+
+	// Only the first frame of an animated GIF is used
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", config.Width, config.Height, err
+	}
+
+	width, height := thumbnailSize(config.Width, config.Height)
+	thumb := scaleImage(src, width, height)
+
+	if err := os.MkdirAll(thumbsDir, 0755); err != nil {
+		return "", 0, 0, err
+	}
+
+	// Photos stay JPEG, PNG and GIF become PNG to keep transparency
+	name := itemID + ".png"
+	if format == "jpeg" {
+		name = itemID + ".jpg"
+	}
+	thumbPath, err := safeJoin(thumbsDir, name)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	tmpPath := thumbPath + ".tmp"
+	out, err := createStoredFile(tmpPath)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		err = png.Encode(out, thumb)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, thumbPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", 0, 0, err
+	}
+
+	return name, config.Width, config.Height, nil
+}
+
+// Fit an image into thumbnailMaxSize, never scaling up
+func thumbnailSize(width, height int) (int, int) {
+	if width <= thumbnailMaxSize && height <= thumbnailMaxSize {
+		return width, height
+	}
+	if width >= height {
+		return thumbnailMaxSize, max(1, height*thumbnailMaxSize/width)
+	}
+	return max(1, width*thumbnailMaxSize/height), thumbnailMaxSize
+}
+
+// Downscale by averaging the source pixels that fall into each target pixel
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if bounds.Dx() == width && bounds.Dy() == height {
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			// RGBA() is premultiplied 16-bit, RGBA64 keeps it that way
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// Delete the thumbnail of a file item, if it has one
+func removeThumbnail(item Item) {
+	if item.File == nil || item.File.Thumbnail == "" {
+		return
+	}
+	thumbPath, err := safeJoin(thumbsDir, item.File.Thumbnail)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(thumbPath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("[ERROR] Failed to delete thumbnail %s: %v\n", thumbPath, err)
+	}
+}
+
+// Delete every thumbnail, used when the history is cleared
+func clearThumbnails() {
+	files, err := os.ReadDir(thumbsDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(thumbsDir, file.Name())); err != nil {
+			fmt.Printf("[ERROR] Failed to delete thumbnail %s: %v\n", file.Name(), err)
+		}
+	}
+}
+
+// Handle thumbnail endpoint: GET /thumbs/{item id}
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] Thumbnail requested - URL: %s\n", r.URL.Path)
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/thumbs/")
+	item, ok := itemStore.Get(id)
+	if !ok || !itemVisibleTo(item, requestDevice(r)) || item.File == nil || item.File.Thumbnail == "" {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+
+	thumbPath, err := safeJoin(thumbsDir, item.File.Thumbnail)
+	if err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	file, err := openStoredFile(thumbPath)
+	if err != nil {
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	contentType := "image/png"
+	if strings.HasSuffix(item.File.Thumbnail, ".jpg") {
+		contentType = "image/jpeg"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// A thumbnail never changes for an item ID
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, item.File.Thumbnail, file.ModTime(), file)
+}
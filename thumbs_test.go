@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		{100, 50, 100, 50},
+		{640, 480, 320, 240},
+		{480, 640, 240, 320},
+		{4000, 10, 320, 1},
+	}
+	for _, tt := range tests {
+		w, h := thumbnailSize(tt.width, tt.height)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("thumbnailSize(%d, %d) = %d, %d, want %d, %d", tt.width, tt.height, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestCreateThumbnail(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	src := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 800; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+
+	for _, format := range []string{"png", "jpeg"} {
+		uploadPath := filepath.Join(t.TempDir(), "photo."+format)
+		file, err := os.Create(uploadPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == "png" {
+			err = png.Encode(file, src)
+		} else {
+			err = jpeg.Encode(file, src, nil)
+		}
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name, width, height, err := createThumbnail(uploadPath, "item_"+format)
+		if err != nil {
+			t.Fatalf("%s: createThumbnail: %v", format, err)
+		}
+		if width != 800 || height != 400 {
+			t.Errorf("%s: original size = %dx%d, want 800x400", format, width, height)
+		}
+
+		thumbFile, err := os.Open(filepath.Join(thumbsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(thumbFile)
+		thumbFile.Close()
+		if err != nil {
+			t.Fatalf("%s: decoding thumbnail %s: %v", format, name, err)
+		}
+		if config.Width != 320 || config.Height != 160 {
+			t.Errorf("%s: thumbnail size = %dx%d, want 320x160", format, config.Width, config.Height)
+		}
+	}
+
+	// Not an image
+	notImage := filepath.Join(t.TempDir(), "fake.png")
+	os.WriteFile(notImage, []byte("hello"), 0644)
+	if _, _, _, err := createThumbnail(notImage, "item_fake"); err == nil {
+		t.Errorf("createThumbnail accepted a file that isn't an image")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const selfSignedCertFile = "memory/tls-cert.pem"
+const selfSignedKeyFile = "memory/tls-key.pem"
+
+// Self-signed certificates are valid this long and regenerated when close to expiry
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+const selfSignedRenewBefore = 30 * 24 * time.Hour
+
+// TLS modes for ServerSettings.TLSMode
+const (
+	tlsModeOff        = "off"
+	tlsModeSelfSigned = "self-signed"
+	tlsModeCustom     = "custom"
+)
+
+// TLS status structure reported on /status
+type TLSStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Mode        string    `json:"mode"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	NotAfter    time.Time `json:"notAfter,omitempty"`
+}
+
+var tlsStatus = TLSStatus{Mode: tlsModeOff}
+
+// Check if the server is configured to listen with TLS
+func tlsEnabled() bool {
+	return serverSettings.TLSMode == tlsModeSelfSigned || serverSettings.TLSMode == tlsModeCustom
+}
+
+// Get the URL scheme clients should use
+func serverScheme() string {
+	if tlsStatus.Enabled {
+		return "https"
+	}
+	return "http"
+}
+
+// Load the certificate for the configured TLS mode, generating a self-signed one if needed
+func loadTLSConfig(serverHost string) (*tls.Config, error) {
+	certFile, keyFile := serverSettings.TLSCertFile, serverSettings.TLSKeyFile
+
+	switch serverSettings.TLSMode {
+	case tlsModeCustom:
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("custom TLS mode needs tlsCertFile and tlsKeyFile")
+		}
+	case tlsModeSelfSigned:
+		certFile, keyFile = selfSignedCertFile, selfSignedKeyFile
+		if err := ensureSelfSignedCert(serverHost); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown TLS mode: %s", serverSettings.TLSMode)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	tlsStatus = TLSStatus{
+		Enabled:     true,
+		Mode:        serverSettings.TLSMode,
+		Fingerprint: certFingerprint(leaf),
+		Subject:     leaf.Subject.CommonName,
+		NotAfter:    leaf.NotAfter,
+	}
+	fmt.Printf("[INFO] TLS certificate fingerprint (SHA-256): %s\n", tlsStatus.Fingerprint)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Generate a self-signed certificate unless a usable one already exists
+func ensureSelfSignedCert(serverHost string) error {
+	if cert, err := tls.LoadX509KeyPair(selfSignedCertFile, selfSignedKeyFile); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > selfSignedRenewBefore && certCoversHost(leaf, serverHost) {
+			return nil
+		}
+		fmt.Printf("[INFO] Self-signed certificate is expiring or doesn't cover %s, regenerating\n", serverHost)
+	}
+
+	fmt.Printf("[INFO] Generating self-signed TLS certificate\n")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Orion", Organization: []string{"Orion"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	for _, host := range []string{serverHost, getLocalIP()} {
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	if err := os.MkdirAll("memory", 0755); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := writeFileAtomic(selfSignedCertFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := writeFileAtomic(selfSignedKeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+
+	fmt.Printf("[INFO] Self-signed certificate saved to %s\n", selfSignedCertFile)
+	return nil
+}
+
+// Check if the certificate is valid for the host clients connect to
+func certCoversHost(cert *x509.Certificate, host string) bool {
+	if host == "" {
+		return true
+	}
+	return cert.VerifyHostname(host) == nil
+}
+
+// SHA-256 fingerprint of a certificate as colon separated hex
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestLoadTLSConfigSelfSigned(t *testing.T) {
+	t.Chdir(t.TempDir())
+	savedSettings, savedStatus := serverSettings, tlsStatus
+	t.Cleanup(func() { serverSettings, tlsStatus = savedSettings, savedStatus })
+	serverSettings.TLSMode = tlsModeSelfSigned
+
+	config, err := loadTLSConfig("192.168.1.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := config.Certificates[0].Leaf
+	if !certCoversHost(leaf, "192.168.1.50") || !certCoversHost(leaf, "localhost") || config.MinVersion == 0 {
+		t.Errorf("certificate covers %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	if !tlsStatus.Enabled || serverScheme() != "https" || tlsStatus.Fingerprint != certFingerprint(leaf) {
+		t.Errorf("TLS status = %+v", tlsStatus)
+	}
+
+	// The certificate is kept across restarts, and replaced once the host changes
+	first := tlsStatus.Fingerprint
+	if _, err := loadTLSConfig("192.168.1.50"); err != nil || tlsStatus.Fingerprint != first {
+		t.Errorf("certificate regenerated for the same host: %v", err)
+	}
+	config, err = loadTLSConfig("orion.lan")
+	if err != nil || tlsStatus.Fingerprint == first || !certCoversHost(config.Certificates[0].Leaf, "orion.lan") {
+		t.Errorf("certificate not regenerated for a new host: %v", err)
+	}
+
+	serverSettings.TLSMode = tlsModeCustom
+	if _, err := loadTLSConfig("orion.lan"); err == nil {
+		t.Errorf("custom mode without certificate files loaded")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Link previews: when a message is nothing but an http(s) URL it becomes a
+// "link" item and the server fetches the page in the background. Title,
+// description and site icon are stored on the item's LinkPayload and sent
+// as item_updated, so clients render the preview without fetching the site
+// themselves. Only the start of a page is read, previews come from <head>.
+
+// Time allowed for fetching a page or icon, redirects included
+const unfurlTimeout = 5 * time.Second
+
+// Bytes read from a page and largest icon stored on an item
+const (
+	maxUnfurlPageSize = 512 << 10
+	maxFaviconSize    = 32 << 10
+)
+
+// Lengths of the stored preview texts, in characters
+const (
+	maxLinkTitleLength       = 200
+	maxLinkDescriptionLength = 400
+)
+
+// Previews fetched at the same time, more wait for a free slot
+const maxConcurrentUnfurls = 4
+
+var unfurlClient = &http.Client{
+	Timeout: unfurlTimeout,
+	Transport: &http.Transport{
+		// Every connection is checked once the host name is resolved, the
+		// ones redirects lead to included
+		DialContext:         (&net.Dialer{Timeout: unfurlTimeout, Control: checkUnfurlDial}).DialContext,
+		TLSHandshakeTimeout: unfurlTimeout,
+		MaxIdleConns:        maxConcurrentUnfurls,
+		IdleConnTimeout:     30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkUnfurlURL(req.URL)
+	},
+}
+
+var (
+	errUnfurlForbidden = errors.New("address is not on the internet")
+	errLinkChanged     = errors.New("link changed while fetching its preview")
+)
+
+// Special-purpose ranges the net.IP checks don't cover: "this network",
+// carrier-grade NAT, protocol assignments and benchmarking
+var nonPublicBlocks = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15")
+
+func parseCIDRs(blocks ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(blocks))
+	for i, block := range blocks {
+		_, ipNet, err := net.ParseCIDR(block)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
+// Decides which addresses previews may be fetched from. Links are sent by
+// any paired device, so the server itself, the LAN and link-local
+// addresses are off limits. Tests swap it to reach their local server.
+var unfurlAllowedIP = isPublicIP
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, block := range nonPublicBlocks {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse a URL up front when its host is an address that may not be fetched
+func checkUnfurlURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !unfurlAllowedIP(ip) {
+		return errUnfurlForbidden
+	}
+	return nil
+}
+
+// Refuse connections to addresses that may not be fetched, called with the
+// resolved address so host names can't point anywhere else
+func checkUnfurlDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !unfurlAllowedIP(ip) {
+		return errUnfurlForbidden
+	}
+	return nil
+}
+
+var unfurlSlots = make(chan struct{}, maxConcurrentUnfurls)
+
+// Preview of a page as found in its HTML
+type linkMetadata struct {
+	Title       string
+	Description string
+	Favicon     string // absolute URL of the site icon
+}
+
+var (
+	unfurlTagPattern  = regexp.MustCompile(`(?is)<(title|meta|link|body)\b([^>]*)>`)
+	unfurlAttrPattern = regexp.MustCompile(`(?s)([a-zA-Z_:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	unfurlTitleEnd    = regexp.MustCompile(`(?i)</title\s*>`)
+)
+
+// Attributes of a tag, names lowercased and values unescaped
+func parseTagAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range unfurlAttrPattern.FindAllStringSubmatch(s, -1) {
+		name := strings.ToLower(match[1])
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = html.UnescapeString(match[2] + match[3] + match[4])
+		}
+	}
+	return attrs
+}
+
+// Collapse whitespace and cut text to at most limit characters
+func cleanPreviewText(s string, limit int) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:limit-1])) + "…"
+}
+
+// Find the preview of a page in its HTML. Open Graph values win over the
+// plain title and description, the icon defaults to /favicon.ico.
+func parseLinkMetadata(page string, base *url.URL) linkMetadata {
+	var meta linkMetadata
+	var title, ogTitle, description, ogDescription, icon, touchIcon string
+
+	for _, match := range unfurlTagPattern.FindAllStringSubmatchIndex(page, -1) {
+		tag := strings.ToLower(page[match[2]:match[3]])
+		if tag == "body" {
+			break
+		}
+		attrs := parseTagAttributes(page[match[4]:match[5]])
+
+		switch tag {
+		case "title":
+			rest := page[match[1]:]
+			if end := unfurlTitleEnd.FindStringIndex(rest); end != nil && title == "" {
+				title = html.UnescapeString(rest[:end[0]])
+			}
+		case "meta":
+			name := strings.ToLower(attrs["property"])
+			if name == "" {
+				name = strings.ToLower(attrs["name"])
+			}
+			switch name {
+			case "og:title", "twitter:title":
+				if ogTitle == "" {
+					ogTitle = attrs["content"]
+				}
+			case "og:description", "twitter:description":
+				if ogDescription == "" {
+					ogDescription = attrs["content"]
+				}
+			case "description":
+				if description == "" {
+					description = attrs["content"]
+				}
+			}
+		case "link":
+			if attrs["href"] == "" {
+				continue
+			}
+			for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+				if rel == "icon" && icon == "" {
+					icon = attrs["href"]
+				} else if strings.HasPrefix(rel, "apple-touch-icon") && touchIcon == "" {
+					touchIcon = attrs["href"]
+				}
+			}
+		}
+	}
+
+	meta.Title = cleanPreviewText(firstNonEmpty(ogTitle, title), maxLinkTitleLength)
+	meta.Description = cleanPreviewText(firstNonEmpty(ogDescription, description), maxLinkDescriptionLength)
+
+	iconRef, err := url.Parse(strings.TrimSpace(firstNonEmpty(icon, touchIcon, "/favicon.ico")))
+	if err == nil {
+		if resolved := base.ResolveReference(iconRef); resolved.Scheme == "http" || resolved.Scheme == "https" {
+			meta.Favicon = resolved.String()
+		}
+	}
+	return meta
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// GET a URL for a preview, the body is cut off at limit bytes
+func fetchForUnfurl(rawURL string, limit int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkUnfurlURL(req.URL); err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "Orion link preview")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,image/*;q=0.8,*/*;q=0.5")
+
+	resp, err := unfurlClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// Fetch the preview of a page. Pages that aren't HTML only get their icon.
+func fetchLinkMetadata(rawURL string) (linkMetadata, error) {
+	resp, body, err := fetchForUnfurl(rawURL, maxUnfurlPageSize)
+	if err != nil {
+		return linkMetadata{}, err
+	}
+
+	// Relative icons resolve against where redirects ended up
+	base := resp.Request.URL
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return parseLinkMetadata("", base), nil
+	}
+	return parseLinkMetadata(string(body), base), nil
+}
+
+// Fetch a site icon as a data: URL, empty if there is none worth storing
+func fetchFavicon(iconURL string) (string, error) {
+	resp, body, err := fetchForUnfurl(iconURL, maxFaviconSize+1)
+	if err != nil {
+		return "", err
+	}
+	if len(body) == 0 || len(body) > maxFaviconSize {
+		return "", fmt.Errorf("icon is empty or larger than %d KB", maxFaviconSize>>10)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(body))
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("icon has type %s", contentType)
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(body), nil
+}
+
+// Fill in the preview of a link. A failed fetch still marks the link as
+// unfurled, the item keeps its URL and host and isn't tried again.
+func unfurlLink(link LinkPayload) LinkPayload {
+	now := time.Now()
+	link.UnfurledAt = &now
+
+	meta, err := fetchLinkMetadata(link.URL)
+	if err != nil {
+		fmt.Printf("[DEBUG] Unfurl: No preview for %s: %v\n", link.URL, err)
+		return link
+	}
+	link.Title = meta.Title
+	link.Description = meta.Description
+
+	if meta.Favicon != "" {
+		if link.Favicon, err = fetchFavicon(meta.Favicon); err != nil {
+			fmt.Printf("[DEBUG] Unfurl: No icon for %s: %v\n", link.URL, err)
+		}
+	}
+	return link
+}
+
+// Fetch the preview of a new or edited link item in the background and
+// publish the updated item. Does nothing for other items or with link
+// previews turned off in the server settings.
+func startUnfurl(item Item) {
+	if item.Type != "link" || item.Link == nil || item.Link.UnfurledAt != nil || !currentSettings().LinkPreviews {
+		return
+	}
+	go func() {
+		unfurlSlots <- struct{}{}
+		defer func() { <-unfurlSlots }()
+
+		link := unfurlLink(*item.Link)
+		if err := storeLinkPreview(item.ID, item.Content, link); err != nil {
+			fmt.Printf("[DEBUG] Unfurl: Preview of item %s not stored: %v\n", item.ID, err)
+		}
+	}()
+}
+
+// Put a fetched preview on the item, unless it was deleted or edited in the
+// meantime. The check and the update happen under the store lock, so an edit
+// can't slip in between.
+func storeLinkPreview(id, content string, link LinkPayload) error {
+	item, err := itemStore.UpdateFunc(id, func(item *Item) error {
+		if item.Content != content || item.Link == nil || item.Link.URL != link.URL {
+			return errLinkChanged
+		}
+		item.Link = &link
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[DEBUG] Unfurl: Stored preview of item %s: %q\n", id, link.Title)
+	publishItemUpdated(item)
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 1x1 transparent PNG
+var testIcon = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89\x00\x00\x00\rIDATx\x9cc\x00\x01\x00\x00\x05\x00\x01\r\n-\xb4\x00\x00\x00\x00IEND\xaeB`\x82")
+
+// Local stand-in for the sites links point to
+func newUnfurlTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/article", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<!doctype html><html><head>
+			<title>Plain title</title>
+			<meta property="og:title" content="Tom &amp; Jerry">
+			<meta name="description" content="  A   short
+				description ">
+			<link rel="shortcut icon" href="/static/icon.png">
+			</head><body><meta property="og:title" content="Not from the body"></body></html>`))
+	})
+	mux.HandleFunc("/static/icon.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testIcon)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/docs/page", http.StatusFound)
+	})
+	mux.HandleFunc("/docs/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><TITLE>Docs</TITLE><link href="icon.png" rel="icon"></head>`))
+	})
+	mux.HandleFunc("/to-lan", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://192.168.1.1/admin", http.StatusFound)
+	})
+	mux.HandleFunc("/docs/icon.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testIcon)
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head>" + strings.Repeat(" ", maxUnfurlPageSize) + "<title>Too far</title>"))
+	})
+	mux.HandleFunc("/big-icon", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><title>Big icon</title><link rel="icon" href="/big.png"></head>`))
+	})
+	mux.HandleFunc("/big.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(append(testIcon, make([]byte, maxFaviconSize)...))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`<title>Slow</title>`))
+	})
+	mux.HandleFunc("/file.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Write([]byte("PK\x03\x04<title>Not a page</title>"))
+	})
+	// No /favicon.ico, the default icon is missing
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Let previews reach the test server on this machine, other local addresses stay refused
+func allowUnfurlLoopback(t *testing.T) {
+	t.Helper()
+	saved := unfurlAllowedIP
+	unfurlAllowedIP = func(ip net.IP) bool { return ip.IsLoopback() || isPublicIP(ip) }
+	t.Cleanup(func() { unfurlAllowedIP = saved })
+}
+
+// Keep items from being fetched in the background for the rest of the test
+func disableLinkPreviews(t *testing.T) {
+	t.Helper()
+	saved := serverSettings
+	serverSettings.LinkPreviews = false
+	t.Cleanup(func() { serverSettings = saved })
+}
+
+func TestParseLinkMetadata(t *testing.T) {
+	base, _ := url.Parse("https://example.com/a/b")
+
+	meta := parseLinkMetadata(`<head><title>Only &lt;title&gt;</title></head>`, base)
+	if meta.Title != "Only <title>" || meta.Description != "" || meta.Favicon != "https://example.com/favicon.ico" {
+		t.Errorf("title only: %+v", meta)
+	}
+
+	meta = parseLinkMetadata(`<meta content='Card' name="twitter:title"><link rel="apple-touch-icon" href="//cdn.example.com/touch.png">`, base)
+	if meta.Title != "Card" || meta.Favicon != "https://cdn.example.com/touch.png" {
+		t.Errorf("twitter card: %+v", meta)
+	}
+
+	meta = parseLinkMetadata(`<link rel="icon" href="javascript:alert(1)"><title>`+strings.Repeat("x", 300)+`</title>`, base)
+	if meta.Favicon != "" {
+		t.Errorf("script icon accepted: %q", meta.Favicon)
+	}
+	if n := len([]rune(meta.Title)); n != maxLinkTitleLength || !strings.HasSuffix(meta.Title, "…") {
+		t.Errorf("long title cut to %d characters: %q", n, meta.Title)
+	}
+}
+
+func TestUnfurlLink(t *testing.T) {
+	server := newUnfurlTestServer(t)
+	allowUnfurlLoopback(t)
+	saved := unfurlClient.Timeout
+	unfurlClient.Timeout = 200 * time.Millisecond
+	t.Cleanup(func() { unfurlClient.Timeout = saved })
+
+	link := unfurlLink(*newLinkPayload(server.URL + "/article"))
+	if link.UnfurledAt == nil || link.Title != "Tom & Jerry" || link.Description != "A short description" {
+		t.Errorf("article preview = %+v", link)
+	}
+	if !strings.HasPrefix(link.Favicon, "data:image/png;base64,") {
+		t.Errorf("article icon = %.40q", link.Favicon)
+	}
+
+	// Relative icons resolve against the page redirects ended up at
+	link = unfurlLink(*newLinkPayload(server.URL + "/moved"))
+	if link.Title != "Docs" || link.Favicon == "" {
+		t.Errorf("redirected preview = %+v", link)
+	}
+
+	tests := []struct {
+		path  string
+		title string
+	}{
+		{"/huge", ""},             // title beyond the size limit
+		{"/big-icon", "Big icon"}, // icon too large to store
+		{"/slow", ""},             // timeout
+		{"/file.zip", ""},         // not HTML
+		{"/missing", ""},          // 404
+		{"/to-lan", ""},           // redirect to the LAN
+	}
+	for _, tt := range tests {
+		link := unfurlLink(*newLinkPayload(server.URL + tt.path))
+		if link.UnfurledAt == nil || link.Title != tt.title || link.Favicon != "" {
+			t.Errorf("%s: preview = %+v", tt.path, link)
+		}
+	}
+}
+
+func TestUnfurlAddresses(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.9", "192.168.1.1", "169.254.169.254", "fe80::1", "fd00::1", "0.0.0.0", "224.0.0.1",
+		"0.1.2.3", "100.64.0.1", "100.127.255.254", "192.0.0.8", "198.18.0.1", "198.19.255.255"} {
+		if isPublicIP(net.ParseIP(addr)) {
+			t.Errorf("%s counted as public", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "100.128.0.1", "198.20.0.1", "2606:4700::6810:85e5"} {
+		if !isPublicIP(net.ParseIP(addr)) {
+			t.Errorf("%s counted as local", addr)
+		}
+	}
+
+	// The server itself is never fetched, whether named by address or host name
+	server := newUnfurlTestServer(t)
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	for _, rawURL := range []string{server.URL + "/article", fmt.Sprintf("http://localhost:%d/article", port), "http://[::1]/", "ftp://example.com/"} {
+		if _, _, err := fetchForUnfurl(rawURL, maxUnfurlPageSize); err == nil {
+			t.Errorf("%s fetched", rawURL)
+		}
+	}
+}
+
+func TestStoreLinkPreview(t *testing.T) {
+	useTestItemStore(t)
+	disableLinkPreviews(t)
+
+	item, err := addTextItem("PC", nil, nil, "https://example.com/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Type != "link" || item.Link == nil {
+		t.Fatalf("single URL stored as %+v", item)
+	}
+	if text, _ := addTextItem("PC", nil, nil, "see https://example.com/page"); text.Type != "text" {
+		t.Errorf("text with a URL stored as %s", text.Type)
+	}
+
+	now := time.Now()
+	link := *item.Link
+	link.Title, link.UnfurledAt = "Page", &now
+	if err := storeLinkPreview(item.ID, item.Content, link); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := itemStore.Get(item.ID); stored.Link == nil || stored.Link.Title != "Page" {
+		t.Errorf("stored link = %+v", stored.Link)
+	}
+
+	// A preview fetched before an edit is dropped
+	if err := storeLinkPreview(item.ID, "https://example.com/page ", link); err != errLinkChanged {
+		t.Errorf("preview of edited content: err = %v", err)
+	}
+	other := link
+	other.URL = "https://example.com/other"
+	if err := storeLinkPreview(item.ID, item.Content, other); err != errLinkChanged {
+		t.Errorf("preview of another URL: err = %v", err)
+	}
+	if stored, _ := itemStore.Get(item.ID); stored.Link.URL != item.Link.URL {
+		t.Errorf("stored link after refused previews = %+v", stored.Link)
+	}
+	if err := storeLinkPreview("item_missing", item.Content, link); err != errItemNotFound {
+		t.Errorf("missing item: err = %v", err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const quarantineDir = "memory/quarantine"
+
+// What clear-history does with the uploaded files
+const (
+	uploadsModeDelete     = "delete"
+	uploadsModeQuarantine = "quarantine"
+	uploadsModeKeep       = "keep"
+)
+
+// Upload cleanup result structure
+type UploadCleanupStats struct {
+	Mode       string `json:"mode"`
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	Errors     int    `json:"errors"`
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// Multipart headers and boundaries that come on top of the file size
+const multipartOverhead = 1 << 20
+
+var errUploadTooLarge = errors.New("upload exceeds the maximum size")
+
+// Get the upload size limit in bytes, 0 means unlimited
+func maxUploadBytes() int64 {
+	return int64(currentSettings().MaxUploadSizeMB) << 20
+}
+
+// Reply with 413 and the configured limit
+func uploadTooLarge(w http.ResponseWriter) {
+	http.Error(w, fmt.Sprintf("File exceeds the maximum upload size of %d MB", currentSettings().MaxUploadSizeMB), http.StatusRequestEntityTooLarge)
+}
+
+// Handle file endpoint
+func handleFile(w http.ResponseWriter, r *http.Request, from string) {
+	fmt.Printf("[DEBUG] File endpoint called - From: %s, Method: %s\n", from, r.Method)
+
+	if r.Method != "POST" {
+		fmt.Printf("[ERROR] File: Method not allowed: %s\n", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Targets come in the query (?to=dev_1,group:mobile) so they are known before the file streams in
+	device := requestDevice(r)
+	to, err := parseTargets(splitTargets(r.URL.Query().Get("to")), device)
+	if err != nil {
+		fmt.Printf("[ERROR] File: Invalid targets: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reject oversized uploads before reading any of the body
+	limit := maxUploadBytes()
+	if limit > 0 {
+		if r.ContentLength > limit+multipartOverhead {
+			fmt.Printf("[ERROR] File: Upload too large: %d bytes\n", r.ContentLength)
+			uploadTooLarge(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit+multipartOverhead)
+	}
+
+	// Stream the multipart body instead of buffering it
+	reader, err := r.MultipartReader()
+	if err != nil {
+		fmt.Printf("[ERROR] File: Unable to read multipart body: %v\n", err)
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	var part *multipart.Part
+	for {
+		part, err = reader.NextPart()
+		if err == io.EOF {
+			fmt.Printf("[ERROR] File: No file part in request\n")
+			http.Error(w, "Unable to get file", http.StatusBadRequest)
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			uploadTooLarge(w)
+			return
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] File: Unable to parse form: %v\n", err)
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		part.Close()
+	}
+	defer part.Close()
+
+	filename := sanitizeFilename(part.FileName())
+	fmt.Printf("[DEBUG] File: Receiving file from %s: '%s' (sent as '%s')\n", from, filename, part.FileName())
+
+	// Receive under a unique name, the blob store renames it to its content hash
+	uniqueFilename := fmt.Sprintf("%s_%s", generateID(), filename)
+	filePath, err := safeJoin(uploadsDir, uniqueFilename)
+	if err != nil {
+		fmt.Printf("[ERROR] File: Unsafe filename: %q\n", uniqueFilename)
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("[DEBUG] File: Saving to path: %s\n", filePath)
+
+	size, err := saveUploadStream(part, filePath, limit)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if err == errUploadTooLarge || errors.As(err, &maxBytesErr) {
+			fmt.Printf("[ERROR] File: Upload exceeded %d bytes\n", limit)
+			uploadTooLarge(w)
+			return
+		}
+		fmt.Printf("[ERROR] File: Unable to save file: %v\n", err)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[DEBUG] File: File saved successfully (%d bytes)\n", size)
+
+	storedName, err := blobStore.Ingest(filePath)
+	if err != nil {
+		fmt.Printf("[ERROR] File: Unable to store file: %v\n", err)
+		os.Remove(filePath)
+		http.Error(w, "Unable to save file", http.StatusInternalServerError)
+		return
+	}
+
+	// Create and store the item for the saved file
+	item, err := addFileItem(from, device, to, filename, storedName)
+	if err != nil {
+		fmt.Printf("[ERROR] File: Error saving data: %v\n", err)
+		blobStore.Release(storedName)
+		http.Error(w, "Error saving data", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[DEBUG] File: Created item with ID: %s\n", item.ID)
+
+	// Broadcast the new item to the WebSocket connections that may see it
+	publishItemAdded(item)
+
+	// Generate the download URL of the new item
+	fileURL := fileDownloadURL(item)
+	fmt.Printf("[DEBUG] File: Generated download URL: %s\n", fileURL)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"id":     item.ID,
+		"url":    fileURL,
+		"size":   size,
+		"file":   item.File,
+	})
+	fmt.Printf("[DEBUG] File: Response sent successfully\n")
+}
+
+// Create a file item for an upload in the blob store and add it to the store
+func addFileItem(from string, device *PairedDevice, to []string, displayName, storedName string) (Item, error) {
+	payload, err := newFilePayload(displayName, storedName)
+	if err != nil {
+		return Item{}, err
+	}
+	item := newItem(from, device, to, "file", displayName)
+	item.File = payload
+
+	if isThumbnailType(payload.MIMEType) {
+		uploadPath, _ := safeJoin(uploadsDir, storedName)
+		thumbnail, width, height, err := createThumbnail(uploadPath, item.ID)
+		if err != nil {
+			// Still a perfectly good file, just without a preview
+			fmt.Printf("[ERROR] File: Unable to create thumbnail for %s: %v\n", storedName, err)
+		}
+		payload.Thumbnail, payload.Width, payload.Height = thumbnail, width, height
+	}
+
+	if err := itemStore.Add(item); err != nil {
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// Get the download URL of a file item. Duplicates share a stored file, the
+// item ID picks the name it is served under and who may fetch it.
+func fileDownloadURL(item Item) string {
+	return fmt.Sprintf("%s://%s:%s/uploads/%s?item=%s", serverScheme(), getCurrentServerHost(), serverPort,
+		url.PathEscape(item.File.StoredName), url.QueryEscape(item.ID))
+}
+
+// Copy an upload to disk through a temporary file, enforcing the size limit.
+// The final path only appears once the whole file was written, and with
+// encryption on no plaintext is written at all.
+func saveUploadStream(src io.Reader, filePath string, limit int64) (int64, error) {
+	tmpPath := filePath + ".part"
+	dst, err := createStoredFile(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit > 0 {
+		// Read one byte past the limit to detect oversized files
+		src = io.LimitReader(src, limit+1)
+	}
+	size, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && size > limit {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return size, nil
+}
+
+// Handle file downloads: GET /uploads/{storedName}?item={id}
+func handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	fmt.Printf("[DEBUG] File download requested - URL: %s\n", r.URL.Path)
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		fmt.Printf("[ERROR] File download: Method not allowed: %s\n", r.Method)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract filename from URL path (remove "/uploads/" prefix)
+	filename := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if filename == "" {
+		fmt.Printf("[ERROR] File download: No filename provided\n")
+		http.Error(w, "No filename provided", http.StatusBadRequest)
+		return
+	}
+
+	// The item the file belongs to decides its name and who may download it
+	item, ok := itemStore.Get(r.URL.Query().Get("item"))
+	if !ok || !itemVisibleTo(item, requestDevice(r)) || item.File == nil || item.File.StoredName != filename {
+		fmt.Printf("[ERROR] File download: No visible item %q for %s\n", r.URL.Query().Get("item"), filename)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Only plain file names directly inside the uploads folder can be downloaded
+	filePath, err := safeJoin(uploadsDir, filename)
+	if err != nil {
+		fmt.Printf("[ERROR] File download: Rejected unsafe path: %q\n", filename)
+		http.Error(w, "Invalid filename", http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("[DEBUG] File download: Looking for file at %s\n", filePath)
+
+	// Encrypted uploads are decrypted while they are served
+	file, err := openStoredFile(filePath)
+	if err != nil {
+		fmt.Printf("[ERROR] File download: File not found: %s (%v)\n", filePath, err)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	// Use the name the file was sent with rather than the content hash it is stored under
+	displayName := item.File.Name
+
+	contentType, err := detectContentType(file, displayName)
+	if err != nil {
+		fmt.Printf("[ERROR] File download: Unable to read file: %v\n", err)
+		http.Error(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "1" {
+		disposition = "inline"
+		// Never render active content from uploads in the server's origin
+		if isActiveContentType(contentType) {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": displayName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", file.Size(), file.ModTime().UnixNano()))
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since
+	fmt.Printf("[DEBUG] File download: Serving file %s as %s (%s)\n", filename, disposition, contentType)
+	http.ServeContent(w, r, displayName, file.ModTime(), file)
+	fmt.Printf("[DEBUG] File download: File served successfully\n")
+}
+
+// Work out a file's content type from its extension, falling back to sniffing its first bytes
+func detectContentType(file io.ReadSeeker, name string) (string, error) {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Content types a browser would execute when shown inline
+func isActiveContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/javascript", "application/javascript", "text/xml", "application/xml":
+		return true
+	}
+	return false
+}
+
+// Clear the uploaded files once the history was cleared. The items that were
+// removed let go of their files, then every file no item references is
+// deleted. In quarantine mode the files are moved to a timestamped folder
+// under memory/quarantine instead. Uploads still being received are left alone.
+func clearUploadedFiles(mode string, removed []Item) (UploadCleanupStats, error) {
+	stats := UploadCleanupStats{Mode: mode}
+
+	// Only the references of the cleared items go, uploads that finished in
+	// the meantime keep their files
+	unused := make(map[string]bool)
+	for _, item := range removed {
+		if item.File != nil && item.File.StoredName != "" && blobStore.Unref(item.File.StoredName) {
+			unused[item.File.StoredName] = true
+		}
+	}
+
+	if mode == uploadsModeKeep {
+		fmt.Printf("[DEBUG] Keeping uploaded files\n")
+		return stats, nil
+	}
+
+	fmt.Printf("[DEBUG] Clearing uploaded files from directory: %s (mode: %s)\n", uploadsDir, mode)
+
+	// Check if uploads directory exists
+	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
+		fmt.Printf("[DEBUG] Uploads directory doesn't exist, nothing to clear\n")
+		return stats, nil
+	}
+
+	// Read all files in the uploads directory
+	files, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to read uploads directory: %v\n", err)
+		return stats, err
+	}
+
+	if mode == uploadsModeQuarantine {
+		stats.Quarantine = filepath.Join(quarantineDir, time.Now().Format("20060102-150405"))
+		if err := os.MkdirAll(stats.Quarantine, 0755); err != nil {
+			return stats, fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+	}
+
+	for _, file := range files {
+		// Anything but a blob is an upload being received or a temporary file
+		if file.IsDir() || (!unused[file.Name()] && !isBlobName(file.Name())) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			stats.Errors++
+			continue
+		}
+
+		filePath := filepath.Join(uploadsDir, file.Name())
+		cleared, err := blobStore.Discard(file.Name(), func() error {
+			if mode == uploadsModeQuarantine {
+				return os.Rename(filePath, filepath.Join(stats.Quarantine, file.Name()))
+			}
+			return os.Remove(filePath)
+		})
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to clear file %s: %v\n", filePath, err)
+			stats.Errors++
+			continue
+		}
+		if !cleared {
+			// Sent again since the history was cleared
+			continue
+		}
+
+		stats.Files++
+		stats.Bytes += info.Size()
+	}
+
+	fmt.Printf("[DEBUG] Cleared %d uploaded files, %d bytes (%d errors)\n", stats.Files, stats.Bytes, stats.Errors)
+
+	if stats.Errors > 0 {
+		return stats, fmt.Errorf("failed to clear %d files", stats.Errors)
+	}
+
+	return stats, nil
+}
+
+// Release the stored file backing a file item and delete its thumbnail. The
+// file itself is only deleted when no other item references the same content.
+// Returns the number of bytes freed, or -1 if no file was deleted.
+func removeUploadedFile(item Item) (int64, error) {
+	removeThumbnail(item)
+
+	if item.File == nil || item.File.StoredName == "" {
+		return -1, nil
+	}
+	return blobStore.Release(item.File.StoredName)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Use a fresh blob store for the rest of the test
+func useTestBlobStore(t *testing.T) {
+	t.Helper()
+	saved := blobStore
+	blobStore = NewBlobStore()
+	t.Cleanup(func() { blobStore = saved })
+}
+
+// Write a file to the uploads folder
+func writeUpload(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadsDir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Names of the files left in a folder
+func folderFiles(dir string) string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Test blob names, 64 hex characters
+func testBlobName(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+func TestHandleClearHistory(t *testing.T) {
+	tests := []struct {
+		mode    string
+		uploads string // left in the uploads folder
+		files   int    // deleted or quarantined
+	}{
+		{"", "item_3_c.txt,item_4_d.txt.part", 2},
+		{"delete", "item_3_c.txt,item_4_d.txt.part", 2},
+		{"quarantine", "item_3_c.txt,item_4_d.txt.part", 2},
+		{"keep", strings.Join([]string{testBlobName('a'), testBlobName('b'), "item_3_c.txt", "item_4_d.txt.part"}, ","), 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("mode %q", tt.mode), func(t *testing.T) {
+			useTestItemStore(t)
+			useTestBlobStore(t)
+			// A file of a cleared item, one nothing references and two uploads being received
+			writeUpload(t, testBlobName('a'), "sent")
+			writeUpload(t, testBlobName('b'), "orphan")
+			writeUpload(t, "item_3_c.txt", "received, not stored yet")
+			writeUpload(t, "item_4_d.txt.part", "receiving")
+			itemStore.Add(Item{ID: "item_1", Type: "file", Content: "a.txt", File: &FilePayload{Name: "a.txt", StoredName: testBlobName('a'), Size: 4}})
+			itemStore.Add(Item{ID: "item_2", Type: "text", Content: "hello"})
+			blobStore.Rebuild(itemStore.List())
+
+			body := ""
+			if tt.mode != "" {
+				body = `{"files":"` + tt.mode + `"}`
+			}
+			w := httptest.NewRecorder()
+			handleClearHistory(w, httptest.NewRequest("POST", "/clear-history", strings.NewReader(body)))
+			var response struct {
+				Items int                `json:"items"`
+				Files UploadCleanupStats `json:"files"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("status %d, err %v", w.Code, err)
+			}
+			if response.Items != 2 || len(itemStore.List()) != 0 {
+				t.Errorf("cleared %d items, %d left", response.Items, len(itemStore.List()))
+			}
+			if got := folderFiles(uploadsDir); got != tt.uploads {
+				t.Errorf("uploads left: %s, want %s", got, tt.uploads)
+			}
+			if response.Files.Files != tt.files {
+				t.Errorf("cleared %d files, want %d", response.Files.Files, tt.files)
+			}
+			if tt.mode == uploadsModeQuarantine {
+				if got := folderFiles(response.Files.Quarantine); got != testBlobName('a')+","+testBlobName('b') {
+					t.Errorf("quarantine holds %s", got)
+				}
+			}
+			if stats := blobStore.Stats(); stats.References != 0 {
+				t.Errorf("references left after clearing: %+v", stats)
+			}
+		})
+	}
+
+	// Unknown modes are refused before anything is cleared
+	useTestItemStore(t)
+	itemStore.Add(Item{ID: "item_1", Type: "text", Content: "hello"})
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/clear-history?files=shred", nil),
+		httptest.NewRequest("GET", "/clear-history", nil),
+	} {
+		w := httptest.NewRecorder()
+		handleClearHistory(w, r)
+		if w.Code == http.StatusOK || len(itemStore.List()) != 1 {
+			t.Errorf("%s %s: status %d, %d items left", r.Method, r.URL, w.Code, len(itemStore.List()))
+		}
+	}
+}
+
+func TestClearUploadedFilesKeepsNewUploads(t *testing.T) {
+	useTestItemStore(t)
+	useTestBlobStore(t)
+	ingest := func(name string) string {
+		t.Helper()
+		writeUpload(t, name, "sent twice")
+		stored, err := blobStore.Ingest(filepath.Join(uploadsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored
+	}
+	cleared := Item{ID: "item_1", Type: "file", File: &FilePayload{StoredName: ingest("item_1_a.txt")}}
+
+	// The same file is sent again after the items were cleared, before the files are
+	ingest("item_2_a.txt")
+
+	if _, err := clearUploadedFiles(uploadsModeDelete, []Item{cleared}); err != nil {
+		t.Fatal(err)
+	}
+	if got := folderFiles(uploadsDir); got != cleared.File.StoredName {
+		t.Errorf("uploads left: %q", got)
+	}
+	if stats := blobStore.Stats(); stats.References != 1 || stats.Blobs != 1 {
+		t.Errorf("stats after clearing = %+v", stats)
+	}
+}
+
+func TestHandleFileDownload(t *testing.T) {
+	am := useTestAuthManager(t)
+	useTestItemStore(t)
+	laptopToken, laptop, _ := am.Register("Laptop", deviceTypePC)
+	phoneToken, phone, _ := am.Register("Phone", deviceTypeMobile)
+	tabletToken, _, _ := am.Register("Tablet", deviceTypeMobile)
+
+	// Two items share one stored file, the second is only for the phone
+	const blob = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadsDir, blob), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	itemStore.Add(Item{ID: "item_1", Type: "file", Content: "notes.txt", File: &FilePayload{Name: "notes.txt", StoredName: blob}})
+	itemStore.Add(Item{ID: "item_2", Type: "file", Content: "plan.txt", DeviceID: laptop.ID, To: []string{phone.ID},
+		File: &FilePayload{Name: "plan.txt", StoredName: blob}})
+	itemStore.Add(Item{ID: "item_3", Type: "text", Content: "hello"})
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		file   string
+	}{
+		{"shared item", "/uploads/" + blob + "?item=item_1", tabletToken, http.StatusOK, "notes.txt"},
+		{"targeted item", "/uploads/" + blob + "?item=item_2", phoneToken, http.StatusOK, "plan.txt"},
+		{"sender", "/uploads/" + blob + "?item=item_2", laptopToken, http.StatusOK, "plan.txt"},
+		{"not a recipient", "/uploads/" + blob + "?item=item_2", tabletToken, http.StatusNotFound, ""},
+		{"no item", "/uploads/" + blob, phoneToken, http.StatusNotFound, ""},
+		{"unknown item", "/uploads/" + blob + "?item=item_9", phoneToken, http.StatusNotFound, ""},
+		{"not a file item", "/uploads/" + blob + "?item=item_3", phoneToken, http.StatusNotFound, ""},
+		{"other file", "/uploads/item_1_notes.txt?item=item_1", phoneToken, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			handleFileDownload(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.file == "" {
+				return
+			}
+			if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, `filename=`+tt.file) || w.Body.String() != "hello" {
+				t.Errorf("served %q as %q", w.Body.String(), disposition)
+			}
+		})
+	}
+}
+
+// Build a multipart upload of one file
+func multipartUpload(t *testing.T, name string, content []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+func TestHandleFileSizeLimit(t *testing.T) {
+	useTestItemStore(t)
+	useTestBlobStore(t)
+	saved := serverSettings
+	serverSettings.MaxUploadSizeMB = 1
+	t.Cleanup(func() { serverSettings = saved })
+	if err := ensureUploadsDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(size int, chunked bool) *httptest.ResponseRecorder {
+		body, contentType := multipartUpload(t, "big.bin", bytes.Repeat([]byte("x"), size))
+		r := httptest.NewRequest("POST", "/pc/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		if chunked {
+			// No length up front, the limit is found while streaming
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handleFile(w, r, "PC")
+		return w
+	}
+	for _, chunked := range []bool{false, true} {
+		if w := upload(3<<20, chunked); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("3 MB upload, chunked %v: status %d", chunked, w.Code)
+		}
+		// Just over the limit, within the multipart allowance
+		if w := upload(1<<20+1, chunked); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("1 MB + 1 byte upload, chunked %v: status %d", chunked, w.Code)
+		}
+	}
+	if got := folderFiles(uploadsDir); got != "" || len(itemStore.List()) != 0 {
+		t.Errorf("refused uploads left files %q and %d items", got, len(itemStore.List()))
+	}
+
+	if w := upload(1<<20, true); w.Code != http.StatusOK {
+		t.Fatalf("upload at the limit: status %d", w.Code)
+	}
+	if items := itemStore.List(); len(items) != 1 || items[0].File == nil || items[0].File.Size != 1<<20 {
+		t.Errorf("items after upload = %+v", items)
+	}
+}
+
+func TestHandleFileDownloadRanges(t *testing.T) {
+	useTestItemStore(t)
+	const blob = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	writeUpload(t, blob, "<b>hello</b>")
+	itemStore.Add(Item{ID: "item_1", Type: "file", Content: "page.html", File: &FilePayload{Name: "page.html", StoredName: blob}})
+
+	download := func(query string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/uploads/"+blob+"?item=item_1"+query, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handleFileDownload(w, r)
+		return w
+	}
+
+	w := download("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("download: status %d, headers %v", w.Code, w.Header())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "attachment; filename=page.html" {
+		t.Errorf("disposition = %q", disposition)
+	}
+
+	if w := download("", "Range", "bytes=3-7"); w.Code != http.StatusPartialContent || w.Body.String() != "hello" ||
+		w.Header().Get("Content-Range") != "bytes 3-7/12" {
+		t.Errorf("range: status %d, body %q, range %q", w.Code, w.Body, w.Header().Get("Content-Range"))
+	}
+	if w := download("", "Range", "bytes=20-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: status %d", w.Code)
+	}
+	if w := download("", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d", w.Code)
+	}
+	// A stale If-Range gets the whole file
+	if w := download("", "Range", "bytes=3-7", "If-Range", `"stale"`); w.Code != http.StatusOK || w.Body.String() != "<b>hello</b>" {
+		t.Errorf("stale If-Range: status %d, body %q", w.Code, w.Body)
+	}
+
+	// Inline previews never render active content
+	w = download("&inline=1")
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Header().Get("Content-Security-Policy") != "sandbox" ||
+		!strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+		t.Errorf("inline headers = %v", w.Header())
+	}
+}